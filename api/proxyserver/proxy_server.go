@@ -3,7 +3,6 @@ package proxyserver
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os"
 	"reverseproxy/internal/constants"
 	"reverseproxy/internal/reverseproxy"
@@ -30,16 +29,29 @@ func ProxyServer(ctx context.Context, route *reverseproxy.Route) error {
 
 	log.Info(fmt.Sprintf("Proxy Server started for target name: %s, listening on %s:%d%s", route.Target.Name, route.ListenHost, route.ListenPort, route.Pattern))
 
+	server := reverseproxy.NewHTTPServer(route, mux)
+
 	// 	// Start the server without TLS configuration
 	if route.Protocol == "http" {
-		err = http.ListenAndServe(fmt.Sprintf("%s:%d", route.ListenHost, route.ListenPort), reverseproxy.HandleCORS(mux))
+		err = server.ListenAndServe()
 		if err != nil {
 			log.Error("Error starting proxy server")
 			return err
 		}
 	} else if route.Protocol == "https" {
+		// Start the companion listener redirecting plain HTTP to HTTPS
+		if route.HTTPRedirect != nil {
+			redirectServer := reverseproxy.NewRedirectServer(route)
+			go func() {
+				log.Info(fmt.Sprintf("HTTPS redirect listener started for route: %s, listening on %s", route.Name, redirectServer.Addr))
+				if err := redirectServer.ListenAndServe(); err != nil {
+					log.Error("Error starting redirect server", err, route.Name)
+				}
+			}()
+		}
+
 		// Start the server with TLS configuration
-		err = http.ListenAndServeTLS(fmt.Sprintf("%s:%d", route.ListenHost, route.ListenPort), route.CertFile, route.KeyFile, reverseproxy.HandleCORS(mux))
+		err = server.ListenAndServeTLS(route.CertFile, route.KeyFile)
 		if err != nil {
 			log.Error("Error starting proxy server")
 			return err
@@ -13,32 +13,165 @@ var LoggingLevel = SetLogLevel(GetEnv("LOG_LEVEL", "debug"))
 
 // Proxy Configurations
 const (
-	MaxIdleConns           = 10
-	ResponseHeaderTimeout  = 30 * time.Second
-	IdleConnTimeout        = 30 * time.Second
-	Timeout                = 5 * time.Second
-	KeepAlive              = 10 * time.Second
-	CORSAllowOrigin        = "*"
-	CORSMethods            = "GET, POST, PUT, DELETE, OPTIONS"
-	CORSHeaders            = "Content-Type, Authorization"
-	RealIPHeader           = "X-Real-IP"
-	ForwardedForHeader     = "X-Forwarded-For"
-	ForwardedHostHeader    = "X-Forwarded-Host"
-	ForwardedProtoHeader   = "X-Forwarded-Proto"
-	ForwardedURIHeader     = "X-Forwarded-URI"
-	ForwardedMethodHeader  = "X-Forwarded-Method"
-	ForwardedPathHeader    = "X-Forwarded-Path"
-	ForwardedQueryHeader   = "X-Forwarded-Query"
-	ForwardedPortHeader    = "X-Forwarded-Port"
-	CORSAllowOriginHeader  = "Access-Control-Allow-Origin"
-	CORSAllowMethodsHeader = "Access-Control-Allow-Methods"
-	CORSAllowHeadersHeader = "Access-Control-Allow-Headers"
-	HeartBeatInterval      = time.Second * 60
-	HeartBeatTimeout       = time.Second * 10
-	PrometheusPath         = "/metrics"
-	PrometheusPort         = "8091"
+	MaxIdleConns               = 10
+	ResponseHeaderTimeout      = 30 * time.Second
+	IdleConnTimeout            = 30 * time.Second
+	Timeout                    = 5 * time.Second
+	KeepAlive                  = 10 * time.Second
+	CORSAllowOrigin            = "*"
+	CORSMethods                = "GET, POST, PUT, DELETE, OPTIONS"
+	CORSHeaders                = "Content-Type, Authorization"
+	RealIPHeader               = "X-Real-IP"
+	ForwardedHeader            = "Forwarded"
+	ForwardedStyleLegacy       = "legacy"
+	ForwardedStyleStandard     = "standard"
+	ForwardedStyleBoth         = "both"
+	ForwardedForHeader         = "X-Forwarded-For"
+	ForwardedHostHeader        = "X-Forwarded-Host"
+	ForwardedProtoHeader       = "X-Forwarded-Proto"
+	ForwardedURIHeader         = "X-Forwarded-URI"
+	ForwardedMethodHeader      = "X-Forwarded-Method"
+	ForwardedPathHeader        = "X-Forwarded-Path"
+	ForwardedQueryHeader       = "X-Forwarded-Query"
+	ForwardedPortHeader        = "X-Forwarded-Port"
+	CORSAllowOriginHeader      = "Access-Control-Allow-Origin"
+	CORSAllowMethodsHeader     = "Access-Control-Allow-Methods"
+	CORSAllowHeadersHeader     = "Access-Control-Allow-Headers"
+	CORSAllowCredentialsHeader = "Access-Control-Allow-Credentials"
+	CORSExposeHeadersHeader    = "Access-Control-Expose-Headers"
+	CORSMaxAgeHeader           = "Access-Control-Max-Age"
+	CORSRequestMethodHeader    = "Access-Control-Request-Method"
+	CORSRequestHeadersHeader   = "Access-Control-Request-Headers"
+	OriginHeader               = "Origin"
+	HSTSHeader                 = "Strict-Transport-Security"
+	CSPHeader                  = "Content-Security-Policy"
+	FrameOptionsHeader         = "X-Frame-Options"
+	ContentTypeOptionsHeader   = "X-Content-Type-Options"
+	ReferrerPolicyHeader       = "Referrer-Policy"
+	PermissionsPolicyHeader    = "Permissions-Policy"
+	SecurityModeAdd            = "add"
+	SecurityModeOverride       = "override"
+	HSTSPreloadMinMaxAge       = 365 * 24 * time.Hour
+	ACMEChallengePath          = "/.well-known/acme-challenge/"
+	HealthPath                 = "/healthz"
+	WAFModeBlock               = "block"
+	WAFModeDetect              = "detect"
+	WAFActionBlock             = "block"
+	WAFActionTag               = "tag"
+	WAFTagHeader               = "X-WAF-Tags"
+	WAFBodyPrefixBytes         = 8 << 10
+	SigningHMACSHA256          = "hmac-sha256"
+	SigningHMACSHA512          = "hmac-sha512"
+	SignatureHeader            = "X-Proxy-Signature"
+	SignatureKeyIDHeader       = "X-Proxy-Key-Id"
+	SignatureTimestampHeader   = "X-Proxy-Timestamp"
+	SignatureBodyHashHeader    = "X-Proxy-Content-SHA256"
+	SigningMaxBodyBytes        = 10 << 20
+	SigningMinKeyBytes         = 32
+	RequestIDHeader            = "X-Request-ID"
+	BodyRewriteMaxBytes        = 4 << 20
+	BodyRewriteWindow          = 4 << 10
+	LocationHeader             = "Location"
+	ContentLocationHeader      = "Content-Location"
+	RefreshHeader              = "Refresh"
+	SetCookieHeader            = "Set-Cookie"
+	EncodingGzip               = "gzip"
+	EncodingBrotli             = "br"
+	EncodingZstd               = "zstd"
+	CompressionMinBytes        = 1024
+	BrotliLevel                = 5
+	CacheMaxBytes              = 64 << 20
+	CacheMaxEntryBytes         = 1 << 20
+	CacheHeuristicMaxAge       = 24 * time.Hour
+	CacheStatusHeader          = "Cache-Status"
+	CacheID                    = "reverseproxy"
+	CacheHit                   = "hit"
+	CacheMiss                  = "miss"
+	CacheStale                 = "stale"
+	CacheRevalidated           = "revalidated"
+	CacheBypass                = "bypass"
+	CacheCollapsed             = "collapsed"
+	CacheTierMemory            = "memory"
+	CacheTierDisk              = "disk"
+	CacheDiskMaxBytes          = 1 << 30
+	CacheDiskMaxEntryBytes     = 128 << 20
+	CacheMetaSuffix            = ".json"
+	CacheBodySuffix            = ".body"
+	CacheTempSuffix            = ".tmp"
+	CacheCoalesceTimeout       = 5 * time.Second
+	BodyRewriteDone            = "rewritten"
+	BodyRewriteTooLarge        = "too_large"
+	BodyRewriteUndecodable     = "undecodable"
+	BodyRewriteStreamed        = "streamed"
+	VaryHeader                 = "Vary"
+	HeartBeatInterval          = time.Second * 60
+	HeartBeatTimeout           = time.Second * 10
+	PrometheusPath             = "/metrics"
+	PrometheusPort             = "8091"
+	AuthorizationHeader        = "Authorization"
+	WWWAuthenticateHeader      = "WWW-Authenticate"
+	ForwardedUserHeader        = "X-Forwarded-User"
+	FileReloadInterval         = 2 * time.Second
+	JWKSRefreshInterval        = 5 * time.Minute
+	JWKSMinRefreshInterval     = 10 * time.Second
+	JWKSMaxSize                = 1 << 20
+	ForwardedEmailHeader       = "X-Forwarded-Email"
+	ForwardedGroupsHeader      = "X-Forwarded-Groups"
+	ForwardedAccessTokenHeader = "X-Forwarded-Access-Token"
+	OIDCDiscoveryPath          = "/.well-known/openid-configuration"
+	OIDCCookieName             = "_proxy_session"
+	OIDCStateCookieSuffix      = "_state"
+	OIDCLoginTimeout           = 10 * time.Minute
+	OIDCSessionLifetime        = 12 * time.Hour
+	OIDCDefaultTokenLifetime   = 5 * time.Minute
+	OIDCClockSkew              = 30 * time.Second
+	OIDCDiscoveryRetryInterval = 10 * time.Second
+	OIDCRefreshReuse           = 10 * time.Second
+	OIDCMinCookieSecretBytes   = 32
+	MaxCookieSize              = 4000
+	ForwardAuthMaxBodySize     = 64 << 10
+	ForwardAuthCacheSize       = 10000
+	RetryAfterHeader           = "Retry-After"
+	APIKeyHeader               = "X-API-Key"
+	ImpersonateHeaderPrefix    = "Impersonate-"
+	ServerReadHeaderTimeout    = 10 * time.Second
+	ServerIdleTimeout          = 2 * time.Minute
+	RejectBodyTooLarge         = "body_too_large"
+	RejectBodyTimeout          = "body_timeout"
+	RejectIncompleteHeader     = "incomplete_header"
+	ImpersonateUserHeader      = "Impersonate-User"
+	ImpersonateGroupHeader     = "Impersonate-Group"
+	RateLimitLimitHeader       = "X-RateLimit-Limit"
+	RateLimitRemainHeader      = "X-RateLimit-Remaining"
+	RateLimitResetHeader       = "X-RateLimit-Reset"
+	RateLimitKeyIP             = "ip"
+	RateLimitKeyHeader         = "header"
+	RateLimitKeyClaim          = "claim"
+	RateLimitKeyRoute          = "route"
+	RateLimitIdleTimeout       = 10 * time.Minute
 )
 
+// LeakyResponseHeaders are removed from responses by the security headers policy unless configured otherwise.
+var LeakyResponseHeaders = []string{"Server", "X-Powered-By"}
+
+// CompressionEncodings are the supported content codings in the default order of preference.
+var CompressionEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// CompressionContentTypes are compressed when a route does not configure content types.
+var CompressionContentTypes = []string{
+	"text/html", "text/css", "text/plain", "text/javascript", "text/xml",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+// OIDCDefaultScopes are requested when a route does not configure scopes.
+var OIDCDefaultScopes = []string{"openid", "email", "profile"}
+
+// HopByHopHeaders are removed from proxied requests by httputil.ReverseProxy or set by the transport.
+var HopByHopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
 // HTTP Headers
 var (
 	HeadersMap = map[string]string{
@@ -71,6 +204,97 @@ var (
 		Help:      "Duration of proxy requests",
 		Buckets:   prometheus.DefBuckets,
 	})
+	RateLimitRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "rate_limit_rejected_total",
+		Help:      "Total number of requests rejected by the rate limiter",
+	}, []string{"route"})
+	ConcurrencyInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "concurrency_in_flight",
+		Help:      "Number of in-flight requests per concurrency limiter",
+	}, []string{"scope", "name"})
+	ConcurrencyQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "concurrency_queue_depth",
+		Help:      "Number of requests waiting for an in-flight slot",
+	}, []string{"scope", "name"})
+	ConcurrencyQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "concurrency_queue_wait_seconds",
+		Help:      "Time requests spent waiting for an in-flight slot",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"scope", "name"})
+	ConcurrencyRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "concurrency_rejected_total",
+		Help:      "Total number of requests rejected by a concurrency limiter",
+	}, []string{"scope", "name"})
+	AdaptiveConcurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "adaptive_concurrency_limit",
+		Help:      "Current adaptive concurrency limit per target",
+	}, []string{"target"})
+	AdaptiveConcurrencyShedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "adaptive_concurrency_shed_total",
+		Help:      "Total number of requests shed by the adaptive concurrency limiter",
+	}, []string{"target"})
+	APIKeyRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "api_key_requests_total",
+		Help:      "Total number of requests authenticated per API key",
+	}, []string{"route", "key", "owner"})
+	APIKeyRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "api_key_rejected_total",
+		Help:      "Total number of requests rejected by API key authentication",
+	}, []string{"route", "reason"})
+	RequestRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "request_rejected_total",
+		Help:      "Total number of requests rejected by the listener and body limits",
+	}, []string{"route", "reason"})
+	WAFRuleHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "waf_rule_hits_total",
+		Help:      "Total number of requests matched by a WAF rule",
+	}, []string{"route", "rule", "action"})
+	BodyRewriteTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "body_rewrite_total",
+		Help:      "Total number of response bodies rewritten or passed through unchanged",
+	}, []string{"route", "result"})
+	CompressedResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "compressed_responses_total",
+		Help:      "Total number of responses compressed by the proxy",
+	}, []string{"route", "encoding"})
+	CacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "cache_requests_total",
+		Help:      "Total number of requests handled by the response cache by result",
+	}, []string{"route", "result"})
+	CacheStoredBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reverseproxy",
+		Subsystem: "metrics",
+		Name:      "cache_stored_bytes",
+		Help:      "Bytes of responses held by the response cache",
+	}, []string{"route", "tier"})
 )
 
 // SetLogLevel sets the logging level for the application.
@@ -0,0 +1,174 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// AdaptiveConcurrency configures an AIMD concurrency limiter for a target.
+// The limit grows by one for every window of requests whose latency stays within Tolerance times the
+// baseline latency and is multiplied by Backoff when latency rises above it or the upstream returns 5xx.
+type AdaptiveConcurrency struct {
+	InitialLimit int     `yaml:"initiallimit omitempty=false"`
+	MinLimit     int     `yaml:"minlimit omitempty=false"`
+	MaxLimit     int     `yaml:"maxlimit omitempty=false"`
+	Tolerance    float64 `yaml:"tolerance omitempty=false"` // latency multiplier over baseline, e.g. 2.0
+	Backoff      float64 `yaml:"backoff omitempty=false"`   // multiplicative decrease, e.g. 0.9
+}
+
+var (
+	// adaptiveLimiters holds the limiters shared by every route proxying to the same target.
+	adaptiveLimiters   = map[string]*AdaptiveLimiter{}
+	adaptiveLimitersMu sync.Mutex
+)
+
+// validateAdaptiveConcurrency validates the adaptive concurrency configuration of a target.
+func validateAdaptiveConcurrency(targetName string, ac *AdaptiveConcurrency) error {
+	if ac.MinLimit < 1 {
+		return fmt.Errorf("invalid adaptiveconcurrency minlimit for target %s", targetName)
+	}
+	if ac.MaxLimit < ac.MinLimit {
+		return fmt.Errorf("invalid adaptiveconcurrency maxlimit for target %s", targetName)
+	}
+	if ac.InitialLimit != 0 && (ac.InitialLimit < ac.MinLimit || ac.InitialLimit > ac.MaxLimit) {
+		return fmt.Errorf("invalid adaptiveconcurrency initiallimit for target %s", targetName)
+	}
+	if ac.Tolerance != 0 && ac.Tolerance < 1 {
+		return fmt.Errorf("invalid adaptiveconcurrency tolerance for target %s", targetName)
+	}
+	if ac.Backoff != 0 && (ac.Backoff <= 0 || ac.Backoff >= 1) {
+		return fmt.Errorf("invalid adaptiveconcurrency backoff for target %s", targetName)
+	}
+	return nil
+}
+
+// AdaptiveLimiter sheds requests once the in-flight count reaches a limit adjusted from upstream latency.
+type AdaptiveLimiter struct {
+	Name   string
+	Config *AdaptiveConcurrency
+
+	mu        sync.Mutex
+	limit     float64
+	inFlight  int
+	baseline  time.Duration // lowest recent latency, decays slowly towards current latency
+	successes int           // requests within tolerance since the last increase
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter for the named target.
+func NewAdaptiveLimiter(name string, config *AdaptiveConcurrency) *AdaptiveLimiter {
+	limit := config.InitialLimit
+	if limit == 0 {
+		limit = config.MinLimit
+	}
+	al := &AdaptiveLimiter{
+		Name:   name,
+		Config: config,
+		limit:  float64(limit),
+	}
+	constants.AdaptiveConcurrencyLimit.WithLabelValues(name).Set(al.limit)
+	return al
+}
+
+// targetAdaptiveLimiter returns the adaptive limiter shared by all routes proxying to the target.
+func targetAdaptiveLimiter(target Target) *AdaptiveLimiter {
+	adaptiveLimitersMu.Lock()
+	defer adaptiveLimitersMu.Unlock()
+
+	key := fmt.Sprintf("%s:%d", target.Host, target.Port)
+	if limiter, ok := adaptiveLimiters[key]; ok {
+		return limiter
+	}
+
+	limiter := NewAdaptiveLimiter(key, target.AdaptiveConcurrency)
+	adaptiveLimiters[key] = limiter
+	return limiter
+}
+
+// Limit returns the current concurrency limit.
+func (al *AdaptiveLimiter) Limit() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return int(al.limit)
+}
+
+// Acquire takes an in-flight slot and returns false if the limit is reached.
+func (al *AdaptiveLimiter) Acquire() bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.inFlight >= int(al.limit) {
+		return false
+	}
+	al.inFlight++
+	return true
+}
+
+// Release frees an in-flight slot and adjusts the limit from the request latency and outcome.
+func (al *AdaptiveLimiter) Release(latency time.Duration, failed bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.inFlight--
+
+	if al.baseline == 0 || latency < al.baseline {
+		al.baseline = latency
+	} else {
+		// let the baseline follow a permanent latency shift of the upstream
+		al.baseline += (latency - al.baseline) / 100
+	}
+
+	tolerance := al.Config.Tolerance
+	if tolerance == 0 {
+		tolerance = 2
+	}
+	backoff := al.Config.Backoff
+	if backoff == 0 {
+		backoff = 0.9
+	}
+
+	if failed || float64(latency) > float64(al.baseline)*tolerance {
+		al.limit = math.Max(float64(al.Config.MinLimit), al.limit*backoff)
+		al.successes = 0
+	} else {
+		al.successes++
+		if al.successes >= int(al.limit) {
+			al.limit = math.Min(float64(al.Config.MaxLimit), al.limit+1)
+			al.successes = 0
+		}
+	}
+
+	constants.AdaptiveConcurrencyLimit.WithLabelValues(al.Name).Set(al.limit)
+}
+
+// Middleware sheds requests over the adaptive limit with 503 and feeds upstream latency back into the limiter.
+func (al *AdaptiveLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !al.Acquire() {
+			constants.AdaptiveConcurrencyShedTotal.WithLabelValues(al.Name).Inc()
+			log.Warn("Adaptive concurrency limit reached", al.Name)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		// the latency is taken when the upstream response headers arrive, so slow clients and
+		// long response bodies do not count against the upstream
+		start := time.Now()
+		var latency time.Duration
+		status := http.StatusOK
+		writer := newHeaderWriter(w, func(_ http.Header, code int) {
+			latency = time.Since(start)
+			status = code
+		})
+		defer func() {
+			if latency == 0 {
+				latency = time.Since(start)
+			}
+			al.Release(latency, status >= http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(writer, r)
+	})
+}
@@ -0,0 +1,93 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAdaptiveLimiterRelease tests that the limit grows while latency is stable and shrinks on latency or errors.
+func TestAdaptiveLimiterRelease(t *testing.T) {
+	limiter := NewAdaptiveLimiter("target1", &AdaptiveConcurrency{InitialLimit: 2, MinLimit: 1, MaxLimit: 3, Backoff: 0.5})
+
+	for i := 0; i < 2; i++ {
+		limiter.Acquire()
+		limiter.Release(10*time.Millisecond, false)
+	}
+	if limiter.Limit() != 3 {
+		t.Fatalf("Expected limit to grow to 3 but got %d", limiter.Limit())
+	}
+
+	for i := 0; i < 10; i++ {
+		limiter.Acquire()
+		limiter.Release(10*time.Millisecond, false)
+	}
+	if limiter.Limit() != 3 {
+		t.Errorf("Expected limit to stay at max 3 but got %d", limiter.Limit())
+	}
+
+	limiter.Acquire()
+	limiter.Release(100*time.Millisecond, false)
+	if limiter.Limit() != 1 {
+		t.Errorf("Expected limit to back off to 1 on high latency but got %d", limiter.Limit())
+	}
+
+	limiter.Acquire()
+	limiter.Release(10*time.Millisecond, true)
+	if limiter.Limit() != 1 {
+		t.Errorf("Expected limit to stay at min 1 on errors but got %d", limiter.Limit())
+	}
+}
+
+// TestAdaptiveLimiterMiddleware tests that requests over the limit are shed with 503.
+func TestAdaptiveLimiterMiddleware(t *testing.T) {
+	limiter := NewAdaptiveLimiter("target1", &AdaptiveConcurrency{MinLimit: 1, MaxLimit: 1})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	if !limiter.Acquire() {
+		t.Fatalf("Expected to acquire a slot")
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 but got %v", w.Code)
+	}
+
+	limiter.Release(time.Millisecond, false)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status OK but got %v", w.Code)
+	}
+}
+
+// TestAdaptiveLimiterMiddlewareLatency tests that latency is taken at the upstream response headers,
+// not after the response body was streamed to the client.
+func TestAdaptiveLimiterMiddlewareLatency(t *testing.T) {
+	limiter := NewAdaptiveLimiter("target1", &AdaptiveConcurrency{InitialLimit: 2, MinLimit: 1, MaxLimit: 2, Backoff: 0.5})
+	limiter.baseline = 50 * time.Millisecond
+	status := http.StatusOK
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow body"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if limiter.Limit() != 2 {
+		t.Errorf("Expected the limit to stay at 2 for a slow body but got %d", limiter.Limit())
+	}
+	if limiter.baseline >= 50*time.Millisecond {
+		t.Errorf("Expected the baseline to follow the header latency but got %v", limiter.baseline)
+	}
+
+	status = http.StatusBadGateway
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if limiter.Limit() != 1 {
+		t.Errorf("Expected the limit to back off to 1 on 5xx but got %d", limiter.Limit())
+	}
+}
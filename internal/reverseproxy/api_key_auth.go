@@ -0,0 +1,256 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyAuth configures API key authentication for a route.
+// Keys are read from a YAML file of SHA-256 key hashes with metadata, which is reloaded when it changes.
+// The key is taken from Header or, if configured, from the QueryParam query parameter.
+type APIKeyAuth struct {
+	KeysFile    string `yaml:"keysfile omitempty=false"`
+	Header      string `yaml:"header omitempty=false"`      // defaults to X-API-Key
+	QueryParam  string `yaml:"queryparam omitempty=false"`  // query parameter accepted in addition to the header
+	OwnerHeader string `yaml:"ownerheader omitempty=false"` // header carrying the key owner upstream, defaults to X-Forwarded-User
+	KeepKey     bool   `yaml:"keepkey omitempty=false"`     // pass the key upstream instead of removing it
+}
+
+// apiKeysFile is the format of the keys file.
+type apiKeysFile struct {
+	Keys []apiKey `yaml:"keys"`
+}
+
+// apiKey is an entry of the keys file.
+type apiKey struct {
+	Name      string       `yaml:"name"`      // identifies the key in metrics, defaults to a hash prefix
+	Hash      string       `yaml:"hash"`      // hex SHA-256 of the key, optionally prefixed with "sha256:"
+	Owner     string       `yaml:"owner"`     // passed upstream and logged
+	Routes    []string     `yaml:"routes"`    // routes the key may be used on, all routes if empty
+	RateLimit *apiKeyQuota `yaml:"ratelimit"` // optional per-key limit
+	Expires   time.Time    `yaml:"expires"`   // optional expiry
+}
+
+// apiKeyQuota is the token-bucket limit of a key.
+type apiKeyQuota struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// validateAPIKeyAuth validates the API key configuration of a route.
+func validateAPIKeyAuth(routeName string, auth *APIKeyAuth) error {
+	if auth.KeysFile == "" {
+		return fmt.Errorf("apikeyauth keysfile is required for route %s", routeName)
+	}
+	return nil
+}
+
+// parseAPIKeys parses the keys file into a map of key hash to entry.
+func parseAPIKeys(data []byte) (map[string]*apiKey, error) {
+	file := apiKeysFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*apiKey{}
+	for i := range file.Keys {
+		key := &file.Keys[i]
+		key.Hash = strings.ToLower(strings.TrimPrefix(key.Hash, "sha256:"))
+		if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash for api key %d", i+1)
+		}
+		if key.Owner == "" {
+			return nil, fmt.Errorf("owner is required for api key %d", i+1)
+		}
+		if key.Name == "" {
+			key.Name = key.Hash[:8]
+		}
+		if key.RateLimit != nil {
+			if key.RateLimit.Rate <= 0 || key.RateLimit.Burst < 1 {
+				return nil, fmt.Errorf("invalid ratelimit for api key %s", key.Name)
+			}
+		}
+		keys[key.Hash] = key
+	}
+	return keys, nil
+}
+
+// APIKeyAuthenticator verifies API keys against a keys file.
+type APIKeyAuthenticator struct {
+	RouteName string
+	Config    *APIKeyAuth
+
+	keys *reloadableFile[map[string]*apiKey]
+	now  func() time.Time
+
+	limitersVersion int // version of the keys file apiKeyLimiters were pruned for, guarded by its lock
+}
+
+// apiKeyLimiterKey identifies the rate limiter of a key of a keys file.
+type apiKeyLimiterKey struct {
+	file string
+	hash string
+}
+
+// apiKeyLimiters holds the per-key rate limiters of all routes, so a key accepted on several routes
+// has a single quota. Limiters are kept across reloads while a key's limit is unchanged and
+// dropped when the key is removed from its file.
+var apiKeyLimiters = struct {
+	sync.Mutex
+	limiters map[apiKeyLimiterKey]*RateLimiter
+}{limiters: map[apiKeyLimiterKey]*RateLimiter{}}
+
+// NewAPIKeyAuthenticator loads the keys file of the configuration.
+func NewAPIKeyAuthenticator(routeName string, config *APIKeyAuth) (*APIKeyAuthenticator, error) {
+	keys, err := newReloadableFile(config.KeysFile, parseAPIKeys)
+	if err != nil {
+		return nil, fmt.Errorf("error loading api keys file for route %s: %w", routeName, err)
+	}
+	return &APIKeyAuthenticator{
+		RouteName: routeName,
+		Config:    config,
+		keys:      keys,
+		now:       time.Now,
+	}, nil
+}
+
+// header returns the header carrying the key.
+func (ka *APIKeyAuthenticator) header() string {
+	if ka.Config.Header != "" {
+		return ka.Config.Header
+	}
+	return constants.APIKeyHeader
+}
+
+// ownerHeader returns the header carrying the key owner upstream.
+func (ka *APIKeyAuthenticator) ownerHeader() string {
+	if ka.Config.OwnerHeader != "" {
+		return ka.Config.OwnerHeader
+	}
+	return constants.ForwardedUserHeader
+}
+
+// requestKey returns the key supplied with the request, preferring the header.
+func (ka *APIKeyAuthenticator) requestKey(r *http.Request) string {
+	if key := r.Header.Get(ka.header()); key != "" {
+		return key
+	}
+	if ka.Config.QueryParam != "" {
+		return r.URL.Query().Get(ka.Config.QueryParam)
+	}
+	return ""
+}
+
+// lookup returns the entry of the key, if it is known.
+func (ka *APIKeyAuthenticator) lookup(key string) (*apiKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+	entry, ok := ka.keys.Load()[hex.EncodeToString(sum[:])]
+	return entry, ok
+}
+
+// limiter returns the rate limiter of the key, or nil if the key has no limit.
+func (ka *APIKeyAuthenticator) limiter(entry *apiKey) *RateLimiter {
+	keys, version := ka.keys.LoadVersion()
+	apiKeyLimiters.Lock()
+	defer apiKeyLimiters.Unlock()
+	if version != ka.limitersVersion {
+		ka.limitersVersion = version
+		for limiterKey := range apiKeyLimiters.limiters {
+			if limiterKey.file != ka.Config.KeysFile {
+				continue
+			}
+			if key, ok := keys[limiterKey.hash]; !ok || key.RateLimit == nil {
+				delete(apiKeyLimiters.limiters, limiterKey)
+			}
+		}
+	}
+	if entry.RateLimit == nil {
+		return nil
+	}
+
+	limiterKey := apiKeyLimiterKey{file: ka.Config.KeysFile, hash: entry.Hash}
+	limiter, ok := apiKeyLimiters.limiters[limiterKey]
+	if !ok || limiter.Config.Rate != entry.RateLimit.Rate || limiter.Config.Burst != entry.RateLimit.Burst {
+		limiter = NewRateLimiter(ka.RouteName, &RateLimit{Rate: entry.RateLimit.Rate, Burst: entry.RateLimit.Burst})
+		limiter.now = ka.now
+		apiKeyLimiters.limiters[limiterKey] = limiter
+	}
+	return limiter
+}
+
+// removeKey removes the key from the request so it is not passed upstream.
+func (ka *APIKeyAuthenticator) removeKey(r *http.Request) {
+	r.Header.Del(ka.header())
+	if ka.Config.QueryParam == "" {
+		return
+	}
+	query := r.URL.Query()
+	if query.Has(ka.Config.QueryParam) {
+		query.Del(ka.Config.QueryParam)
+		r.URL.RawQuery = query.Encode()
+	}
+}
+
+// reject counts and logs a rejected request and writes the status, with a challenge naming the key header for 401.
+func (ka *APIKeyAuthenticator) reject(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	constants.APIKeyRejectedTotal.WithLabelValues(ka.RouteName, reason).Inc()
+	log.Warn("API key rejected", ka.RouteName, reason, clientIP(r))
+	if status == http.StatusUnauthorized {
+		w.Header().Set(constants.WWWAuthenticateHeader, fmt.Sprintf(`APIKey realm="%s", header="%s"`, ka.RouteName, ka.header()))
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Middleware rejects requests without a valid key and passes the key owner upstream.
+// Unknown or expired keys get 401, keys not allowed on the route 403 and keys over their limit 429.
+func (ka *APIKeyAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := ka.requestKey(r)
+		if key == "" {
+			ka.reject(w, r, http.StatusUnauthorized, "missing")
+			return
+		}
+		entry, ok := ka.lookup(key)
+		if !ok {
+			ka.reject(w, r, http.StatusUnauthorized, "invalid")
+			return
+		}
+		if !entry.Expires.IsZero() && ka.now().After(entry.Expires) {
+			ka.reject(w, r, http.StatusUnauthorized, "expired")
+			return
+		}
+		if len(entry.Routes) > 0 && !slices.Contains(entry.Routes, ka.RouteName) {
+			ka.reject(w, r, http.StatusForbidden, "route")
+			return
+		}
+		if limiter := ka.limiter(entry); limiter != nil {
+			allowed, _, wait := limiter.Allow(entry.Hash)
+			if !allowed {
+				w.Header().Set(constants.RetryAfterHeader, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				ka.reject(w, r, http.StatusTooManyRequests, "ratelimit")
+				return
+			}
+		}
+
+		constants.APIKeyRequestsTotal.WithLabelValues(ka.RouteName, entry.Name, entry.Owner).Inc()
+		if !ka.Config.KeepKey {
+			ka.removeKey(r)
+		}
+		r.Header.Set(ka.ownerHeader(), entry.Owner)
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, withIdentity(r, &Identity{User: entry.Owner, Method: "apikey"}))
+		log.Debug("API key request", ka.RouteName, entry.Name, entry.Owner, r.Method, r.URL.Path, recorder.status, clientIP(r))
+	})
+}
@@ -0,0 +1,231 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reverseproxy/pkg/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hashAPIKey returns the hex SHA-256 of the key as stored in the keys file.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestAPIKeyAuthenticatorMiddleware tests key lookup, expiry, route restrictions and per-key limits.
+func TestAPIKeyAuthenticatorMiddleware(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := `keys:
+  - name: ci
+    hash: "sha256:` + hashAPIKey("ci-key") + `"
+    owner: ci-bot
+    ratelimit:
+      rate: 1
+      burst: 2
+  - hash: "` + hashAPIKey("old-key") + `"
+    owner: retired
+    expires: 2020-01-01T00:00:00Z
+  - hash: "` + hashAPIKey("other-key") + `"
+    owner: other-team
+    routes: ["other"]
+`
+	if err := os.WriteFile(keysFile, []byte(keys), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+
+	authenticator, err := NewAPIKeyAuthenticator("route1", &APIKeyAuth{KeysFile: keysFile, QueryParam: "api_key"})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	now := time.Now()
+	authenticator.now = func() time.Time { return now }
+
+	var upstream *http.Request
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		header   string
+		target   string
+		wantCode int
+	}{
+		{name: "header", header: "ci-key", target: "/", wantCode: http.StatusOK},
+		{name: "query parameter", target: "/items?api_key=ci-key&page=2", wantCode: http.StatusOK},
+		{name: "over the key limit", header: "ci-key", target: "/", wantCode: http.StatusTooManyRequests},
+		{name: "missing", target: "/", wantCode: http.StatusUnauthorized},
+		{name: "unknown", header: "guess", target: "/", wantCode: http.StatusUnauthorized},
+		{name: "expired", header: "old-key", target: "/", wantCode: http.StatusUnauthorized},
+		{name: "other route", header: "other-key", target: "/", wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("X-Forwarded-User", "spoofed")
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantCode == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+				t.Errorf("Expected Retry-After 1 but got %q", w.Header().Get("Retry-After"))
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); (challenge == `APIKey realm="route1", header="X-API-Key"`) != (tt.wantCode == http.StatusUnauthorized) {
+				t.Errorf("Unexpected WWW-Authenticate %q", challenge)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if got := upstream.Header.Get("X-Forwarded-User"); got != "ci-bot" {
+				t.Errorf("Expected owner ci-bot upstream but got %q", got)
+			}
+			if upstream.Header.Get("X-API-Key") != "" || upstream.URL.Query().Has("api_key") {
+				t.Errorf("Expected the key to be removed from the upstream request but got %s", upstream.URL)
+			}
+			if identity, ok := identityFromContext(upstream.Context()); !ok || identity.User != "ci-bot" {
+				t.Errorf("Expected identity ci-bot in context")
+			}
+		})
+	}
+
+	// the bucket refills over time
+	now = now.Add(time.Second)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "ci-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status OK after the refill but got %d", w.Code)
+	}
+}
+
+// apiKeyLimiterCount returns the number of limiters of the keys file.
+func apiKeyLimiterCount(keysFile string) int {
+	apiKeyLimiters.Lock()
+	defer apiKeyLimiters.Unlock()
+	count := 0
+	for limiterKey := range apiKeyLimiters.limiters {
+		if limiterKey.file == keysFile {
+			count++
+		}
+	}
+	return count
+}
+
+// TestAPIKeyAuthenticatorReload tests that limiters of keys removed from the keys file are dropped
+// and that the key owner is logged with the outcome of the request.
+func TestAPIKeyAuthenticatorReload(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLog := log
+	logHandler, _ := logger.GetHandler(&logs, slog.LevelDebug)
+	log = &logger.Logger{Logger: slog.New(logHandler)}
+	defer func() { log = defaultLog }()
+
+	limitedKey := func(key, owner string) string {
+		return "  - hash: " + hashAPIKey(key) + "\n    owner: " + owner + "\n    ratelimit:\n      rate: 10\n      burst: 10\n"
+	}
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keysFile, []byte("keys:\n"+limitedKey("ci-key", "ci-bot")+limitedKey("old-key", "retired")), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+	authenticator, err := NewAPIKeyAuthenticator("route1", &APIKeyAuth{KeysFile: keysFile})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	serve := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	serve("ci-key")
+	serve("old-key")
+	if count := apiKeyLimiterCount(keysFile); count != 2 {
+		t.Fatalf("Expected a limiter per key but got %d", count)
+	}
+	if !strings.Contains(logs.String(), `"API key request"`) || !strings.Contains(logs.String(), `"ci-bot"`) || !strings.Contains(logs.String(), "202") {
+		t.Errorf("Expected the owner and status to be logged but got %s", logs.String())
+	}
+
+	if err := os.WriteFile(keysFile, []byte("keys:\n"+limitedKey("ci-key", "ci-bot")), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+	authenticator.keys.lastCheck = time.Time{}
+	if code := serve("ci-key"); code != http.StatusAccepted {
+		t.Fatalf("Expected status 202 but got %d", code)
+	}
+	if count := apiKeyLimiterCount(keysFile); count != 1 {
+		t.Errorf("Expected the limiter of the removed key to be dropped but got %d limiters", count)
+	}
+}
+
+// TestAPIKeyAuthenticatorSharedQuota tests that a key accepted on two routes has a single quota.
+func TestAPIKeyAuthenticatorSharedQuota(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := "keys:\n  - hash: " + hashAPIKey("ci-key") + "\n    owner: ci-bot\n    ratelimit:\n      rate: 0.1\n      burst: 1\n"
+	if err := os.WriteFile(keysFile, []byte(keys), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+	codes := []int{}
+	for _, route := range []string{"route1", "route2"} {
+		authenticator, err := NewAPIKeyAuthenticator(route, &APIKeyAuth{KeysFile: keysFile})
+		if err != nil {
+			t.Fatalf("Failed to create authenticator: %v", err)
+		}
+		handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", "ci-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Expected the second route to share the used up quota but got %v", codes)
+	}
+}
+
+// TestParseAPIKeys tests the keys file validation.
+func TestParseAPIKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "valid", data: "keys:\n  - hash: " + hashAPIKey("a") + "\n    owner: alice\n"},
+		{name: "empty", data: ""},
+		{name: "invalid hash", data: "keys:\n  - hash: abc\n    owner: alice\n", wantErr: true},
+		{name: "missing owner", data: "keys:\n  - hash: " + hashAPIKey("a") + "\n", wantErr: true},
+		{name: "invalid ratelimit", data: "keys:\n  - hash: " + hashAPIKey("a") + "\n    owner: alice\n    ratelimit:\n      rate: 0\n", wantErr: true},
+		{name: "invalid yaml", data: "keys: [", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseAPIKeys([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("parseAPIKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuth configures HTTP Basic authentication for a route.
+// Users are read from an htpasswd file with bcrypt ("$2y$") or SHA-512 crypt ("$6$") hashes,
+// which is reloaded when it changes.
+type BasicAuth struct {
+	HtpasswdFile       string `yaml:"htpasswdfile omitempty=false"`
+	Realm              string `yaml:"realm omitempty=false"`
+	StripAuthorization bool   `yaml:"stripauthorization omitempty=false"` // remove the Authorization header before proxying
+	UserHeader         string `yaml:"userheader omitempty=false"`         // header carrying the user upstream, defaults to X-Forwarded-User
+}
+
+// BasicAuthenticator verifies Basic credentials against an htpasswd file.
+type BasicAuthenticator struct {
+	RouteName string
+	Config    *BasicAuth
+
+	users *reloadableFile[map[string]string]
+
+	// verified caches a digest of the last verified password per user, since bcrypt is slow by design.
+	mu              sync.Mutex
+	verified        map[string][32]byte
+	verifiedVersion int
+}
+
+// validateBasicAuth validates the basic auth configuration of a route.
+func validateBasicAuth(routeName string, auth *BasicAuth) error {
+	if auth.HtpasswdFile == "" {
+		return fmt.Errorf("basicauth htpasswdfile is required for route %s", routeName)
+	}
+	if strings.Contains(auth.Realm, `"`) {
+		return fmt.Errorf("invalid basicauth realm for route %s", routeName)
+	}
+	return nil
+}
+
+// NewBasicAuthenticator loads the htpasswd file of the configuration.
+func NewBasicAuthenticator(routeName string, config *BasicAuth) (*BasicAuthenticator, error) {
+	users, err := newReloadableFile(config.HtpasswdFile, parseHtpasswd)
+	if err != nil {
+		return nil, fmt.Errorf("error loading htpasswd file for route %s: %w", routeName, err)
+	}
+	return &BasicAuthenticator{
+		RouteName: routeName,
+		Config:    config,
+		users:     users,
+		verified:  map[string][32]byte{},
+	}, nil
+}
+
+// parseHtpasswd parses "user:hash" lines, skipping blank lines and comments.
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, sha512CryptPrefix) {
+			return nil, fmt.Errorf("unsupported htpasswd hash for user %s, use bcrypt or SHA-512 crypt", user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Authenticate reports whether the user and password match an htpasswd entry.
+func (ba *BasicAuthenticator) Authenticate(user, password string) bool {
+	users, version := ba.users.LoadVersion()
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	ba.mu.Lock()
+	if ba.verifiedVersion != version {
+		ba.verified = map[string][32]byte{}
+		ba.verifiedVersion = version
+	}
+	cached, ok := ba.verified[user]
+	ba.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+
+	var match bool
+	if strings.HasPrefix(hash, sha512CryptPrefix) {
+		match, _ = compareSHA512Crypt(hash, password)
+	} else {
+		match = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if match {
+		ba.mu.Lock()
+		if ba.verifiedVersion == version {
+			ba.verified[user] = digest
+		}
+		ba.mu.Unlock()
+	}
+	return match
+}
+
+// userHeader returns the header carrying the authenticated user upstream.
+func (ba *BasicAuthenticator) userHeader() string {
+	if ba.Config.UserHeader != "" {
+		return ba.Config.UserHeader
+	}
+	return constants.ForwardedUserHeader
+}
+
+// Middleware challenges requests without valid credentials with 401 and passes the user upstream.
+func (ba *BasicAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !ba.Authenticate(user, password) {
+			if ok {
+				log.Warn("Basic authentication failed", ba.RouteName, user, clientIP(r))
+			}
+			realm := ba.Config.Realm
+			if realm == "" {
+				realm = ba.RouteName
+			}
+			w.Header().Set(constants.WWWAuthenticateHeader, fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if ba.Config.StripAuthorization {
+			r.Header.Del(constants.AuthorizationHeader)
+		}
+		r.Header.Set(ba.userHeader(), user)
+
+		next.ServeHTTP(w, withIdentity(r, &Identity{User: user, Method: "basic"}))
+	})
+}
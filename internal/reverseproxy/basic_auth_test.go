@@ -0,0 +1,124 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes an htpasswd file with a bcrypt entry for alice and the given extra lines.
+func writeHtpasswd(t *testing.T, path string, extra string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	content := "# users\nalice:" + string(hash) + "\n" + extra
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+}
+
+// TestBasicAuthenticatorMiddleware tests the 401 challenge, credential checks and upstream headers.
+func TestBasicAuthenticatorMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	// SHA-512 crypt of "Hello world!"
+	writeHtpasswd(t, path, "bob:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n")
+
+	authenticator, err := NewBasicAuthenticator("route1", &BasicAuth{HtpasswdFile: path, Realm: "dashboards", StripAuthorization: true})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	var upstream *http.Request
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantCode int
+	}{
+		{name: "bcrypt", user: "alice", password: "secret", wantCode: http.StatusOK},
+		{name: "bcrypt cached", user: "alice", password: "secret", wantCode: http.StatusOK},
+		{name: "sha512 crypt", user: "bob", password: "Hello world!", wantCode: http.StatusOK},
+		{name: "wrong password", user: "alice", password: "wrong", wantCode: http.StatusUnauthorized},
+		{name: "unknown user", user: "carol", password: "secret", wantCode: http.StatusUnauthorized},
+		{name: "no credentials", wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantCode == http.StatusUnauthorized {
+				if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="dashboards", charset="UTF-8"` {
+					t.Errorf("Unexpected WWW-Authenticate %q", got)
+				}
+				return
+			}
+			if upstream.Header.Get("Authorization") != "" {
+				t.Errorf("Expected Authorization header to be stripped")
+			}
+			if got := upstream.Header.Get("X-Forwarded-User"); got != tt.user {
+				t.Errorf("Expected X-Forwarded-User %q but got %q", tt.user, got)
+			}
+			if identity, ok := identityFromContext(upstream.Context()); !ok || identity.User != tt.user {
+				t.Errorf("Expected identity %q in context", tt.user)
+			}
+		})
+	}
+}
+
+// TestBasicAuthenticatorReload tests that users are reloaded when the htpasswd file changes.
+func TestBasicAuthenticatorReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "")
+
+	authenticator, err := NewBasicAuthenticator("route1", &BasicAuth{HtpasswdFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	if !authenticator.Authenticate("alice", "secret") {
+		t.Fatalf("Expected alice to authenticate")
+	}
+
+	// remove alice and force the next check to see the change
+	if err := os.WriteFile(path, []byte("bob:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+	authenticator.users.lastCheck = time.Time{}
+
+	if authenticator.Authenticate("alice", "secret") {
+		t.Errorf("Expected alice to be rejected after reload")
+	}
+	if !authenticator.Authenticate("bob", "Hello world!") {
+		t.Errorf("Expected bob to authenticate after reload")
+	}
+}
+
+// TestParseHtpasswd tests that unsupported hashes are rejected.
+func TestParseHtpasswd(t *testing.T) {
+	if _, err := parseHtpasswd([]byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")); err == nil {
+		t.Errorf("Expected error for unsupported hash")
+	}
+	if _, err := parseHtpasswd([]byte("alice\n")); err == nil {
+		t.Errorf("Expected error for missing hash")
+	}
+}
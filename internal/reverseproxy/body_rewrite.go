@@ -0,0 +1,387 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+)
+
+// BodyRewrite configures replacements in the response bodies of a route, e.g. to fix absolute links
+// of an application served below a sub-path.
+// Responses of the ContentTypes up to MaxBytes are buffered and rewritten; larger responses, partial
+// content and encodings other than gzip pass through unchanged. Clients accepting gzip are only
+// offered gzip by the upstream, so responses can be decoded.
+// Responses without a Content-Length stop being buffered when the upstream flushes: plain bodies are
+// rewritten as they stream, holding back a window of BodyRewriteWindow bytes, and gzip bodies pass through.
+type BodyRewrite struct {
+	ContentTypes []string          `yaml:"contenttypes omitempty=false"` // media types such as "text/html" or "text/*", defaults to text/html
+	Replacements []BodyReplacement `yaml:"replacements omitempty=false"`
+	MaxBytes     int64             `yaml:"maxbytes omitempty=false"` // defaults to 4 MiB
+}
+
+// BodyReplacement replaces a literal string or the matches of a regular expression.
+// With Regex, Replace may refer to groups as $1 or ${name}.
+type BodyReplacement struct {
+	Literal string `yaml:"literal omitempty=false"`
+	Regex   string `yaml:"regex omitempty=false"`
+	Replace string `yaml:"replace omitempty=false"`
+}
+
+// bodyReplacement is a parsed BodyReplacement.
+type bodyReplacement struct {
+	literal []byte
+	regex   *regexp.Regexp
+	replace []byte
+}
+
+// validateBodyRewrite validates the body rewrite configuration of a route.
+func validateBodyRewrite(routeName string, rewrite *BodyRewrite) error {
+	if _, err := NewBodyRewriter(routeName, rewrite); err != nil {
+		return err
+	}
+	if rewrite.MaxBytes < 0 {
+		return fmt.Errorf("invalid bodyrewrite maxbytes for route %s", routeName)
+	}
+	return nil
+}
+
+// BodyRewriter applies the replacements to response bodies.
+type BodyRewriter struct {
+	RouteName string
+	Config    *BodyRewrite
+
+	contentTypes []string
+	replacements []bodyReplacement
+	maxBytes     int64
+}
+
+// NewBodyRewriter parses the replacements of the configuration.
+func NewBodyRewriter(routeName string, config *BodyRewrite) (*BodyRewriter, error) {
+	br := &BodyRewriter{RouteName: routeName, Config: config, contentTypes: config.ContentTypes, maxBytes: config.MaxBytes}
+	if len(br.contentTypes) == 0 {
+		br.contentTypes = []string{"text/html"}
+	}
+	if br.maxBytes == 0 {
+		br.maxBytes = constants.BodyRewriteMaxBytes
+	}
+	if len(config.Replacements) == 0 {
+		return nil, fmt.Errorf("bodyrewrite replacements are required for route %s", routeName)
+	}
+	for i, replacement := range config.Replacements {
+		parsed := bodyReplacement{replace: []byte(replacement.Replace)}
+		switch {
+		case replacement.Literal != "" && replacement.Regex == "":
+			parsed.literal = []byte(replacement.Literal)
+		case replacement.Regex != "" && replacement.Literal == "":
+			re, err := regexp.Compile(replacement.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bodyrewrite regex %d for route %s: %w", i+1, routeName, err)
+			}
+			parsed.regex = re
+		default:
+			return nil, fmt.Errorf("either literal or regex is required for bodyrewrite replacement %d for route %s", i+1, routeName)
+		}
+		br.replacements = append(br.replacements, parsed)
+	}
+	return br, nil
+}
+
+// matchMediaType reports whether the media type of the Content-Type is one of the patterns,
+// which are media types such as "text/html" or wildcards such as "text/*".
+func matchMediaType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRewrite reports whether the response can be rewritten judging by its status and headers.
+func (br *BodyRewriter) shouldRewrite(r *http.Request, header http.Header, status int) bool {
+	if r.Method == http.MethodHead || status == http.StatusPartialContent || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	switch header.Get("Content-Encoding") {
+	case "", "identity", "gzip":
+	default:
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length > br.maxBytes {
+		constants.BodyRewriteTotal.WithLabelValues(br.RouteName, constants.BodyRewriteTooLarge).Inc()
+		return false
+	}
+	return matchMediaType(header.Get("Content-Type"), br.contentTypes)
+}
+
+// streamCut moves the point up to which a streamed body is rewritten back to the start of
+// any match spanning it, so that matches are only replaced once they are complete.
+func (br *BodyRewriter) streamCut(data []byte, cut int) int {
+	for moved := true; moved && cut > 0; {
+		moved = false
+		for _, replacement := range br.replacements {
+			start := cut
+			if replacement.regex != nil {
+				for _, match := range replacement.regex.FindAllIndex(data, -1) {
+					if match[0] < cut && match[1] > cut {
+						start = match[0]
+						break
+					}
+				}
+			} else if from := max(0, cut-len(replacement.literal)+1); from < cut {
+				if i := bytes.Index(data[from:], replacement.literal); i >= 0 && from+i < cut {
+					start = from + i
+				}
+			}
+			if start < cut {
+				cut, moved = start, true
+			}
+		}
+	}
+	return cut
+}
+
+// rewrite applies the replacements in order.
+func (br *BodyRewriter) rewrite(body []byte) []byte {
+	for _, replacement := range br.replacements {
+		if replacement.regex != nil {
+			body = replacement.regex.ReplaceAll(body, replacement.replace)
+		} else {
+			body = bytes.ReplaceAll(body, replacement.literal, replacement.replace)
+		}
+	}
+	return body
+}
+
+// errBodyTooLarge is returned when a decoded body exceeds the size ceiling.
+var errBodyTooLarge = errors.New("body exceeds the rewrite limit")
+
+// rewriteEncoded decodes a gzip body, rewrites it and encodes it again.
+func (br *BodyRewriter) rewriteEncoded(body []byte, encoding string) ([]byte, error) {
+	if encoding != "gzip" {
+		return br.rewrite(body), nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := io.ReadAll(io.LimitReader(reader, br.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > br.maxBytes {
+		return nil, errBodyTooLarge
+	}
+
+	var encoded bytes.Buffer
+	writer := gzip.NewWriter(&encoded)
+	writer.Write(br.rewrite(decoded))
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header accepts the content coding.
+func acceptsEncoding(header, coding string) bool {
+	return acceptEncodingQuality(header, coding) > 0
+}
+
+// acceptEncodingQuality returns the quality value the Accept-Encoding header gives the content coding,
+// falling back to that of "*"; codings that are not listed have quality 0.
+func acceptEncodingQuality(header, coding string) float64 {
+	wildcard := 0.0
+	for _, part := range splitHeaderList(header) {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		switch name = strings.TrimSpace(name); {
+		case strings.EqualFold(name, coding):
+			return q
+		case name == "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// Middleware rewrites the response bodies of the upstream.
+func (br *BodyRewriter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			r.Header.Set("Accept-Encoding", "gzip")
+		} else {
+			r.Header.Del("Accept-Encoding")
+		}
+
+		rw := &bodyRewriteWriter{ResponseWriter: w, rewriter: br, r: r}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// bodyRewriteWriter buffers a response body for rewriting until it exceeds the size ceiling,
+// after which the response passes through unchanged. A flush of a response without a Content-Length
+// switches to streaming, where the body is rewritten on every flush except for a carry-over window.
+type bodyRewriteWriter struct {
+	http.ResponseWriter
+	rewriter *BodyRewriter
+	r        *http.Request
+
+	wroteHeader bool
+	buffering   bool
+	streaming   bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (bw *bodyRewriteWriter) WriteHeader(status int) {
+	if bw.wroteHeader {
+		return
+	}
+	// informational responses are followed by the final one
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	bw.wroteHeader = true
+	bw.status = status
+	bw.buffering = bw.rewriter.shouldRewrite(bw.r, bw.Header(), status)
+	if !bw.buffering {
+		bw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (bw *bodyRewriteWriter) Write(data []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.buffering {
+		return bw.ResponseWriter.Write(data)
+	}
+	if bw.streaming {
+		bw.body.Write(data)
+		if int64(bw.body.Len()) > bw.rewriter.maxBytes {
+			bw.writeStreamed(false)
+		}
+		return len(data), nil
+	}
+	if int64(bw.body.Len()+len(data)) > bw.rewriter.maxBytes {
+		constants.BodyRewriteTotal.WithLabelValues(bw.rewriter.RouteName, constants.BodyRewriteTooLarge).Inc()
+		bw.passThrough()
+		return bw.ResponseWriter.Write(data)
+	}
+	return bw.body.Write(data)
+}
+
+// Flush is ignored while a body with a Content-Length is buffered. Other bodies are written
+// so far as they can be rewritten, or pass through unchanged if they are encoded.
+func (bw *bodyRewriteWriter) Flush() {
+	if bw.buffering && !bw.streaming {
+		if bw.Header().Get("Content-Length") != "" {
+			return
+		}
+		if bw.Header().Get("Content-Encoding") == "gzip" {
+			constants.BodyRewriteTotal.WithLabelValues(bw.rewriter.RouteName, constants.BodyRewriteStreamed).Inc()
+			bw.passThrough()
+		} else {
+			bw.streaming = true
+			bw.writeRewrittenHeader()
+		}
+	}
+	if bw.streaming {
+		bw.writeStreamed(false)
+	}
+	if flusher, ok := bw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (bw *bodyRewriteWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// passThrough writes the buffered response unchanged and stops buffering.
+func (bw *bodyRewriteWriter) passThrough() {
+	bw.buffering = false
+	bw.ResponseWriter.WriteHeader(bw.status)
+	bw.ResponseWriter.Write(bw.body.Bytes())
+	bw.body.Reset()
+}
+
+// writeRewrittenHeader writes the header of a rewritten response.
+func (bw *bodyRewriteWriter) writeRewrittenHeader() {
+	// the rewritten body is no longer byte-identical to the upstream representation
+	if etag := bw.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		bw.Header().Set("ETag", "W/"+etag)
+	}
+	bw.ResponseWriter.WriteHeader(bw.status)
+}
+
+// writeStreamed rewrites and writes the buffered part of a streamed body. Until the body is
+// complete, the last BodyRewriteWindow bytes and matches spanning them are carried over to the
+// next write, so matches longer than the window may be missed.
+func (bw *bodyRewriteWriter) writeStreamed(complete bool) {
+	data := bw.body.Bytes()
+	cut := len(data)
+	if !complete {
+		cut = bw.rewriter.streamCut(data, len(data)-constants.BodyRewriteWindow)
+	}
+	if cut <= 0 {
+		return
+	}
+	bw.ResponseWriter.Write(bw.rewriter.rewrite(data[:cut]))
+	bw.body.Next(cut)
+}
+
+// finish rewrites and writes a buffered response once the upstream response is complete.
+func (bw *bodyRewriteWriter) finish() {
+	if !bw.buffering {
+		return
+	}
+	if bw.streaming {
+		constants.BodyRewriteTotal.WithLabelValues(bw.rewriter.RouteName, constants.BodyRewriteDone).Inc()
+		bw.writeStreamed(true)
+		return
+	}
+	header := bw.Header()
+	body, err := bw.rewriter.rewriteEncoded(bw.body.Bytes(), header.Get("Content-Encoding"))
+	if err != nil {
+		result := constants.BodyRewriteUndecodable
+		if errors.Is(err, errBodyTooLarge) {
+			result = constants.BodyRewriteTooLarge
+		}
+		constants.BodyRewriteTotal.WithLabelValues(bw.rewriter.RouteName, result).Inc()
+		bw.passThrough()
+		return
+	}
+
+	constants.BodyRewriteTotal.WithLabelValues(bw.rewriter.RouteName, constants.BodyRewriteDone).Inc()
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	bw.buffering = false
+	bw.writeRewrittenHeader()
+	bw.ResponseWriter.Write(body)
+}
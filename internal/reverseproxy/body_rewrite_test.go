@@ -0,0 +1,213 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipBytes compresses the data.
+func gzipBytes(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+// TestBodyRewriterMiddleware tests rewriting of plain and gzip bodies and the pass-through cases.
+func TestBodyRewriterMiddleware(t *testing.T) {
+	rewriter, err := NewBodyRewriter("route1", &BodyRewrite{
+		ContentTypes: []string{"text/html", "application/json"},
+		Replacements: []BodyReplacement{
+			{Literal: `href="/`, Replace: `href="/grafana/`},
+			{Regex: `"url":\s*"/(\w+)"`, Replace: `"url": "/grafana/$1"`},
+		},
+		MaxBytes: 64,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		encoding    string
+		status      int
+		body        string
+		wantBody    string
+	}{
+		{name: "html", contentType: "text/html; charset=utf-8", body: `<a href="/login">`, wantBody: `<a href="/grafana/login">`},
+		{name: "json regex", contentType: "application/json", body: `{"url": "/dashboards"}`, wantBody: `{"url": "/grafana/dashboards"}`},
+		{name: "gzip", contentType: "text/html", encoding: "gzip", body: `<a href="/login">`, wantBody: `<a href="/grafana/login">`},
+		{name: "other content type", contentType: "text/css", body: `a[href="/x"]{}`, wantBody: `a[href="/x"]{}`},
+		{name: "other encoding", contentType: "text/html", encoding: "br", body: `<a href="/login">`, wantBody: `<a href="/login">`},
+		{name: "partial content", contentType: "text/html", status: http.StatusPartialContent, body: `<a href="/login">`, wantBody: `<a href="/login">`},
+		{name: "above ceiling", contentType: "text/html", body: `<a href="/login">` + strings.Repeat("x", 64), wantBody: `<a href="/login">` + strings.Repeat("x", 64)},
+		{name: "error page", contentType: "text/html", status: http.StatusNotFound, body: `<a href="/">`, wantBody: `<a href="/grafana/">`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acceptEncoding string
+			handler := rewriter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				body := []byte(tt.body)
+				if tt.encoding == "gzip" {
+					body = gzipBytes(t, tt.body)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Header().Set("ETag", `"v1"`)
+				status := tt.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				w.WriteHeader(status)
+				// written in two parts like a streamed upstream response
+				w.Write(body[:len(body)/2])
+				w.Write(body[len(body)/2:])
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if acceptEncoding != "gzip" {
+				t.Errorf("Expected the upstream to be offered gzip only but got %q", acceptEncoding)
+			}
+			body := w.Body.Bytes()
+			if tt.encoding == "gzip" {
+				reader, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("Expected a gzip body: %v", err)
+				}
+				body, _ = io.ReadAll(reader)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("Expected body %q but got %q", tt.wantBody, body)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Expected Content-Length %d but got %s", w.Body.Len(), got)
+			}
+			rewritten := tt.wantBody != tt.body
+			if got := w.Header().Get("ETag"); (got == `W/"v1"`) != rewritten {
+				t.Errorf("Unexpected ETag %s", got)
+			}
+		})
+	}
+}
+
+// TestBodyRewriterStreaming tests that responses without a Content-Length are written as the upstream flushes.
+func TestBodyRewriterStreaming(t *testing.T) {
+	rewriter, err := NewBodyRewriter("route1", &BodyRewrite{
+		Replacements: []BodyReplacement{
+			{Literal: `href="/`, Replace: `href="/grafana/`},
+			{Regex: `src="/(\w+)"`, Replace: `src="/grafana/$1"`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+	padding := strings.Repeat("x", constants.BodyRewriteWindow)
+	chunks := []string{`<a href="/a">` + padding + `<a hr`, `ef="/b"><img src="/lo`, `go">` + padding, `<a href="/c">`}
+
+	for _, encoding := range []string{"", "gzip"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			flushed := []int{}
+			handler := rewriter.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header().Set("Content-Encoding", encoding)
+				rw.Header().Set("ETag", `"v1"`)
+				if encoding == "gzip" {
+					rw.Write(gzipBytes(t, strings.Join(chunks, "")))
+					rw.(http.Flusher).Flush()
+					flushed = append(flushed, w.Body.Len())
+					return
+				}
+				for _, chunk := range chunks {
+					rw.Write([]byte(chunk))
+					rw.(http.Flusher).Flush()
+					flushed = append(flushed, w.Body.Len())
+				}
+			}))
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if flushed[0] == 0 || !w.Flushed {
+				t.Errorf("Expected the response to be written when the upstream flushes")
+			}
+			body := w.Body.String()
+			want := `<a href="/grafana/a">` + padding + `<a href="/grafana/b"><img src="/grafana/logo">` + padding + `<a href="/grafana/c">`
+			etag := `W/"v1"`
+			if encoding == "gzip" {
+				reader, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("Expected a gzip body: %v", err)
+				}
+				decoded, _ := io.ReadAll(reader)
+				body, want, etag = string(decoded), strings.Join(chunks, ""), `"v1"`
+			}
+			if body != want {
+				t.Errorf("Expected body %q but got %q", want, body)
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("Expected ETag %s but got %s", etag, got)
+			}
+		})
+	}
+}
+
+// TestAcceptsEncoding tests the Accept-Encoding parsing.
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "gzip, deflate, br", want: true},
+		{header: "br;q=1.0, GZIP;q=0.5", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "br", want: false},
+		{header: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// TestValidateBodyRewrite tests the body rewrite configuration validation.
+func TestValidateBodyRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite *BodyRewrite
+		wantErr bool
+	}{
+		{name: "valid", rewrite: &BodyRewrite{Replacements: []BodyReplacement{{Literal: "a", Replace: "b"}}}},
+		{name: "no replacements", rewrite: &BodyRewrite{}, wantErr: true},
+		{name: "literal and regex", rewrite: &BodyRewrite{Replacements: []BodyReplacement{{Literal: "a", Regex: "a"}}}, wantErr: true},
+		{name: "invalid regex", rewrite: &BodyRewrite{Replacements: []BodyReplacement{{Regex: "("}}}, wantErr: true},
+		{name: "negative maxbytes", rewrite: &BodyRewrite{Replacements: []BodyReplacement{{Literal: "a"}}, MaxBytes: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateBodyRewrite("route1", tt.rewrite); (err != nil) != tt.wantErr {
+				t.Errorf("validateBodyRewrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
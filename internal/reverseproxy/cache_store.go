@@ -0,0 +1,245 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response.
+// An entry with VaryHeaders is the index of a resource that varies: the variants are stored
+// under keys that include the values of those request headers.
+// The body is either held in Body or, in the disk tier, in BodyFile.
+type cacheEntry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte `json:"-"`
+	BodyFile     string
+	BodySize     int64
+	RequestTime  time.Time // when the request that produced the response was sent
+	ResponseTime time.Time // when the response was received
+	VaryHeaders  []string
+}
+
+// bodySize returns the length of the body.
+func (e *cacheEntry) bodySize() int64 {
+	if e.BodyFile != "" {
+		return e.BodySize
+	}
+	return int64(len(e.Body))
+}
+
+// openBody returns a reader of the body; bodies in the disk tier are streamed from their file.
+func (e *cacheEntry) openBody() (io.ReadCloser, error) {
+	if e.BodyFile == "" {
+		return io.NopCloser(bytes.NewReader(e.Body)), nil
+	}
+	file, err := os.Open(e.BodyFile)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := file.Stat(); err != nil || stat.Size() != e.BodySize {
+		file.Close()
+		return nil, errors.New("cache body file changed")
+	}
+	return file, nil
+}
+
+// size approximates the memory used by the entry.
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Key)) + e.bodySize()
+	for key, values := range e.Header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	for _, name := range e.VaryHeaders {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// cacheStore stores cache entries by key.
+type cacheStore interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(entry *cacheEntry)
+	Delete(key string)
+}
+
+// memoryCacheStore is a byte-bounded LRU cacheStore.
+type memoryCacheStore struct {
+	routeName string
+	maxBytes  int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	bytes   int64
+}
+
+// newMemoryCacheStore creates a store holding at most maxBytes.
+func newMemoryCacheStore(routeName string, maxBytes int64) *memoryCacheStore {
+	return &memoryCacheStore{routeName: routeName, maxBytes: maxBytes, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (ms *memoryCacheStore) Get(key string) (*cacheEntry, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	element, ok := ms.entries[key]
+	if !ok {
+		return nil, false
+	}
+	ms.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// Set stores the entry, evicting the least recently used entries to stay within the limit.
+// Entries are not modified once stored, so they can be shared with readers.
+func (ms *memoryCacheStore) Set(entry *cacheEntry) {
+	size := entry.size()
+	if size > ms.maxBytes {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if element, ok := ms.entries[entry.Key]; ok {
+		ms.remove(element)
+	}
+	ms.entries[entry.Key] = ms.lru.PushFront(entry)
+	ms.bytes += size
+	for ms.bytes > ms.maxBytes {
+		ms.remove(ms.lru.Back())
+	}
+	constants.CacheStoredBytes.WithLabelValues(ms.routeName, constants.CacheTierMemory).Set(float64(ms.bytes))
+}
+
+func (ms *memoryCacheStore) Delete(key string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if element, ok := ms.entries[key]; ok {
+		ms.remove(element)
+		constants.CacheStoredBytes.WithLabelValues(ms.routeName, constants.CacheTierMemory).Set(float64(ms.bytes))
+	}
+}
+
+// remove drops the element. The caller must hold the lock.
+func (ms *memoryCacheStore) remove(element *list.Element) {
+	entry := ms.lru.Remove(element).(*cacheEntry)
+	delete(ms.entries, entry.Key)
+	ms.bytes -= entry.size()
+}
+
+// tieredCacheStore keeps small responses in memory and larger ones on disk.
+// Vary indexes are kept in both tiers, so variants on disk stay reachable after a restart.
+type tieredCacheStore struct {
+	memory           *memoryCacheStore
+	disk             *diskCacheStore
+	memoryEntryBytes int64
+}
+
+func (ts *tieredCacheStore) Get(key string) (*cacheEntry, bool) {
+	if entry, ok := ts.memory.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := ts.disk.Get(key)
+	if ok && len(entry.VaryHeaders) > 0 {
+		ts.memory.Set(entry)
+	}
+	return entry, ok
+}
+
+func (ts *tieredCacheStore) Set(entry *cacheEntry) {
+	switch {
+	case len(entry.VaryHeaders) > 0:
+		ts.memory.Set(entry)
+		ts.disk.Set(entry)
+	case entry.BodyFile != "" || entry.bodySize() > ts.memoryEntryBytes:
+		ts.memory.Delete(entry.Key)
+		ts.disk.Set(entry)
+	default:
+		ts.disk.Delete(entry.Key)
+		ts.memory.Set(entry)
+	}
+}
+
+func (ts *tieredCacheStore) Delete(key string) {
+	ts.memory.Delete(key)
+	ts.disk.Delete(key)
+}
+
+// errCacheBodyTooLarge is returned when a response body exceeds the entry limit.
+var errCacheBodyTooLarge = errors.New("response exceeds the cache entry limit")
+
+// cacheBody collects a response body for the cache: in memory up to memoryBytes and,
+// with a disk tier, in a body file of the disk tier up to maxBytes.
+type cacheBody struct {
+	memoryBytes int64
+	maxBytes    int64
+	disk        *diskCacheStore
+
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (cb *cacheBody) Write(data []byte) error {
+	cb.size += int64(len(data))
+	if cb.size > cb.maxBytes {
+		return errCacheBodyTooLarge
+	}
+	if cb.file == nil && cb.size > cb.memoryBytes {
+		file, err := cb.disk.createBodyFile()
+		if err != nil {
+			return err
+		}
+		cb.file = file
+		if _, err := file.Write(cb.buf.Bytes()); err != nil {
+			return err
+		}
+		cb.buf = bytes.Buffer{}
+	}
+	if cb.file != nil {
+		_, err := cb.file.Write(data)
+		return err
+	}
+	cb.buf.Write(data)
+	return nil
+}
+
+// finish sets the body of the entry, committing a body file to disk.
+func (cb *cacheBody) finish(entry *cacheEntry) error {
+	if cb.file == nil {
+		entry.Body = bytes.Clone(cb.buf.Bytes())
+		return nil
+	}
+	err := cb.file.Sync()
+	if closeErr := cb.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(cb.file.Name())
+		return err
+	}
+	entry.BodyFile, entry.BodySize = cb.file.Name(), cb.size
+	cb.file = nil
+	return nil
+}
+
+// discard drops the collected body.
+func (cb *cacheBody) discard() {
+	cb.buf = bytes.Buffer{}
+	if cb.file != nil {
+		cb.file.Close()
+		os.Remove(cb.file.Name())
+		cb.file = nil
+	}
+}
@@ -0,0 +1,38 @@
+package reverseproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMemoryCacheStore tests the LRU eviction of the memory store.
+func TestMemoryCacheStore(t *testing.T) {
+	store := newMemoryCacheStore("grafana", 250)
+	body := []byte(strings.Repeat("x", 97))
+	for _, key := range []string{"a", "b"} {
+		store.Set(&cacheEntry{Key: key, Body: body})
+	}
+	// a becomes the most recently used, so c evicts b
+	if _, ok := store.Get("a"); !ok {
+		t.Fatal("Expected a to be stored")
+	}
+	store.Set(&cacheEntry{Key: "c", Body: body})
+	if _, ok := store.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, ok := store.Get("a"); !ok {
+		t.Errorf("Expected a to be kept")
+	}
+	if store.bytes != 196 {
+		t.Errorf("Expected 196 stored bytes but got %d", store.bytes)
+	}
+
+	store.Set(&cacheEntry{Key: "large", Body: []byte(strings.Repeat("x", 300))})
+	if _, ok := store.Get("large"); ok {
+		t.Errorf("Expected an entry above the limit not to be stored")
+	}
+	store.Delete("a")
+	if _, ok := store.Get("a"); ok || store.bytes != 98 {
+		t.Errorf("Expected a to be deleted, %d bytes left", store.bytes)
+	}
+}
@@ -0,0 +1,256 @@
+package reverseproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression configures compression of the responses of a route according to the client's Accept-Encoding.
+// Responses that are already encoded, partial, marked no-transform or smaller than MinBytes are sent as they are.
+type Compression struct {
+	Encodings    []string `yaml:"encodings omitempty=false"`    // zstd, br and gzip in order of preference, defaults to all of them
+	ContentTypes []string `yaml:"contenttypes omitempty=false"` // media types such as "text/html" or "text/*", defaults to common text types
+	MinBytes     int      `yaml:"minbytes omitempty=false"`     // defaults to 1024
+}
+
+// encoder is a compressing writer that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools hold reusable encoders per content coding.
+var encoderPools = map[string]*sync.Pool{
+	constants.EncodingGzip: {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	constants.EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(io.Discard, constants.BrotliLevel)
+	}},
+	constants.EncodingZstd: {New: func() any {
+		writer, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return writer
+	}},
+}
+
+// validateCompression validates the compression configuration of a route.
+func validateCompression(routeName string, compression *Compression) error {
+	for _, encoding := range compression.Encodings {
+		if !slices.Contains(constants.CompressionEncodings, encoding) {
+			return fmt.Errorf("invalid compression encoding %s for route %s", encoding, routeName)
+		}
+	}
+	if compression.MinBytes < 0 {
+		return fmt.Errorf("invalid compression minbytes for route %s", routeName)
+	}
+	return nil
+}
+
+// Compressor compresses the responses of a route.
+type Compressor struct {
+	RouteName string
+	Config    *Compression
+
+	encodings    []string
+	contentTypes []string
+	minBytes     int
+}
+
+// NewCompressor creates the compressor of the configuration.
+func NewCompressor(routeName string, config *Compression) *Compressor {
+	c := &Compressor{
+		RouteName:    routeName,
+		Config:       config,
+		encodings:    config.Encodings,
+		contentTypes: config.ContentTypes,
+		minBytes:     config.MinBytes,
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = constants.CompressionEncodings
+	}
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = constants.CompressionContentTypes
+	}
+	if c.minBytes == 0 {
+		c.minBytes = constants.CompressionMinBytes
+	}
+	return c
+}
+
+// negotiate returns the encoding with the highest quality in Accept-Encoding,
+// preferring the configured order on ties, or "" if none is accepted.
+func (c *Compressor) negotiate(acceptEncoding string) string {
+	best, bestQuality := "", 0.0
+	for _, encoding := range c.encodings {
+		if quality := acceptEncodingQuality(acceptEncoding, encoding); quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether the response may be compressed judging by its status and headers.
+// It adds Vary: Accept-Encoding to responses whose representation depends on the negotiation.
+func (c *Compressor) compressible(r *http.Request, header http.Header, status int) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if header.Get("Content-Range") != "" || !matchMediaType(header.Get("Content-Type"), c.contentTypes) {
+		return false
+	}
+	for _, directive := range splitHeaderList(header.Get("Cache-Control")) {
+		if strings.EqualFold(directive, "no-transform") {
+			return false
+		}
+	}
+
+	if !slices.ContainsFunc(header.Values(constants.VaryHeader), func(value string) bool {
+		return strings.Contains(strings.ToLower(value), "accept-encoding")
+	}) {
+		header.Add(constants.VaryHeader, "Accept-Encoding")
+	}
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < c.minBytes {
+		return false
+	}
+	return true
+}
+
+// Middleware compresses the responses with the encoding negotiated with the client.
+func (c *Compressor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, compressor: c, r: r, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// compressWriter buffers the start of an eligible response until it reaches the minimum size,
+// then compresses the rest of it.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	r          *http.Request
+	encoding   string
+
+	wroteHeader bool
+	pending     bool // eligible, waiting for minBytes
+	status      int
+	buf         []byte
+	encoder     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// informational responses are followed by the final one
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	cw.pending = status != http.StatusSwitchingProtocols && cw.compressor.compressible(cw.r, cw.Header(), status)
+	if !cw.pending {
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(data)
+	}
+	if !cw.pending {
+		return cw.ResponseWriter.Write(data)
+	}
+	cw.buf = append(cw.buf, data...)
+	if len(cw.buf) >= cw.compressor.minBytes {
+		if err := cw.startEncoder(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush compresses what was written so far, so streamed responses keep flowing.
+func (cw *compressWriter) Flush() {
+	if cw.pending && cw.encoder == nil {
+		if err := cw.startEncoder(); err != nil {
+			return
+		}
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// startEncoder writes the headers of the compressed response and the buffered start of the body.
+func (cw *compressWriter) startEncoder() error {
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	// the encoded representation differs from the upstream one
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	constants.CompressedResponsesTotal.WithLabelValues(cw.compressor.RouteName, cw.encoding).Inc()
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	cw.encoder = encoderPools[cw.encoding].Get().(encoder)
+	cw.encoder.Reset(cw.ResponseWriter)
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.encoder.Write(buf)
+	return err
+}
+
+// finish completes the compressed stream, or writes a response that stayed below the minimum size as it is.
+func (cw *compressWriter) finish() {
+	if cw.encoder != nil {
+		cw.encoder.Close()
+		cw.encoder.Reset(io.Discard)
+		encoderPools[cw.encoding].Put(cw.encoder)
+		cw.encoder = nil
+		return
+	}
+	if cw.pending {
+		cw.pending = false
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.ResponseWriter.Write(cw.buf)
+	}
+}
@@ -0,0 +1,175 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeBody decodes a response body with the content coding.
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	var reader io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to read gzip body: %v", err)
+		}
+		reader = gz
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to read zstd body: %v", err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return string(body)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decode %s body: %v", encoding, err)
+	}
+	return string(decoded)
+}
+
+// TestCompressorMiddleware tests the negotiation and the responses that are not compressed.
+func TestCompressorMiddleware(t *testing.T) {
+	compressor := NewCompressor("grafana", &Compression{MinBytes: 100})
+	large := strings.Repeat(`{"panel":"cpu"},`, 50)
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		header         map[string]string
+		status         int
+		body           string
+		unknownLength  bool
+		wantEncoding   string
+		wantVary       bool
+	}{
+		{name: "zstd preferred", acceptEncoding: "gzip, deflate, br, zstd", contentType: "application/json", body: large, wantEncoding: "zstd", wantVary: true},
+		{name: "client quality", acceptEncoding: "gzip;q=1.0, br;q=0.5", contentType: "application/json", body: large, wantEncoding: "gzip", wantVary: true},
+		{name: "brotli", acceptEncoding: "br", contentType: "text/html; charset=utf-8", body: large, wantEncoding: "br", wantVary: true},
+		{name: "unknown length", acceptEncoding: "gzip", contentType: "text/css", body: large, unknownLength: true, wantEncoding: "gzip", wantVary: true},
+		{name: "no accepted encoding", acceptEncoding: "deflate", contentType: "application/json", body: large},
+		{name: "below minimum", acceptEncoding: "gzip", contentType: "application/json", body: `{"ok":true}`, wantVary: true},
+		{name: "below minimum with unknown length", acceptEncoding: "gzip", contentType: "application/json", body: `{"ok":true}`, unknownLength: true, wantVary: true},
+		{name: "other content type", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "already encoded", acceptEncoding: "gzip", contentType: "application/json", header: map[string]string{"Content-Encoding": "br"}, body: large},
+		{name: "range response", acceptEncoding: "gzip", contentType: "application/json", header: map[string]string{"Content-Range": "bytes 0-799/2000"}, status: http.StatusPartialContent, body: large},
+		{name: "no-transform", acceptEncoding: "gzip", contentType: "application/json", header: map[string]string{"Cache-Control": "public, no-transform"}, body: large},
+		{name: "head", method: http.MethodHead, acceptEncoding: "gzip", contentType: "application/json", wantVary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := compressor.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("ETag", `"v1"`)
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				if !tt.unknownLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				status := tt.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				w.WriteHeader(status)
+				// written in parts like a streamed upstream response
+				for i := 0; i < len(tt.body); i += 64 {
+					w.Write([]byte(tt.body[i:min(i+64, len(tt.body))]))
+				}
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/api/dashboards", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			encoding := w.Header().Get("Content-Encoding")
+			if tt.header["Content-Encoding"] == "" && encoding != tt.wantEncoding {
+				t.Fatalf("Expected Content-Encoding %q but got %q", tt.wantEncoding, encoding)
+			}
+			if tt.wantEncoding != "" {
+				if got := decodeBody(t, encoding, w.Body.Bytes()); got != tt.body {
+					t.Errorf("Expected the decoded body to match the upstream body")
+				}
+				if w.Header().Get("Content-Length") != "" || w.Header().Get("ETag") != `W/"v1"` {
+					t.Errorf("Unexpected headers of a compressed response %v", w.Header())
+				}
+			} else {
+				if w.Body.String() != tt.body {
+					t.Errorf("Expected the body to pass through unchanged but got %q", w.Body.String())
+				}
+				if w.Header().Get("ETag") != `"v1"` {
+					t.Errorf("Expected the ETag to be kept but got %s", w.Header().Get("ETag"))
+				}
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+				t.Errorf("Expected Vary: Accept-Encoding %v but got %v", tt.wantVary, w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+// TestCompressorFlush tests that flushed parts of a streamed response reach the client.
+func TestCompressorFlush(t *testing.T) {
+	compressor := NewCompressor("grafana", &Compression{})
+	flushed := make(chan string, 1)
+	handler := compressor.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first part"))
+		w.(http.Flusher).Flush()
+		flushed <- w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String()
+		w.Write([]byte(" second part"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	reader, err := gzip.NewReader(strings.NewReader(<-flushed))
+	if err != nil {
+		t.Fatalf("Expected the gzip stream to start on flush: %v", err)
+	}
+	partial := make([]byte, len("first part"))
+	if _, err := io.ReadFull(reader, partial); err != nil || string(partial) != "first part" {
+		t.Errorf("Expected the flushed part to be readable but got %q, %v", partial, err)
+	}
+	if got := decodeBody(t, "gzip", w.Body.Bytes()); got != "first part second part" {
+		t.Errorf("Unexpected body %q", got)
+	}
+}
+
+// TestValidateCompression tests the compression configuration validation.
+func TestValidateCompression(t *testing.T) {
+	if err := validateCompression("route1", &Compression{Encodings: []string{"br", "gzip"}, MinBytes: 512}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+	if err := validateCompression("route1", &Compression{Encodings: []string{"deflate"}}); err == nil {
+		t.Errorf("Expected error for an unsupported encoding")
+	}
+	if err := validateCompression("route1", &Compression{MinBytes: -1}); err == nil {
+		t.Errorf("Expected error for a negative minbytes")
+	}
+}
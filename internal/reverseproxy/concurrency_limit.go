@@ -0,0 +1,149 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimit configures the maximum number of in-flight requests for a route or a target.
+// Requests over the limit wait in a queue of MaxQueue entries for up to QueueTimeout.
+type ConcurrencyLimit struct {
+	MaxRequests  int           `yaml:"maxrequests omitempty=false"`
+	MaxQueue     int           `yaml:"maxqueue omitempty=false"`
+	QueueTimeout time.Duration `yaml:"queuetimeout omitempty=false"`
+}
+
+var (
+	ErrQueueFull    = errors.New("concurrency queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in concurrency queue")
+
+	// targetLimiters holds the limiters shared by every route proxying to the same target.
+	targetLimiters   = map[string]*ConcurrencyLimiter{}
+	targetLimitersMu sync.Mutex
+)
+
+// validateConcurrencyLimit validates a concurrency limit configuration.
+func validateConcurrencyLimit(name string, cl *ConcurrencyLimit) error {
+	if cl.MaxRequests < 1 {
+		return fmt.Errorf("invalid concurrency maxrequests for %s", name)
+	}
+	if cl.MaxQueue < 0 {
+		return fmt.Errorf("invalid concurrency maxqueue for %s", name)
+	}
+	if cl.QueueTimeout < 0 {
+		return fmt.Errorf("invalid concurrency queuetimeout for %s", name)
+	}
+	return nil
+}
+
+// ConcurrencyLimiter is a semaphore with a bounded wait queue.
+type ConcurrencyLimiter struct {
+	Scope  string // "route" or "target"
+	Name   string
+	Config *ConcurrencyLimit
+
+	slots  chan struct{}
+	mu     sync.Mutex
+	queued int
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter for the named route or target.
+func NewConcurrencyLimiter(scope, name string, config *ConcurrencyLimit) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		Scope:  scope,
+		Name:   name,
+		Config: config,
+		slots:  make(chan struct{}, config.MaxRequests),
+	}
+}
+
+// targetConcurrencyLimiter returns the limiter shared by all routes proxying to the target.
+// The first configuration registered for a target wins.
+func targetConcurrencyLimiter(target Target) *ConcurrencyLimiter {
+	targetLimitersMu.Lock()
+	defer targetLimitersMu.Unlock()
+
+	key := fmt.Sprintf("%s:%d", target.Host, target.Port)
+	if limiter, ok := targetLimiters[key]; ok {
+		if *limiter.Config != *target.ConcurrencyLimit {
+			log.Warn("Target concurrency limit already registered with a different configuration", key)
+		}
+		return limiter
+	}
+
+	limiter := NewConcurrencyLimiter("target", key, target.ConcurrencyLimit)
+	targetLimiters[key] = limiter
+	return limiter
+}
+
+// Acquire takes an in-flight slot, waiting in the queue if all slots are busy.
+// The returned function must be called to release the slot.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case cl.slots <- struct{}{}:
+		constants.ConcurrencyInFlight.WithLabelValues(cl.Scope, cl.Name).Inc()
+		return cl.release, nil
+	default:
+	}
+
+	cl.mu.Lock()
+	if cl.queued >= cl.Config.MaxQueue {
+		cl.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	cl.queued++
+	constants.ConcurrencyQueueDepth.WithLabelValues(cl.Scope, cl.Name).Set(float64(cl.queued))
+	cl.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		cl.mu.Lock()
+		cl.queued--
+		constants.ConcurrencyQueueDepth.WithLabelValues(cl.Scope, cl.Name).Set(float64(cl.queued))
+		cl.mu.Unlock()
+		constants.ConcurrencyQueueWait.WithLabelValues(cl.Scope, cl.Name).Observe(time.Since(start).Seconds())
+	}()
+
+	var timeout <-chan time.Time
+	if cl.Config.QueueTimeout > 0 {
+		timer := time.NewTimer(cl.Config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case cl.slots <- struct{}{}:
+		constants.ConcurrencyInFlight.WithLabelValues(cl.Scope, cl.Name).Inc()
+		return cl.release, nil
+	case <-timeout:
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release frees an in-flight slot.
+func (cl *ConcurrencyLimiter) release() {
+	<-cl.slots
+	constants.ConcurrencyInFlight.WithLabelValues(cl.Scope, cl.Name).Dec()
+}
+
+// Middleware holds an in-flight slot for the duration of the request and returns 503 when none is available.
+func (cl *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := cl.Acquire(r.Context())
+		if err != nil {
+			constants.ConcurrencyRejectedTotal.WithLabelValues(cl.Scope, cl.Name).Inc()
+			log.Warn("Concurrency limit reached", cl.Scope, cl.Name, err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
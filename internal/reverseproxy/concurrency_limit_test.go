@@ -0,0 +1,86 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestConcurrencyLimiterAcquire tests the in-flight slots and the bounded queue.
+func TestConcurrencyLimiterAcquire(t *testing.T) {
+	limiter := NewConcurrencyLimiter("route", "route1", &ConcurrencyLimit{MaxRequests: 1, MaxQueue: 1, QueueTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	release, err := limiter.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Expected first request to acquire a slot but got %v", err)
+	}
+
+	// the queued request times out while the slot is held
+	if _, err := limiter.Acquire(ctx); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Expected ErrQueueTimeout but got %v", err)
+	}
+
+	// a queued request gets the slot once it is released
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := limiter.Acquire(ctx)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := limiter.Acquire(ctx); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull but got %v", err)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected queued request to acquire a slot but got %v", err)
+	}
+}
+
+// TestConcurrencyLimiterMiddleware tests that requests over the limit get 503.
+func TestConcurrencyLimiterMiddleware(t *testing.T) {
+	limiter := NewConcurrencyLimiter("route", "route1", &ConcurrencyLimit{MaxRequests: 1})
+	block := make(chan struct{})
+	started := make(chan struct{})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-block
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 but got %v", w.Code)
+	}
+
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected status OK but got %v", code)
+	}
+}
+
+// TestTargetConcurrencyLimiter tests that routes proxying to the same target share a limiter.
+func TestTargetConcurrencyLimiter(t *testing.T) {
+	target := Target{Host: "shared.example.com", Port: 8080, ConcurrencyLimit: &ConcurrencyLimit{MaxRequests: 2}}
+
+	if targetConcurrencyLimiter(target) != targetConcurrencyLimiter(target) {
+		t.Errorf("Expected the same limiter for the same target")
+	}
+}
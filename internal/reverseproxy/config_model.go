@@ -13,24 +13,49 @@ type Config struct {
 	Routes []Route `yaml:"routes"`
 }
 type Route struct {
-	Name       string `yaml:"name omitempty=false"`
-	ListenHost string `yaml:"listenhost omitempty=false"`
-	ListenPort int    `yaml:"listenport omitempty=false"`
-	Protocol   string `yaml:"protocol omitempty=false"`
-	Pattern    string `yaml:"pattern omitempty=false"`
-	CertFile   string `yaml:"certfile omitempty=false"`
-	KeyFile    string `yaml:"keyfile omitempty=false"`
-	Target     Target `yaml:"target omitempty=false"`
+	Name             string            `yaml:"name omitempty=false"`
+	ListenHost       string            `yaml:"listenhost omitempty=false"`
+	ListenPort       int               `yaml:"listenport omitempty=false"`
+	Protocol         string            `yaml:"protocol omitempty=false"`
+	Pattern          string            `yaml:"pattern omitempty=false"`
+	CertFile         string            `yaml:"certfile omitempty=false"`
+	KeyFile          string            `yaml:"keyfile omitempty=false"`
+	Target           Target            `yaml:"target omitempty=false"`
+	RateLimit        *RateLimit        `yaml:"ratelimit omitempty=false"`
+	ConcurrencyLimit *ConcurrencyLimit `yaml:"concurrencylimit omitempty=false"`
+	IPFilter         *IPFilter         `yaml:"ipfilter omitempty=false"`
+	TrustedProxies   []string          `yaml:"trustedproxies omitempty=false"`
+	Forwarded        *Forwarded        `yaml:"forwarded omitempty=false"`
+	BasicAuth        *BasicAuth        `yaml:"basicauth omitempty=false"`
+	JWTAuth          *JWTAuth          `yaml:"jwtauth omitempty=false"`
+	OIDC             *OIDC             `yaml:"oidc omitempty=false"`
+	ForwardAuth      *ForwardAuth      `yaml:"forwardauth omitempty=false"`
+	APIKeyAuth       *APIKeyAuth       `yaml:"apikeyauth omitempty=false"`
+	Server           *Server           `yaml:"server omitempty=false"`
+	BodyLimit        *BodyLimit        `yaml:"bodylimit omitempty=false"`
+	CORS             *CORS             `yaml:"cors omitempty=false"`
+	SecurityHeaders  *SecurityHeaders  `yaml:"securityheaders omitempty=false"`
+	HTTPRedirect     *HTTPRedirect     `yaml:"httpredirect omitempty=false"`
+	WAF              *WAF              `yaml:"waf omitempty=false"`
+	Headers          *HeaderRules      `yaml:"headers omitempty=false"`
+	BodyRewrite      *BodyRewrite      `yaml:"bodyrewrite omitempty=false"`
+	RedirectRewrite  *RedirectRewrite  `yaml:"redirectrewrite omitempty=false"`
+	Compression      *Compression      `yaml:"compression omitempty=false"`
+	Cache            *Cache            `yaml:"cache omitempty=false"`
 }
 
 type Target struct {
-	Name     string `yaml:"name omitempty=false"`
-	Protocol string `yaml:"protocol omitempty=false"`
-	Host     string `yaml:"host omitempty=false"`
-	Port     int    `yaml:"port omitempty=false"`
-	CertFile string `yaml:"certfile omitempty=false"`
-	KeyFile  string `yaml:"keyfile omitempty=false"`
-	CaCert   string `yaml:"cacert omitempty=false"`
+	Name                string               `yaml:"name omitempty=false"`
+	Protocol            string               `yaml:"protocol omitempty=false"`
+	Host                string               `yaml:"host omitempty=false"`
+	Port                int                  `yaml:"port omitempty=false"`
+	CertFile            string               `yaml:"certfile omitempty=false"`
+	KeyFile             string               `yaml:"keyfile omitempty=false"`
+	CaCert              string               `yaml:"cacert omitempty=false"`
+	ConcurrencyLimit    *ConcurrencyLimit    `yaml:"concurrencylimit omitempty=false"`
+	AdaptiveConcurrency *AdaptiveConcurrency `yaml:"adaptiveconcurrency omitempty=false"`
+	Credentials         *UpstreamCredentials `yaml:"credentials omitempty=false"`
+	Signing             *RequestSigning      `yaml:"signing omitempty=false"`
 }
 
 func (target *Target) GetTlsTransport() (*tls.Config, error) {
@@ -111,6 +136,155 @@ func validateRoute(route Route) error {
 		}
 	}
 
+	if err := validateTrustedProxies(route.Name, route.TrustedProxies); err != nil {
+		return err
+	}
+
+	if route.Forwarded != nil {
+		if err := validateForwarded(route.Name, route.Forwarded); err != nil {
+			return err
+		}
+	}
+
+	if route.Server != nil {
+		if err := validateServer(route.Name, route.Server); err != nil {
+			return err
+		}
+	}
+
+	if route.BodyLimit != nil {
+		if err := validateBodyLimit(route.Name, route.BodyLimit); err != nil {
+			return err
+		}
+	}
+
+	if route.HTTPRedirect != nil {
+		if err := validateHTTPRedirect(route, route.HTTPRedirect); err != nil {
+			return err
+		}
+	}
+
+	if route.SecurityHeaders != nil {
+		if err := validateSecurityHeaders(route, route.SecurityHeaders); err != nil {
+			return err
+		}
+	}
+
+	if route.CORS != nil {
+		if err := validateCORS(route.Name, route.CORS); err != nil {
+			return err
+		}
+	}
+
+	if route.IPFilter != nil {
+		if err := validateIPFilter(route.Name, route.IPFilter); err != nil {
+			return err
+		}
+	}
+
+	if route.WAF != nil {
+		if err := validateWAF(route.Name, route.WAF); err != nil {
+			return err
+		}
+	}
+
+	if route.Headers != nil {
+		if err := validateHeaderRules(route.Name, route.Headers); err != nil {
+			return err
+		}
+	}
+
+	if route.BodyRewrite != nil {
+		if err := validateBodyRewrite(route.Name, route.BodyRewrite); err != nil {
+			return err
+		}
+	}
+
+	if route.RedirectRewrite != nil {
+		if err := validateRedirectRewrite(route.Name, route.RedirectRewrite); err != nil {
+			return err
+		}
+	}
+
+	if route.Compression != nil {
+		if err := validateCompression(route.Name, route.Compression); err != nil {
+			return err
+		}
+	}
+
+	if route.BasicAuth != nil {
+		if err := validateBasicAuth(route.Name, route.BasicAuth); err != nil {
+			return err
+		}
+	}
+
+	if route.JWTAuth != nil {
+		if err := validateJWTAuth(route.Name, route.JWTAuth); err != nil {
+			return err
+		}
+	}
+
+	if route.OIDC != nil {
+		if err := validateOIDC(route.Name, route.OIDC); err != nil {
+			return err
+		}
+	}
+
+	if route.APIKeyAuth != nil {
+		if err := validateAPIKeyAuth(route.Name, route.APIKeyAuth); err != nil {
+			return err
+		}
+	}
+
+	if route.ForwardAuth != nil {
+		if err := validateForwardAuth(route.Name, route.ForwardAuth); err != nil {
+			return err
+		}
+	}
+
+	if route.RateLimit != nil {
+		if err := validateRateLimit(route, route.RateLimit); err != nil {
+			return err
+		}
+	}
+
+	if route.Cache != nil {
+		if err := validateCache(route.Name, route.Cache); err != nil {
+			return err
+		}
+	}
+
+	if route.ConcurrencyLimit != nil {
+		if err := validateConcurrencyLimit("route "+route.Name, route.ConcurrencyLimit); err != nil {
+			return err
+		}
+	}
+
+	if route.Target.ConcurrencyLimit != nil {
+		if err := validateConcurrencyLimit("target "+route.Target.Name, route.Target.ConcurrencyLimit); err != nil {
+			return err
+		}
+	}
+
+	if route.Target.AdaptiveConcurrency != nil {
+		if err := validateAdaptiveConcurrency(route.Target.Name, route.Target.AdaptiveConcurrency); err != nil {
+			return err
+		}
+	}
+
+	if route.Target.Credentials != nil {
+		authenticated := route.BasicAuth != nil || route.JWTAuth != nil || route.OIDC != nil || route.APIKeyAuth != nil
+		if err := validateUpstreamCredentials(route.Target.Name, route.Target.Credentials, authenticated); err != nil {
+			return err
+		}
+	}
+
+	if route.Target.Signing != nil {
+		if err := validateRequestSigning(route.Target.Name, route.Target.Signing); err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
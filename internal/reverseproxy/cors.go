@@ -0,0 +1,248 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures the cross-origin resource sharing policy of a route.
+// AllowedOrigins holds exact origins, wildcard subdomains such as "https://*.example.com" or "*" for any origin;
+// AllowedOriginPatterns holds regular expressions matched against the whole origin.
+// Routes without a policy get the permissive default of HandleCORS; Disabled turns CORS handling off.
+type CORS struct {
+	Disabled              bool          `yaml:"disabled omitempty=false"`
+	AllowedOrigins        []string      `yaml:"allowedorigins omitempty=false"`
+	AllowedOriginPatterns []string      `yaml:"allowedoriginpatterns omitempty=false"`
+	AllowedMethods        []string      `yaml:"allowedmethods omitempty=false"` // defaults to constants.CORSMethods
+	AllowedHeaders        []string      `yaml:"allowedheaders omitempty=false"` // defaults to constants.CORSHeaders, "*" allows any
+	ExposedHeaders        []string      `yaml:"exposedheaders omitempty=false"`
+	AllowCredentials      bool          `yaml:"allowcredentials omitempty=false"`
+	MaxAge                time.Duration `yaml:"maxage omitempty=false"` // how long browsers may cache a preflight
+}
+
+// defaultCORS is the policy of routes without a CORS configuration.
+var defaultCORS = &CORS{AllowedOrigins: []string{constants.CORSAllowOrigin}}
+
+// validateCORS validates the CORS configuration of a route.
+func validateCORS(routeName string, cors *CORS) error {
+	if cors.Disabled {
+		return nil
+	}
+	if _, err := NewCORSPolicy(cors); err != nil {
+		return fmt.Errorf("invalid cors for route %s: %w", routeName, err)
+	}
+	if cors.AllowCredentials && slices.Contains(cors.AllowedOrigins, "*") {
+		return fmt.Errorf("cors allowcredentials cannot be combined with any origin for route %s", routeName)
+	}
+	if cors.MaxAge < 0 {
+		return fmt.Errorf("invalid cors maxage for route %s", routeName)
+	}
+	return nil
+}
+
+// CORSPolicy answers preflight requests and adds CORS headers to responses.
+type CORSPolicy struct {
+	Config *CORS
+
+	anyOrigin  bool
+	origins    []string
+	subdomains []*url.URL // scheme and parent domain of wildcard origins
+	patterns   []*regexp.Regexp
+	methods    []string
+	headers    []string
+	anyHeader  bool
+}
+
+// NewCORSPolicy parses the origins, methods and headers of the configuration.
+func NewCORSPolicy(config *CORS) (*CORSPolicy, error) {
+	policy := &CORSPolicy{Config: config}
+	for _, origin := range config.AllowedOrigins {
+		switch {
+		case origin == "*":
+			policy.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			wildcard, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+			if err != nil || wildcard.Host == "" {
+				return nil, fmt.Errorf("invalid origin %s", origin)
+			}
+			policy.subdomains = append(policy.subdomains, wildcard)
+		default:
+			policy.origins = append(policy.origins, strings.ToLower(origin))
+		}
+	}
+	for _, pattern := range config.AllowedOriginPatterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %s: %w", pattern, err)
+		}
+		policy.patterns = append(policy.patterns, re)
+	}
+
+	policy.methods = slices.Clone(config.AllowedMethods)
+	if len(policy.methods) == 0 {
+		policy.methods = splitHeaderList(constants.CORSMethods)
+	}
+	for i, method := range policy.methods {
+		policy.methods[i] = strings.ToUpper(method)
+	}
+
+	headers := config.AllowedHeaders
+	if len(headers) == 0 {
+		headers = splitHeaderList(constants.CORSHeaders)
+	}
+	for _, header := range headers {
+		if header == "*" {
+			policy.anyHeader = true
+			continue
+		}
+		policy.headers = append(policy.headers, http.CanonicalHeaderKey(header))
+	}
+	return policy, nil
+}
+
+// splitHeaderList splits a comma separated header value.
+func splitHeaderList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// originAllowed reports whether the origin matches the policy.
+func (cp *CORSPolicy) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if cp.anyOrigin {
+		return true
+	}
+	if slices.Contains(cp.origins, strings.ToLower(origin)) {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil {
+		host := strings.ToLower(parsed.Host)
+		for _, wildcard := range cp.subdomains {
+			if parsed.Scheme == wildcard.Scheme && strings.HasSuffix(host, "."+wildcard.Host) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range cp.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether all requested headers are allowed.
+func (cp *CORSPolicy) headersAllowed(requested []string) bool {
+	if cp.anyHeader {
+		return true
+	}
+	for _, header := range requested {
+		if !slices.Contains(cp.headers, http.CanonicalHeaderKey(header)) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for an allowed origin.
+// The origin is echoed unless any origin is allowed without credentials.
+func (cp *CORSPolicy) allowOrigin(origin string) string {
+	if cp.anyOrigin && !cp.Config.AllowCredentials {
+		return "*"
+	}
+	return origin
+}
+
+// Middleware answers preflight requests and adds CORS headers to the responses of allowed origins.
+// Other OPTIONS requests are passed on to the upstream.
+func (cp *CORSPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(constants.OriginHeader)
+		requestMethod := r.Header.Get(constants.CORSRequestMethodHeader)
+		if r.Method == http.MethodOptions && origin != "" && requestMethod != "" {
+			cp.preflight(w, r, origin, requestMethod)
+			return
+		}
+
+		header := http.Header{}
+		if !cp.anyOrigin || cp.Config.AllowCredentials {
+			header.Add(constants.VaryHeader, constants.OriginHeader)
+		}
+		switch {
+		case cp.originAllowed(origin):
+			header.Set(constants.CORSAllowOriginHeader, cp.allowOrigin(origin))
+			if cp.Config.AllowCredentials {
+				header.Set(constants.CORSAllowCredentialsHeader, "true")
+			}
+			if len(cp.Config.ExposedHeaders) > 0 {
+				header.Set(constants.CORSExposeHeadersHeader, strings.Join(cp.Config.ExposedHeaders, ", "))
+			}
+		case cp.anyOrigin && !cp.Config.AllowCredentials:
+			// the wildcard response is the same for every origin and for non-CORS requests
+			header.Set(constants.CORSAllowOriginHeader, "*")
+		}
+
+		// the headers replace any CORS headers set by the upstream
+		next.ServeHTTP(newHeaderWriter(w, func(h http.Header, status int) {
+			for key := range h {
+				if strings.HasPrefix(key, "Access-Control-") {
+					h.Del(key)
+				}
+			}
+			for key, values := range header {
+				if key == constants.VaryHeader {
+					for _, value := range values {
+						h.Add(key, value)
+					}
+					continue
+				}
+				h[key] = values
+			}
+		}), r)
+	})
+}
+
+// preflight answers a preflight request with 204 if the origin, method and headers are allowed and 403 otherwise.
+func (cp *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request, origin, requestMethod string) {
+	w.Header().Add(constants.VaryHeader, constants.OriginHeader)
+	w.Header().Add(constants.VaryHeader, constants.CORSRequestMethodHeader)
+	w.Header().Add(constants.VaryHeader, constants.CORSRequestHeadersHeader)
+
+	requested := splitHeaderList(r.Header.Get(constants.CORSRequestHeadersHeader))
+	if !cp.originAllowed(origin) || !slices.Contains(cp.methods, strings.ToUpper(requestMethod)) || !cp.headersAllowed(requested) {
+		log.Debug("CORS preflight rejected", origin, requestMethod, requested)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(constants.CORSAllowOriginHeader, cp.allowOrigin(origin))
+	w.Header().Set(constants.CORSAllowMethodsHeader, strings.Join(cp.methods, ", "))
+	if cp.anyHeader {
+		if len(requested) > 0 {
+			w.Header().Set(constants.CORSAllowHeadersHeader, strings.Join(requested, ", "))
+		}
+	} else {
+		w.Header().Set(constants.CORSAllowHeadersHeader, strings.Join(cp.headers, ", "))
+	}
+	if cp.Config.AllowCredentials {
+		w.Header().Set(constants.CORSAllowCredentialsHeader, "true")
+	}
+	if cp.Config.MaxAge > 0 {
+		w.Header().Set(constants.CORSMaxAgeHeader, strconv.Itoa(int(cp.Config.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
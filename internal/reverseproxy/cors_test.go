@@ -0,0 +1,133 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCORSPolicyMiddleware tests origin matching, preflight handling and the headers of actual requests.
+func TestCORSPolicyMiddleware(t *testing.T) {
+	policy, err := NewCORSPolicy(&CORS{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.corp.example.com"},
+		AllowedOriginPatterns: []string{`https://pr-[0-9]+\.preview\.example\.com`},
+		AllowedMethods:        []string{"GET", "PUT"},
+		AllowedHeaders:        []string{"Content-Type", "X-Request-Id"},
+		ExposedHeaders:        []string{"X-Total-Count"},
+		AllowCredentials:      true,
+		MaxAge:                10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+
+	upstreamCalled := false
+	handler := policy.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		method         string
+		origin         string
+		requestMethod  string
+		requestHeaders string
+		wantCode       int
+		wantOrigin     string
+		wantUpstream   bool
+	}{
+		{name: "exact origin", method: http.MethodGet, origin: "https://app.example.com", wantCode: http.StatusOK, wantOrigin: "https://app.example.com", wantUpstream: true},
+		{name: "wildcard subdomain", method: http.MethodGet, origin: "https://grafana.corp.example.com", wantCode: http.StatusOK, wantOrigin: "https://grafana.corp.example.com", wantUpstream: true},
+		{name: "wildcard parent domain", method: http.MethodGet, origin: "https://corp.example.com", wantCode: http.StatusOK, wantUpstream: true},
+		{name: "wildcard other scheme", method: http.MethodGet, origin: "http://grafana.corp.example.com", wantCode: http.StatusOK, wantUpstream: true},
+		{name: "pattern", method: http.MethodGet, origin: "https://pr-42.preview.example.com", wantCode: http.StatusOK, wantOrigin: "https://pr-42.preview.example.com", wantUpstream: true},
+		{name: "pattern suffix", method: http.MethodGet, origin: "https://pr-42.preview.example.com.evil.com", wantCode: http.StatusOK, wantUpstream: true},
+		{name: "disallowed origin", method: http.MethodGet, origin: "https://evil.com", wantCode: http.StatusOK, wantUpstream: true},
+		{name: "preflight", method: http.MethodOptions, origin: "https://app.example.com", requestMethod: "PUT", requestHeaders: "content-type, x-request-id", wantCode: http.StatusNoContent, wantOrigin: "https://app.example.com"},
+		{name: "preflight disallowed method", method: http.MethodOptions, origin: "https://app.example.com", requestMethod: "DELETE", wantCode: http.StatusForbidden},
+		{name: "preflight disallowed header", method: http.MethodOptions, origin: "https://app.example.com", requestMethod: "GET", requestHeaders: "X-Other", wantCode: http.StatusForbidden},
+		{name: "preflight disallowed origin", method: http.MethodOptions, origin: "https://evil.com", requestMethod: "GET", wantCode: http.StatusForbidden},
+		{name: "non-preflight OPTIONS", method: http.MethodOptions, wantCode: http.StatusOK, wantUpstream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamCalled = false
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			if tt.requestHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if upstreamCalled != tt.wantUpstream {
+				t.Errorf("Expected upstream called %v but got %v", tt.wantUpstream, upstreamCalled)
+			}
+			if got := w.Header().Values("Access-Control-Allow-Origin"); (tt.wantOrigin == "" && len(got) != 0) || (tt.wantOrigin != "" && (len(got) != 1 || got[0] != tt.wantOrigin)) {
+				t.Errorf("Expected Access-Control-Allow-Origin %q but got %v", tt.wantOrigin, got)
+			}
+			if got := w.Header().Get("Vary"); got == "" {
+				t.Errorf("Expected Vary: Origin")
+			}
+			if tt.wantOrigin == "" {
+				return
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("Expected credentials to be allowed but got %q", got)
+			}
+			if tt.method == http.MethodOptions {
+				if w.Header().Get("Access-Control-Allow-Methods") != "GET, PUT" || w.Header().Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("Unexpected preflight headers %v", w.Header())
+				}
+			} else if got := w.Header().Get("Access-Control-Expose-Headers"); got != "X-Total-Count" {
+				t.Errorf("Expected exposed headers X-Total-Count but got %q", got)
+			}
+		})
+	}
+}
+
+// TestCORSDefaultPolicy tests that the default policy allows any origin with a wildcard.
+func TestCORSDefaultPolicy(t *testing.T) {
+	handler := HandleCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected a wildcard preflight response but got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Headers") != "Content-Type, Authorization" {
+		t.Errorf("Unexpected allowed headers %q", w.Header().Get("Access-Control-Allow-Headers"))
+	}
+}
+
+// TestValidateCORS tests the CORS configuration validation.
+func TestValidateCORS(t *testing.T) {
+	if err := validateCORS("route1", &CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Errorf("Expected error for credentials with any origin")
+	}
+	if err := validateCORS("route1", &CORS{AllowedOriginPatterns: []string{"("}}); err == nil {
+		t.Errorf("Expected error for an invalid pattern")
+	}
+	if err := validateCORS("route1", &CORS{Disabled: true}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache configures the disk tier of a route cache for responses above the memory entry limit.
+type DiskCache struct {
+	Dir           string `yaml:"dir omitempty=false"`           // directory of the route, created if missing
+	MaxBytes      int64  `yaml:"maxbytes omitempty=false"`      // LRU limit, defaults to 1 GiB
+	MaxEntryBytes int64  `yaml:"maxentrybytes omitempty=false"` // larger responses are not stored, defaults to 128 MiB
+}
+
+// validateDiskCache validates the disk tier configuration of a route cache.
+func validateDiskCache(routeName string, disk *DiskCache) error {
+	if disk.Dir == "" {
+		return fmt.Errorf("cache disk dir is required for route %s", routeName)
+	}
+	if disk.MaxBytes < 0 || disk.MaxEntryBytes < 0 {
+		return fmt.Errorf("invalid cache disk size for route %s", routeName)
+	}
+	if disk.MaxBytes > 0 && disk.MaxEntryBytes > disk.MaxBytes {
+		return fmt.Errorf("cache disk maxentrybytes exceeds maxbytes for route %s", routeName)
+	}
+	return nil
+}
+
+// diskCacheStore is a byte-bounded LRU cacheStore in a directory.
+// Each entry is a metadata file named by the hash of its key, referring to a body file.
+// Files are written to temporary names and renamed, and the metadata is written last,
+// so a crash leaves at most unreferenced files that are removed when the index is rebuilt.
+// The recency of entries is kept in the modification time of their metadata files.
+type diskCacheStore struct {
+	routeName     string
+	dir           string
+	maxBytes      int64
+	maxEntryBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	bytes   int64
+}
+
+// newDiskCacheStore creates the directory if needed and rebuilds the index from its files.
+func newDiskCacheStore(routeName string, config *DiskCache) (*diskCacheStore, error) {
+	ds := &diskCacheStore{
+		routeName:     routeName,
+		dir:           config.Dir,
+		maxBytes:      config.MaxBytes,
+		maxEntryBytes: config.MaxEntryBytes,
+		entries:       map[string]*list.Element{},
+		lru:           list.New(),
+	}
+	if ds.maxBytes == 0 {
+		ds.maxBytes = constants.CacheDiskMaxBytes
+	}
+	if ds.maxEntryBytes == 0 {
+		ds.maxEntryBytes = min(constants.CacheDiskMaxEntryBytes, ds.maxBytes)
+	}
+	if err := os.MkdirAll(ds.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir for route %s: %w", routeName, err)
+	}
+	if err := ds.rebuild(); err != nil {
+		return nil, fmt.Errorf("failed to read cache dir for route %s: %w", routeName, err)
+	}
+	return ds, nil
+}
+
+// metaPath returns the path of the metadata file of the key.
+func (ds *diskCacheStore) metaPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.dir, hex.EncodeToString(sum[:])+constants.CacheMetaSuffix)
+}
+
+// rebuild loads the metadata files in the order they were last used and removes
+// temporary files, body files without metadata and entries whose body file is incomplete.
+func (ds *diskCacheStore) rebuild() error {
+	files, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+	entries := []loaded{}
+	referenced := map[string]bool{}
+	for _, file := range files {
+		path := filepath.Join(ds.dir, file.Name())
+		switch {
+		case file.IsDir():
+		case strings.HasSuffix(file.Name(), constants.CacheTempSuffix):
+			os.Remove(path)
+		case strings.HasSuffix(file.Name(), constants.CacheMetaSuffix):
+			entry, err := ds.readMeta(path)
+			info, statErr := file.Info()
+			if err != nil || statErr != nil {
+				log.Warn("Removing unreadable cache file", ds.routeName, path, err)
+				os.Remove(path)
+				continue
+			}
+			referenced[entry.BodyFile] = true
+			entries = append(entries, loaded{entry: entry, modTime: info.ModTime()})
+		}
+	}
+	for _, file := range files {
+		path := filepath.Join(ds.dir, file.Name())
+		if strings.HasSuffix(file.Name(), constants.CacheBodySuffix) && !referenced[path] {
+			os.Remove(path)
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b loaded) int { return a.modTime.Compare(b.modTime) })
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, loaded := range entries {
+		ds.entries[loaded.entry.Key] = ds.lru.PushFront(loaded.entry)
+		ds.bytes += loaded.entry.size()
+	}
+	ds.evict()
+	return nil
+}
+
+// readMeta reads a metadata file and checks that its body file is complete.
+func (ds *diskCacheStore) readMeta(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	if ds.metaPath(entry.Key) != path {
+		return nil, fmt.Errorf("cache key does not match the file name")
+	}
+	if entry.BodyFile != "" {
+		entry.BodyFile = filepath.Join(ds.dir, filepath.Base(entry.BodyFile))
+		stat, err := os.Stat(entry.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() != entry.BodySize {
+			os.Remove(entry.BodyFile)
+			return nil, fmt.Errorf("incomplete cache body file %s", entry.BodyFile)
+		}
+	}
+	return entry, nil
+}
+
+// createBodyFile creates a body file for a response being received.
+// It is removed by the next rebuild unless an entry is stored with it.
+func (ds *diskCacheStore) createBodyFile() (*os.File, error) {
+	return os.CreateTemp(ds.dir, "*"+constants.CacheBodySuffix)
+}
+
+// writeFile writes a file atomically by renaming a synced temporary file.
+func (ds *diskCacheStore) writeFile(path string, data []byte) error {
+	file, err := os.CreateTemp(ds.dir, "*"+constants.CacheTempSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Get returns the entry and records the access in the modification time of its metadata file.
+func (ds *diskCacheStore) Get(key string) (*cacheEntry, bool) {
+	ds.mu.Lock()
+	element, ok := ds.entries[key]
+	if ok {
+		ds.lru.MoveToFront(element)
+	}
+	ds.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(ds.metaPath(key), now, now)
+	return element.Value.(*cacheEntry), true
+}
+
+// Set writes the entry, evicting the least recently used entries to stay within the limit.
+// Entries with a Body are written to a new body file; entries with a BodyFile must refer to
+// a file created by createBodyFile or to the body file of the stored entry.
+func (ds *diskCacheStore) Set(entry *cacheEntry) {
+	stored := *entry
+	if stored.BodyFile == "" && len(stored.Body) > 0 {
+		file, err := ds.createBodyFile()
+		if err != nil {
+			log.Error("Failed to write cache entry", ds.routeName, err)
+			return
+		}
+		file.Close()
+		if err := ds.writeFile(file.Name(), stored.Body); err != nil {
+			log.Error("Failed to write cache entry", ds.routeName, err)
+			os.Remove(file.Name())
+			return
+		}
+		stored.BodyFile, stored.BodySize = file.Name(), int64(len(stored.Body))
+	}
+	stored.Body = nil
+
+	if stored.size() > ds.maxEntryBytes {
+		ds.removeBody(&stored, nil)
+		return
+	}
+	meta := stored
+	meta.BodyFile = filepath.Base(stored.BodyFile)
+	if stored.BodyFile == "" {
+		meta.BodyFile = ""
+	}
+	data, err := json.Marshal(&meta)
+	if err == nil {
+		err = ds.writeFile(ds.metaPath(stored.Key), data)
+	}
+	if err != nil {
+		log.Error("Failed to write cache entry", ds.routeName, err)
+		ds.removeBody(&stored, nil)
+		return
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var previous *cacheEntry
+	if element, ok := ds.entries[stored.Key]; ok {
+		previous = ds.lru.Remove(element).(*cacheEntry)
+		ds.bytes -= previous.size()
+	}
+	ds.removeBody(previous, &stored)
+	ds.entries[stored.Key] = ds.lru.PushFront(&stored)
+	ds.bytes += stored.size()
+	ds.evict()
+}
+
+func (ds *diskCacheStore) Delete(key string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if element, ok := ds.entries[key]; ok {
+		ds.remove(element)
+		constants.CacheStoredBytes.WithLabelValues(ds.routeName, constants.CacheTierDisk).Set(float64(ds.bytes))
+	}
+}
+
+// evict removes the least recently used entries above the limit. The caller must hold the lock.
+func (ds *diskCacheStore) evict() {
+	for ds.bytes > ds.maxBytes {
+		ds.remove(ds.lru.Back())
+	}
+	constants.CacheStoredBytes.WithLabelValues(ds.routeName, constants.CacheTierDisk).Set(float64(ds.bytes))
+}
+
+// remove drops the element and its files. The caller must hold the lock.
+// Responses being served from the body file are not affected on systems that keep open files.
+func (ds *diskCacheStore) remove(element *list.Element) {
+	entry := ds.lru.Remove(element).(*cacheEntry)
+	delete(ds.entries, entry.Key)
+	ds.bytes -= entry.size()
+	os.Remove(ds.metaPath(entry.Key))
+	ds.removeBody(entry, nil)
+}
+
+// removeBody removes the body file of the entry unless the replacement uses it.
+func (ds *diskCacheStore) removeBody(entry, replacement *cacheEntry) {
+	if entry == nil || entry.BodyFile == "" || (replacement != nil && replacement.BodyFile == entry.BodyFile) {
+		return
+	}
+	os.Remove(entry.BodyFile)
+}
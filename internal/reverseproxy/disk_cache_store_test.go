@@ -0,0 +1,141 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDiskCacheStore tests the LRU eviction of the disk store and the rebuild of its index.
+func TestDiskCacheStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskCacheStore("downloads", &DiskCache{Dir: dir, MaxBytes: 250})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	body := []byte(strings.Repeat("x", 97))
+	for _, key := range []string{"a", "b"} {
+		store.Set(&cacheEntry{Key: key, Status: http.StatusOK, Header: http.Header{}, Body: body})
+	}
+	// a becomes the most recently used, so c evicts b
+	if _, ok := store.Get("a"); !ok {
+		t.Fatal("Expected a to be stored")
+	}
+	store.Set(&cacheEntry{Key: "c", Status: http.StatusOK, Header: http.Header{}, Body: body})
+	if _, ok := store.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, err := os.Stat(store.metaPath("b")); !os.IsNotExist(err) {
+		t.Errorf("Expected the files of b to be removed")
+	}
+
+	entry, ok := store.Get("c")
+	if !ok || entry.Body != nil || entry.BodySize != 97 {
+		t.Fatalf("Expected c to be stored in a body file")
+	}
+	reader, err := entry.openBody()
+	if err != nil {
+		t.Fatalf("Failed to open body: %v", err)
+	}
+	reader.Close()
+
+	// leftovers of a crash: a temporary file, a body without metadata and an incomplete body
+	os.WriteFile(filepath.Join(dir, "123.tmp"), []byte("partial"), 0o600)
+	os.WriteFile(filepath.Join(dir, "456.body"), []byte("orphan"), 0o600)
+	entryA, _ := store.Get("a")
+	os.WriteFile(entryA.BodyFile, []byte("truncated"), 0o600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(store.metaPath("c"), old, old)
+
+	rebuilt, err := newDiskCacheStore("downloads", &DiskCache{Dir: dir, MaxBytes: 250})
+	if err != nil {
+		t.Fatalf("Failed to rebuild store: %v", err)
+	}
+	if _, ok := rebuilt.Get("a"); ok {
+		t.Errorf("Expected the entry with an incomplete body to be dropped")
+	}
+	if _, ok := rebuilt.Get("c"); !ok {
+		t.Errorf("Expected c to be loaded")
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected only the files of c to be left but got %d files", len(files))
+	}
+
+	rebuilt.Delete("c")
+	if files, _ := os.ReadDir(dir); len(files) != 0 || rebuilt.bytes != 0 {
+		t.Errorf("Expected an empty store after deleting c")
+	}
+}
+
+// TestHTTPCacheDiskTier tests that large responses are streamed to and from the disk tier
+// and survive a restart.
+func TestHTTPCacheDiskTier(t *testing.T) {
+	config := &Cache{MaxEntryBytes: 64, Disk: &DiskCache{Dir: t.TempDir(), MaxEntryBytes: 4096}}
+	large := strings.Repeat("0123456789", 200)
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		body := "small"
+		switch r.URL.Path {
+		case "/large.bin":
+			body = large
+		case "/huge.bin":
+			body = large + large + large
+		}
+		for i := 0; i < len(body); i += 500 {
+			w.Write([]byte(body[i:min(i+500, len(body))]))
+		}
+	}}
+
+	hc, _ := newTestCache(t, &Route{Name: "downloads"}, config)
+	handler := hc.Middleware(upstream)
+	for _, path := range []string{"/large.bin", "/small.txt", "/huge.bin"} {
+		cacheGet(handler, path, nil)
+	}
+	if entry, ok := hc.disk.Get("example.com/large.bin"); !ok || entry.BodySize != int64(len(large)) {
+		t.Fatalf("Expected the large response in the disk tier")
+	}
+	if _, ok := hc.disk.Get("example.com/small.txt"); ok {
+		t.Errorf("Expected the small response to stay in memory")
+	}
+	if _, ok := hc.store.Get("example.com/huge.bin"); ok {
+		t.Errorf("Expected the response above the disk entry limit not to be stored")
+	}
+	files, _ := os.ReadDir(config.Disk.Dir)
+	if len(files) != 2 {
+		t.Errorf("Expected the metadata and body file of one entry but got %d files", len(files))
+	}
+
+	restarted, _ := newTestCache(t, &Route{Name: "downloads"}, config)
+	handler = restarted.Middleware(upstream)
+	w := cacheGet(handler, "/large.bin", nil)
+	if w.Body.String() != large || w.Header().Get("Content-Length") != "2000" {
+		t.Errorf("Expected the large response from the disk tier but got %d bytes", w.Body.Len())
+	}
+	if upstream.calls.Load() != 3 {
+		t.Errorf("Expected a cache hit after the restart but got %d upstream calls", upstream.calls.Load())
+	}
+
+	// a body file removed behind the store's back is fetched again
+	entry, _ := restarted.disk.Get("example.com/large.bin")
+	os.Remove(entry.BodyFile)
+	if w := cacheGet(handler, "/large.bin", nil); w.Body.String() != large || upstream.calls.Load() != 4 {
+		t.Errorf("Expected the response to be fetched again")
+	}
+}
+
+// TestValidateDiskCache tests the disk tier configuration validation.
+func TestValidateDiskCache(t *testing.T) {
+	if err := validateCache("route1", &Cache{Disk: &DiskCache{Dir: "/var/cache/reverseproxy", MaxBytes: 1 << 30}}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+	if err := validateCache("route1", &Cache{Disk: &DiskCache{}}); err == nil {
+		t.Errorf("Expected error for a missing dir")
+	}
+	if err := validateCache("route1", &Cache{Disk: &DiskCache{Dir: "cache", MaxBytes: 1 << 10, MaxEntryBytes: 1 << 20}}); err == nil {
+		t.Errorf("Expected error for a maxentrybytes above maxbytes")
+	}
+}
@@ -0,0 +1,226 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// ForwardAuth configures external authorization of requests by an auth service.
+// Before proxying, a subrequest with the original method, URI and RequestHeaders is sent to URL.
+// A 2xx response lets the request through with ResponseHeaders copied upstream;
+// any other response is returned to the client.
+type ForwardAuth struct {
+	URL             string        `yaml:"url omitempty=false"`
+	RequestHeaders  []string      `yaml:"requestheaders omitempty=false"`  // defaults to Authorization and Cookie
+	ResponseHeaders []string      `yaml:"responseheaders omitempty=false"` // copied to the upstream request on success
+	Timeout         time.Duration `yaml:"timeout omitempty=false"`
+	CacheTTL        time.Duration `yaml:"cachettl omitempty=false"`        // caches 2xx, 401 and 403 decisions, zero disables caching
+	CacheKeyHeaders []string      `yaml:"cachekeyheaders omitempty=false"` // decisions are cached per request target and value of these headers
+}
+
+// forwardAuthDecision is the outcome of an auth subrequest.
+type forwardAuthDecision struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// validateForwardAuth validates the forward auth configuration of a route.
+func validateForwardAuth(routeName string, auth *ForwardAuth) error {
+	authURL, err := url.Parse(auth.URL)
+	if err != nil || (authURL.Scheme != "http" && authURL.Scheme != "https") || authURL.Host == "" {
+		return fmt.Errorf("invalid forwardauth url for route %s", routeName)
+	}
+	if auth.CacheTTL > 0 && len(auth.CacheKeyHeaders) == 0 {
+		return fmt.Errorf("forwardauth cachekeyheaders are required with a cachettl for route %s", routeName)
+	}
+	return nil
+}
+
+// ForwardAuthenticator is a middleware delegating authorization to an auth service.
+type ForwardAuthenticator struct {
+	RouteName string
+	Config    *ForwardAuth
+
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*forwardAuthDecision
+}
+
+// NewForwardAuthenticator creates a ForwardAuthenticator for the route.
+func NewForwardAuthenticator(routeName string, config *ForwardAuth) *ForwardAuthenticator {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = constants.Timeout
+	}
+	return &ForwardAuthenticator{
+		RouteName: routeName,
+		Config:    config,
+		client: &http.Client{
+			Timeout: timeout,
+			// redirects, e.g. to a login page, are returned to the client
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		now:   time.Now,
+		cache: map[string]*forwardAuthDecision{},
+	}
+}
+
+// Middleware authorizes the request with the auth service before passing it on.
+func (fa *ForwardAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision, err := fa.authorize(r)
+		if err != nil {
+			log.Error("Error calling forward auth service", fa.RouteName, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		if decision.status < 200 || decision.status > 299 {
+			log.Debug("Forward auth denied request", fa.RouteName, decision.status, clientIP(r))
+			for key, values := range decision.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(decision.status)
+			w.Write(decision.body)
+			return
+		}
+
+		for _, header := range fa.Config.ResponseHeaders {
+			r.Header.Del(header)
+			for _, value := range decision.header.Values(header) {
+				r.Header.Add(header, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize returns the cached decision for the request or asks the auth service.
+func (fa *ForwardAuthenticator) authorize(r *http.Request) (*forwardAuthDecision, error) {
+	key := ""
+	if fa.Config.CacheTTL > 0 {
+		key = fa.cacheKey(r)
+		fa.mu.Lock()
+		decision, ok := fa.cache[key]
+		fa.mu.Unlock()
+		if ok && fa.now().Before(decision.expires) {
+			return decision, nil
+		}
+	}
+
+	decision, err := fa.subrequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// other responses, such as errors of the auth service, are not definite decisions
+	if fa.Config.CacheTTL > 0 && cacheableDecision(decision.status) {
+		decision.expires = fa.now().Add(fa.Config.CacheTTL)
+		fa.mu.Lock()
+		fa.evictExpired()
+		fa.cache[key] = decision
+		fa.mu.Unlock()
+	}
+	return decision, nil
+}
+
+// cacheableDecision reports whether a decision with the status may be cached: allows and
+// authentication or authorization denials.
+func cacheableDecision(status int) bool {
+	return (status >= 200 && status <= 299) || status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// subrequest sends the auth subrequest for the request.
+func (fa *ForwardAuthenticator) subrequest(r *http.Request) (*forwardAuthDecision, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, fa.Config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := fa.Config.RequestHeaders
+	if len(headers) == 0 {
+		headers = []string{constants.AuthorizationHeader, "Cookie"}
+	}
+	for _, header := range headers {
+		for _, value := range r.Header.Values(header) {
+			req.Header.Add(header, value)
+		}
+	}
+
+	req.Header.Set(constants.ForwardedMethodHeader, r.Method)
+	req.Header.Set(constants.ForwardedURIHeader, r.URL.RequestURI())
+	req.Header.Set(constants.ForwardedHostHeader, r.Host)
+	req.Header.Set(constants.ForwardedProtoHeader, requestProto(r))
+	req.Header.Set(constants.ForwardedForHeader, clientIP(r))
+
+	resp, err := fa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, constants.ForwardAuthMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	return &forwardAuthDecision{status: resp.StatusCode, header: header, body: body}, nil
+}
+
+// requestProto returns the scheme the request was received with.
+func requestProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// cacheKey hashes what the auth service is told about the request: the method, host, URI and
+// scheme sent as X-Forwarded-* headers, and the values of the cache key headers.
+func (fa *ForwardAuthenticator) cacheKey(r *http.Request) string {
+	h := sha256.New()
+	for _, part := range []string{r.Method, r.Host, r.URL.RequestURI(), requestProto(r)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	for _, header := range fa.Config.CacheKeyHeaders {
+		for _, value := range r.Header.Values(header) {
+			h.Write([]byte(value))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// evictExpired drops expired decisions once the cache is full. The caller must hold the lock.
+func (fa *ForwardAuthenticator) evictExpired() {
+	if len(fa.cache) < constants.ForwardAuthCacheSize {
+		return
+	}
+	now := fa.now()
+	for key, decision := range fa.cache {
+		if now.After(decision.expires) {
+			delete(fa.cache, key)
+		}
+	}
+	if len(fa.cache) >= constants.ForwardAuthCacheSize {
+		fa.cache = map[string]*forwardAuthDecision{}
+	}
+}
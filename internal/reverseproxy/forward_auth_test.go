@@ -0,0 +1,255 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestForwardAuthenticatorMiddleware tests allowed and denied subrequests against a local auth service.
+func TestForwardAuthenticatorMiddleware(t *testing.T) {
+	calls := 0
+	var subrequest *http.Request
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		subrequest = r
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Internal", "secret")
+			w.WriteHeader(http.StatusNoContent)
+		case "":
+			http.Redirect(w, r, "https://login.example.com/", http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "denied", http.StatusForbidden)
+		}
+	}))
+	defer authServer.Close()
+
+	authenticator := NewForwardAuthenticator("route1", &ForwardAuth{
+		URL:             authServer.URL + "/verify",
+		RequestHeaders:  []string{"Authorization"},
+		ResponseHeaders: []string{"X-Auth-User"},
+	})
+
+	var upstream *http.Request
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantLocation  string
+		wantBody      string
+	}{
+		{name: "allowed", authorization: "Bearer good", wantCode: http.StatusOK},
+		{name: "denied", authorization: "Bearer bad", wantCode: http.StatusForbidden, wantBody: "denied\n"},
+		{name: "login redirect", wantCode: http.StatusFound, wantLocation: "https://login.example.com/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			req := httptest.NewRequest(http.MethodDelete, "http://api.example.com/items/1?force=true", nil)
+			req.Header.Set("Cookie", "session=abc")
+			req.Header.Set("X-Auth-User", "spoofed")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if subrequest.Method != http.MethodDelete || subrequest.URL.Path != "/verify" ||
+				subrequest.Header.Get("X-Forwarded-Uri") != "/items/1?force=true" || subrequest.Header.Get("X-Forwarded-Host") != "api.example.com" {
+				t.Errorf("Unexpected subrequest %s %s %v", subrequest.Method, subrequest.URL, subrequest.Header)
+			}
+			if subrequest.Header.Get("Cookie") != "" {
+				t.Errorf("Expected only the selected headers in the subrequest")
+			}
+			if tt.wantCode != http.StatusOK {
+				if upstream != nil {
+					t.Errorf("Expected the request not to reach the upstream")
+				}
+				if got := w.Header().Get("Location"); got != tt.wantLocation {
+					t.Errorf("Expected Location %q but got %q", tt.wantLocation, got)
+				}
+				if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+					t.Errorf("Expected body %q but got %q", tt.wantBody, w.Body.String())
+				}
+				return
+			}
+			if got := upstream.Header.Get("X-Auth-User"); got != "alice" {
+				t.Errorf("Expected X-Auth-User alice but got %q", got)
+			}
+			if got := upstream.Header.Get("X-Internal"); got != "" {
+				t.Errorf("Expected unselected response headers not to be copied but got %q", got)
+			}
+		})
+	}
+
+	if calls != len(tests) {
+		t.Errorf("Expected %d subrequests without caching but got %d", len(tests), calls)
+	}
+}
+
+// TestForwardAuthenticatorCache tests that decisions are cached per cache key for the TTL.
+func TestForwardAuthenticatorCache(t *testing.T) {
+	calls := 0
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Auth-User", "alice")
+	}))
+	defer authServer.Close()
+
+	authenticator := NewForwardAuthenticator("route1", &ForwardAuth{
+		URL:             authServer.URL,
+		RequestHeaders:  []string{"Authorization"},
+		ResponseHeaders: []string{"X-Auth-User"},
+		CacheTTL:        time.Minute,
+		CacheKeyHeaders: []string{"Authorization"},
+	})
+	now := time.Now()
+	authenticator.now = func() time.Time { return now }
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Auth-User")))
+	}))
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := serve("Bearer good"); w.Code != http.StatusOK || w.Body.String() != "alice" {
+			t.Fatalf("Expected cached allow but got %d %q", w.Code, w.Body.String())
+		}
+		if w := serve("Bearer bad"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected cached deny but got %d", w.Code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 subrequests within the TTL but got %d", calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	serve("Bearer good")
+	if calls != 3 {
+		t.Errorf("Expected a new subrequest after the TTL but got %d calls", calls)
+	}
+}
+
+// TestForwardAuthenticatorCacheKey tests that cached decisions are not reused for another request target.
+func TestForwardAuthenticatorCacheKey(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Method") != http.MethodGet || r.Header.Get("X-Forwarded-Uri") != "/public" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer authServer.Close()
+
+	authenticator := NewForwardAuthenticator("route1", &ForwardAuth{
+		URL:             authServer.URL,
+		CacheTTL:        time.Minute,
+		CacheKeyHeaders: []string{"Cookie"},
+	})
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{method: http.MethodGet, target: "/public", wantStatus: http.StatusOK},
+		{method: http.MethodDelete, target: "/public", wantStatus: http.StatusForbidden},
+		{method: http.MethodGet, target: "/admin", wantStatus: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://other.example.com/public", wantStatus: http.StatusOK},
+		{method: http.MethodGet, target: "/public?export=all", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Header.Set("Cookie", "session=abc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("Expected status %d for %s %s but got %d", tt.wantStatus, tt.method, tt.target, w.Code)
+		}
+	}
+}
+
+// TestForwardAuthenticatorCacheErrors tests that failures of the auth service are not cached.
+func TestForwardAuthenticatorCacheErrors(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusFound, http.StatusOK}
+	calls := 0
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls < len(statuses) {
+			w.WriteHeader(statuses[calls])
+		}
+		calls++
+	}))
+	defer authServer.Close()
+
+	authenticator := NewForwardAuthenticator("route1", &ForwardAuth{
+		URL:             authServer.URL,
+		CacheTTL:        time.Minute,
+		CacheKeyHeaders: []string{"Authorization"},
+	})
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range append(statuses, http.StatusOK, http.StatusOK) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Expected status %d for request %d but got %d", want, i+1, w.Code)
+		}
+	}
+	if calls != len(statuses) {
+		t.Errorf("Expected a subrequest until the first allow but got %d", calls)
+	}
+}
+
+// TestForwardAuthenticatorUnavailable tests that an unreachable auth service fails closed.
+func TestForwardAuthenticatorUnavailable(t *testing.T) {
+	authServer := httptest.NewServer(http.NotFoundHandler())
+	authServer.Close()
+
+	authenticator := NewForwardAuthenticator("route1", &ForwardAuth{URL: authServer.URL})
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected the request not to reach the upstream")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502 but got %d", w.Code)
+	}
+}
+
+// TestValidateForwardAuth tests the forward auth configuration validation.
+func TestValidateForwardAuth(t *testing.T) {
+	if err := validateForwardAuth("route1", &ForwardAuth{URL: "auth:8080/verify"}); err == nil {
+		t.Errorf("Expected error for an invalid url")
+	}
+	if err := validateForwardAuth("route1", &ForwardAuth{URL: "http://auth:8080/verify", CacheTTL: time.Minute}); err == nil {
+		t.Errorf("Expected error for a cache TTL without cache key headers")
+	}
+	if err := validateForwardAuth("route1", &ForwardAuth{URL: "http://auth:8080/verify"}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+}
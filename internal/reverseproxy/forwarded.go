@@ -0,0 +1,234 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+)
+
+// Forwarded configures which forwarding headers a route sends to its target.
+// Style is "legacy" for the X-Forwarded-* headers (default), "standard" for the RFC 7239 Forwarded header or "both".
+// By is the identifier of the proxy in the "by" parameter; it defaults to the listen address ("unknown:port" without a listen IP)
+// and may be an obfuscated identifier such as "_proxy1" or "unknown".
+type Forwarded struct {
+	Style string `yaml:"style omitempty=false"`
+	By    string `yaml:"by omitempty=false"`
+}
+
+// forwardedElement is a single element of a Forwarded header.
+type forwardedElement struct {
+	For   string
+	By    string
+	Proto string
+	Host  string
+}
+
+// validateForwarded validates the forwarded header configuration of a route.
+func validateForwarded(routeName string, fwd *Forwarded) error {
+	switch fwd.Style {
+	case "", constants.ForwardedStyleLegacy, constants.ForwardedStyleStandard, constants.ForwardedStyleBoth:
+	default:
+		return fmt.Errorf("invalid forwarded style %s for route %s", fwd.Style, routeName)
+	}
+	if fwd.By != "" && fwd.By != "unknown" && !strings.HasPrefix(fwd.By, "_") {
+		if _, err := netip.ParseAddr(fwd.By); err != nil {
+			if _, err := netip.ParseAddrPort(fwd.By); err != nil {
+				return fmt.Errorf("invalid forwarded by %s for route %s", fwd.By, routeName)
+			}
+		}
+	}
+	return nil
+}
+
+// forwardedStyle returns the configured style of the route, defaulting to legacy.
+func forwardedStyle(route *Route) string {
+	if route.Forwarded == nil || route.Forwarded.Style == "" {
+		return constants.ForwardedStyleLegacy
+	}
+	return route.Forwarded.Style
+}
+
+// forwardedBy returns the "by" identifier of the route: the configured one, or the listen address.
+// A listen host that is empty, as for ":8080", or not an IP address is not a valid node name
+// (RFC 7239 section 6), so it is sent as "unknown" with the port.
+func forwardedBy(route *Route) string {
+	if route.Forwarded != nil && route.Forwarded.By != "" {
+		return route.Forwarded.By
+	}
+	if route.ListenPort <= 0 {
+		return ""
+	}
+	host := route.ListenHost
+	if _, err := netip.ParseAddr(host); err != nil {
+		host = "unknown"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(route.ListenPort))
+}
+
+// setForwarded appends an element describing this hop to the Forwarded header of the request.
+// A Forwarded header is only kept when it was sent by a trusted proxy.
+func setForwarded(r *http.Request, route *Route, trusted bool) {
+	element := formatForwardedElement(forwardedElement{
+		For:   remoteIP(r),
+		By:    forwardedBy(route),
+		Proto: route.Protocol,
+		Host:  r.Host,
+	})
+
+	prior := r.Header.Values(constants.ForwardedHeader)
+	if trusted && len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	r.Header.Set(constants.ForwardedHeader, element)
+}
+
+// formatForwardedElement formats an element as defined by RFC 7239 section 4.
+func formatForwardedElement(element forwardedElement) string {
+	pairs := []string{}
+	if element.For != "" {
+		pairs = append(pairs, "for="+quoteForwardedValue(formatForwardedNode(element.For)))
+	}
+	if element.By != "" {
+		pairs = append(pairs, "by="+quoteForwardedValue(formatForwardedNode(element.By)))
+	}
+	if element.Proto != "" {
+		pairs = append(pairs, "proto="+quoteForwardedValue(element.Proto))
+	}
+	if element.Host != "" {
+		pairs = append(pairs, "host="+quoteForwardedValue(element.Host))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// formatForwardedNode brackets IPv6 addresses as required for node identifiers.
+func formatForwardedNode(node string) string {
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return formatForwardedAddr(addrPort.Addr()) + ":" + strconv.Itoa(int(addrPort.Port()))
+	}
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return formatForwardedAddr(addr)
+	}
+	return node
+}
+
+// formatForwardedAddr formats an address, bracketing IPv6.
+func formatForwardedAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		return "[" + addr.String() + "]"
+	}
+	return addr.String()
+}
+
+// quoteForwardedValue returns the value as a token, or as a quoted-string when it contains other characters.
+func quoteForwardedValue(value string) string {
+	if value != "" && strings.IndexFunc(value, func(c rune) bool { return !isTokenChar(c) }) == -1 {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// isTokenChar reports whether the character is allowed in an RFC 7230 token.
+func isTokenChar(c rune) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// parseForwarded parses the Forwarded header values into elements.
+// Parameters that cannot be parsed end the element they belong to.
+func parseForwarded(values []string) []forwardedElement {
+	elements := []forwardedElement{}
+	for _, value := range values {
+		for _, raw := range splitQuoted(value, ',') {
+			element := forwardedElement{}
+			for _, pair := range splitQuoted(raw, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					break
+				}
+				val = unquoteForwardedValue(strings.TrimSpace(val))
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					element.For = val
+				case "by":
+					element.By = val
+				case "proto":
+					element.Proto = val
+				case "host":
+					element.Host = val
+				}
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits the string on the separator outside of quoted-strings.
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && quoted:
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquoteForwardedValue removes the quotes and escapes of a quoted-string.
+func unquoteForwardedValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// forwardedNodeIP returns the IP of a node identifier, or false for obfuscated and unknown nodes.
+func forwardedNodeIP(node string) (string, bool) {
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap().String(), true
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return addr.Unmap().String(), true
+	}
+	return "", false
+}
+
+// forwardedChain returns the "for" addresses of the Forwarded header in order.
+// Obfuscated and unknown nodes are returned as is so that they stop a client IP walk.
+func forwardedChain(header http.Header) []string {
+	hops := []string{}
+	for _, element := range parseForwarded(header.Values(constants.ForwardedHeader)) {
+		if ip, ok := forwardedNodeIP(element.For); ok {
+			hops = append(hops, ip)
+		} else {
+			hops = append(hops, element.For)
+		}
+	}
+	return hops
+}
@@ -0,0 +1,153 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// TestFormatForwardedElement tests quoting of IPv6 nodes, ports and obfuscated identifiers.
+func TestFormatForwardedElement(t *testing.T) {
+	tests := []struct {
+		name    string
+		element forwardedElement
+		want    string
+	}{
+		{name: "ipv4", element: forwardedElement{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"}, want: "for=192.0.2.60;by=203.0.113.43;proto=http"},
+		{name: "ipv6", element: forwardedElement{For: "2001:db8:cafe::17"}, want: `for="[2001:db8:cafe::17]"`},
+		{name: "ipv6 with port", element: forwardedElement{For: "[2001:db8:cafe::17]:4711"}, want: `for="[2001:db8:cafe::17]:4711"`},
+		{name: "obfuscated", element: forwardedElement{For: "unknown", By: "_hidden"}, want: "for=unknown;by=_hidden"},
+		{name: "host with port", element: forwardedElement{Host: "example.com:6443", Proto: "https"}, want: `proto=https;host="example.com:6443"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatForwardedElement(tt.element); got != tt.want {
+				t.Errorf("formatForwardedElement() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseForwarded tests parsing of multiple elements and quoted values.
+func TestParseForwarded(t *testing.T) {
+	values := []string{`for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=https`, `for=_hidden;by="a;b\"c", For=unknown`}
+	want := []forwardedElement{
+		{For: "192.0.2.43"},
+		{For: "[2001:db8:cafe::17]:4711", Proto: "https"},
+		{For: "_hidden", By: `a;b"c`},
+		{For: "unknown"},
+	}
+
+	if got := parseForwarded(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseForwarded() = %+v, want %+v", got, want)
+	}
+
+	header := http.Header{"Forwarded": values[:1]}
+	if got := forwardedChain(header); !reflect.DeepEqual(got, []string{"192.0.2.43", "2001:db8:cafe::17"}) {
+		t.Errorf("forwardedChain() = %v", got)
+	}
+}
+
+// TestForwardedBy tests the "by" identifier of a route.
+func TestForwardedBy(t *testing.T) {
+	tests := []struct {
+		name  string
+		route *Route
+		want  string
+	}{
+		{name: "configured", route: &Route{ListenHost: "192.0.2.1", ListenPort: 8080, Forwarded: &Forwarded{By: "_edge"}}, want: "_edge"},
+		{name: "listen address", route: &Route{ListenHost: "192.0.2.1", ListenPort: 8080}, want: "192.0.2.1:8080"},
+		{name: "ipv6 listen address", route: &Route{ListenHost: "2001:db8::1", ListenPort: 8080}, want: "[2001:db8::1]:8080"},
+		{name: "all interfaces", route: &Route{ListenPort: 8080}, want: "unknown:8080"},
+		{name: "host name", route: &Route{ListenHost: "localhost", ListenPort: 8080}, want: "unknown:8080"},
+		{name: "no listen port", route: &Route{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedBy(tt.route); got != tt.want {
+				t.Errorf("Expected %q but got %q", tt.want, got)
+			}
+		})
+	}
+
+	element := formatForwardedElement(forwardedElement{For: "198.51.100.7", By: forwardedBy(&Route{ListenPort: 8080})})
+	if element != `for=198.51.100.7;by="unknown:8080"` {
+		t.Errorf("Unexpected element %s", element)
+	}
+}
+
+// TestReverseProxyForwardedStyle tests the headers sent to the target for each forwarded style.
+func TestReverseProxyForwardedStyle(t *testing.T) {
+	var received http.Header
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	tests := []struct {
+		style         string
+		wantForwarded string
+		wantXFF       string
+	}{
+		{style: "legacy", wantForwarded: "", wantXFF: "198.51.100.7, 10.0.0.1"},
+		{style: "standard", wantForwarded: `for=198.51.100.7, for=10.0.0.1;by=_edge;proto=http;host="example.com:6446"`, wantXFF: ""},
+		{style: "both", wantForwarded: `for=198.51.100.7, for=10.0.0.1;by=_edge;proto=http;host="example.com:6446"`, wantXFF: "198.51.100.7, 10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			route := &Route{
+				Name:           "route1",
+				Pattern:        "/",
+				Protocol:       "http",
+				TrustedProxies: []string{"10.0.0.0/8"},
+				Forwarded:      &Forwarded{Style: tt.style, By: "_edge"},
+			}
+			proxy, err := NewReverseProxy(context.Background(), route)
+			if err != nil {
+				t.Fatalf("Failed to create reverse proxy: %v", err)
+			}
+			proxy.Proxy.Director = func(req *http.Request) {
+				req.URL.Scheme = backendURL.Scheme
+				req.URL.Host = backendURL.Host
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com:6446/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			if tt.style != "legacy" {
+				req.Header.Set("Forwarded", "for=198.51.100.7")
+			}
+			proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := received.Get("Forwarded"); got != tt.wantForwarded {
+				t.Errorf("Expected Forwarded %q but got %q", tt.wantForwarded, got)
+			}
+			if got := received.Get("X-Forwarded-For"); got != tt.wantXFF {
+				t.Errorf("Expected X-Forwarded-For %q but got %q", tt.wantXFF, got)
+			}
+			if received.Get("X-Real-IP") != "198.51.100.7" {
+				t.Errorf("Expected X-Real-IP 198.51.100.7 but got %q", received.Get("X-Real-IP"))
+			}
+		})
+	}
+}
+
+// TestValidateForwarded tests the forwarded configuration validation.
+func TestValidateForwarded(t *testing.T) {
+	if err := validateForwarded("route1", &Forwarded{Style: "rfc"}); err == nil {
+		t.Errorf("Expected error for invalid style")
+	}
+	if err := validateForwarded("route1", &Forwarded{Style: "both", By: "proxy"}); err == nil {
+		t.Errorf("Expected error for non obfuscated identifier")
+	}
+	if err := validateForwarded("route1", &Forwarded{Style: "standard", By: "_proxy"}); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+}
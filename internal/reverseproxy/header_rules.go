@@ -0,0 +1,273 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"reverseproxy/internal/constants"
+	"strconv"
+)
+
+// HeaderRules configures the headers a route sends to the upstream and to the client.
+// Values are templates over the request, e.g. "{{.ClientIP}}", "{{.RequestID}}", "{{.Captures.version}}"
+// or "{{env \"REGION\"}}". Captures holds the groups of PathRegex matched against the request path,
+// by index ("0" is the whole match) and by name.
+// Request rules are rendered after authentication, so templates see the identity, and applied to
+// the request as sent upstream, so they can override or remove the X-Forwarded-* and Forwarded headers.
+// Response rules run outside the response cache, so cached responses get the headers rendered for each request.
+type HeaderRules struct {
+	PathRegex string     `yaml:"pathregex omitempty=false"`
+	Request   *HeaderOps `yaml:"request omitempty=false"`
+	Response  *HeaderOps `yaml:"response omitempty=false"`
+}
+
+// HeaderOps are the header operations of one direction, applied in the order rename, remove, set, add.
+type HeaderOps struct {
+	Rename []HeaderRename `yaml:"rename omitempty=false"`
+	Remove []string       `yaml:"remove omitempty=false"`
+	Set    []HeaderValue  `yaml:"set omitempty=false"`
+	Add    []HeaderValue  `yaml:"add omitempty=false"`
+}
+
+// HeaderRename moves the values of a header to another name.
+type HeaderRename struct {
+	From string `yaml:"from omitempty=false"`
+	To   string `yaml:"to omitempty=false"`
+}
+
+// headerOps is a parsed HeaderOps.
+type headerOps struct {
+	rename []HeaderRename
+	remove []string
+	set    []*headerTemplate
+	add    []*headerTemplate
+}
+
+// validateHeaderRules validates the header rules of a route.
+func validateHeaderRules(routeName string, rules *HeaderRules) error {
+	if _, err := NewHeaderRewriter(routeName, rules); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseHeaderOps parses the templates of the operations.
+func parseHeaderOps(ops *HeaderOps) (*headerOps, error) {
+	parsed := &headerOps{}
+	if ops == nil {
+		return parsed, nil
+	}
+	for _, rename := range ops.Rename {
+		if rename.From == "" || rename.To == "" {
+			return nil, errors.New("rename requires from and to")
+		}
+		parsed.rename = append(parsed.rename, HeaderRename{
+			From: textproto.CanonicalMIMEHeaderKey(rename.From),
+			To:   textproto.CanonicalMIMEHeaderKey(rename.To),
+		})
+	}
+	for _, name := range ops.Remove {
+		if name == "" {
+			return nil, errors.New("remove requires a header name")
+		}
+		parsed.remove = append(parsed.remove, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	for _, header := range ops.Set {
+		tmpl, err := parseHeaderTemplate(header)
+		if err != nil {
+			return nil, err
+		}
+		parsed.set = append(parsed.set, tmpl)
+	}
+	for _, header := range ops.Add {
+		tmpl, err := parseHeaderTemplate(header)
+		if err != nil {
+			return nil, err
+		}
+		parsed.add = append(parsed.add, tmpl)
+	}
+	return parsed, nil
+}
+
+// renderedHeader is the value of a set or add operation rendered for a request.
+type renderedHeader struct {
+	name  string
+	value string
+}
+
+// render renders the values of the set and add operations. Values that fail to render are left out
+// and the last error is returned.
+func (ops *headerOps) render(data *headerTemplateData) ([]renderedHeader, []renderedHeader, error) {
+	var renderErr error
+	renderAll := func(templates []*headerTemplate) []renderedHeader {
+		values := []renderedHeader{}
+		for _, tmpl := range templates {
+			value, err := tmpl.render(data)
+			if err != nil {
+				renderErr = err
+				continue
+			}
+			values = append(values, renderedHeader{name: tmpl.name, value: value})
+		}
+		return values
+	}
+	set := renderAll(ops.set)
+	add := renderAll(ops.add)
+	return set, add, renderErr
+}
+
+// applyRendered runs the operations on the header with the rendered values.
+func (ops *headerOps) applyRendered(header http.Header, set, add []renderedHeader) {
+	for _, rename := range ops.rename {
+		if values := header.Values(rename.From); len(values) > 0 {
+			header.Del(rename.From)
+			header[rename.To] = append(header[rename.To], values...)
+		}
+	}
+	for _, name := range ops.remove {
+		header.Del(name)
+	}
+	for _, value := range set {
+		header.Set(value.name, value.value)
+	}
+	for _, value := range add {
+		header.Add(value.name, value.value)
+	}
+}
+
+// apply runs the operations on the header. Rendering errors are returned after the remaining operations ran.
+func (ops *headerOps) apply(header http.Header, data *headerTemplateData) error {
+	set, add, err := ops.render(data)
+	ops.applyRendered(header, set, add)
+	return err
+}
+
+// HeaderRewriter applies the header rules of a route.
+type HeaderRewriter struct {
+	RouteName string
+	Config    *HeaderRules
+
+	pathRegex *regexp.Regexp
+	request   *headerOps
+	response  *headerOps
+}
+
+// NewHeaderRewriter parses the header rules of the configuration.
+func NewHeaderRewriter(routeName string, config *HeaderRules) (*HeaderRewriter, error) {
+	hr := &HeaderRewriter{RouteName: routeName, Config: config}
+	if config.PathRegex != "" {
+		re, err := regexp.Compile(config.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid headers pathregex for route %s: %w", routeName, err)
+		}
+		hr.pathRegex = re
+	}
+	request, err := parseHeaderOps(config.Request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request headers for route %s: %w", routeName, err)
+	}
+	response, err := parseHeaderOps(config.Response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response headers for route %s: %w", routeName, err)
+	}
+	hr.request = request
+	hr.response = response
+	return hr, nil
+}
+
+// captures returns the groups of the path regex matched against the request path.
+func (hr *HeaderRewriter) captures(r *http.Request) map[string]string {
+	captures := map[string]string{}
+	if hr.pathRegex == nil {
+		return captures
+	}
+	match := hr.pathRegex.FindStringSubmatch(r.URL.Path)
+	for i, name := range hr.pathRegex.SubexpNames() {
+		if i >= len(match) {
+			break
+		}
+		captures[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			captures[name] = match[i]
+		}
+	}
+	return captures
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// setRequestID keeps the request ID of the client, otherwise one is generated and passed upstream.
+func setRequestID(r *http.Request) {
+	if r.Header.Get(constants.RequestIDHeader) == "" {
+		r.Header.Set(constants.RequestIDHeader, newRequestID())
+	}
+}
+
+// headerRulesContextKey is the context key of the pending request rules of a request.
+type headerRulesContextKey struct{}
+
+// pendingHeaderRules are the request rules of a request with their values rendered.
+type pendingHeaderRules struct {
+	ops *headerOps
+	set []renderedHeader
+	add []renderedHeader
+}
+
+// RequestMiddleware renders the request rules for the request as the client sent it. They are applied
+// by upstreamTransport to the request as sent upstream, so they can change the forwarding headers.
+func (hr *HeaderRewriter) RequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestID(r)
+		data := newHeaderTemplateData(hr.RouteName, r)
+		data.Captures = hr.captures(r)
+
+		set, add, err := hr.request.render(data)
+		if err != nil {
+			log.Error("Error rendering request header", hr.RouteName, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		pending := &pendingHeaderRules{ops: hr.request, set: set, add: add}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), headerRulesContextKey{}, pending)))
+	})
+}
+
+// applyRequestHeaderRules applies the pending request rules of the request to it.
+func applyRequestHeaderRules(r *http.Request) {
+	pending, ok := r.Context().Value(headerRulesContextKey{}).(*pendingHeaderRules)
+	if !ok {
+		return
+	}
+	pending.ops.applyRendered(r.Header, pending.set, pending.add)
+	// the Host header is held by the request, not its header map
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+		r.Header.Del("Host")
+	}
+}
+
+// ResponseMiddleware applies the response rules to the response, rendered for the request as the client sent it.
+func (hr *HeaderRewriter) ResponseMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestID(r)
+		data := newHeaderTemplateData(hr.RouteName, r)
+		data.Captures = hr.captures(r)
+
+		w = newHeaderWriter(w, func(header http.Header, status int) {
+			if err := hr.response.apply(header, data); err != nil {
+				log.Error("Error rendering response header", hr.RouteName, err)
+			}
+		})
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,174 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// TestHeaderRewriterMiddleware tests the request and response header operations and templates.
+func TestHeaderRewriterMiddleware(t *testing.T) {
+	t.Setenv("PROXY_REGION", "eu-west")
+	rewriter, err := NewHeaderRewriter("route1", &HeaderRules{
+		PathRegex: `^/api/(?P<version>v[0-9]+)/`,
+		Request: &HeaderOps{
+			Rename: []HeaderRename{{From: "X-Legacy-Token", To: "Authorization"}},
+			Remove: []string{"Cookie"},
+			Set: []HeaderValue{
+				{Name: "X-Api-Version", Value: "{{.Captures.version}}"},
+				{Name: "X-Client", Value: "{{.ClientIP}} {{.Route}} {{.Host}} {{.Path}}"},
+				{Name: "X-Region", Value: `{{env "PROXY_REGION"}}`},
+				{Name: "Host", Value: "internal.example.com"},
+			},
+			Add: []HeaderValue{{Name: "Via", Value: "proxy"}},
+		},
+		Response: &HeaderOps{
+			Rename: []HeaderRename{{From: "X-Upstream-Time", To: "X-Response-Time"}},
+			Remove: []string{"X-Internal"},
+			Set:    []HeaderValue{{Name: "X-Request-ID", Value: "{{.RequestID}}"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+
+	var upstream *http.Request
+	transport := upstreamTransport{RoundTripper: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		upstream = r
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	})}
+	handler := rewriter.ResponseMiddleware(rewriter.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := transport.RoundTrip(r); err != nil {
+			t.Fatalf("Failed to send the upstream request: %v", err)
+		}
+		w.Header().Set("X-Upstream-Time", "12ms")
+		w.Header().Set("X-Internal", "node-3")
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/items", nil)
+	req.Host = "api.example.com"
+	req.RemoteAddr = "192.0.2.10:51000"
+	req.Header.Set("X-Legacy-Token", "Bearer abc")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Via", "1.1 edge")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	wantRequest := map[string]string{
+		"Authorization":  "Bearer abc",
+		"X-Legacy-Token": "",
+		"Cookie":         "",
+		"X-Api-Version":  "v2",
+		"X-Client":       "192.0.2.10 route1 api.example.com /api/v2/items",
+		"X-Region":       "eu-west",
+	}
+	for name, want := range wantRequest {
+		if got := upstream.Header.Get(name); got != want {
+			t.Errorf("Expected request header %s %q but got %q", name, want, got)
+		}
+	}
+	if via := upstream.Header.Values("Via"); len(via) != 2 || via[1] != "proxy" {
+		t.Errorf("Expected Via to be added but got %v", via)
+	}
+	if upstream.Host != "internal.example.com" {
+		t.Errorf("Expected Host internal.example.com but got %s", upstream.Host)
+	}
+
+	requestID := upstream.Header.Get("X-Request-ID")
+	if len(requestID) != 32 {
+		t.Errorf("Expected a generated request ID but got %q", requestID)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != requestID {
+		t.Errorf("Expected response request ID %q but got %q", requestID, got)
+	}
+	if w.Header().Get("X-Response-Time") != "12ms" || w.Header().Get("X-Upstream-Time") != "" || w.Header().Get("X-Internal") != "" {
+		t.Errorf("Unexpected response headers %v", w.Header())
+	}
+
+	// the request ID of the client is kept and unmatched captures are empty
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Request-ID", "client-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if upstream.Header.Get("X-Request-ID") != "client-id" || w.Header().Get("X-Request-ID") != "client-id" {
+		t.Errorf("Expected the client request ID to be kept but got %q", upstream.Header.Get("X-Request-ID"))
+	}
+	if got := upstream.Header.Get("X-Api-Version"); got != "" {
+		t.Errorf("Expected an empty capture but got %q", got)
+	}
+}
+
+// TestHeaderRewriterForwardingHeaders tests that request rules can override and remove the forwarding headers
+// the proxy sets on the upstream request.
+func TestHeaderRewriterForwardingHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(backendURL.Port())
+
+	route := &Route{
+		Name:    "route1",
+		Pattern: "/",
+		Target:  Target{Protocol: "http", Host: backendURL.Hostname(), Port: port},
+		Headers: &HeaderRules{Request: &HeaderOps{
+			Remove: []string{"X-Forwarded-For", "X-Real-IP"},
+			Set:    []HeaderValue{{Name: "X-Forwarded-Proto", Value: "https"}, {Name: "Host", Value: "internal.example.com"}},
+		}},
+	}
+	proxy, err := NewReverseProxy(context.Background(), route)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Host = "api.example.com"
+	req.RemoteAddr = "192.0.2.10:51000"
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK but got %d", w.Code)
+	}
+
+	header := <-received
+	wantHeaders := map[string]string{
+		"X-Forwarded-For":   "",
+		"X-Real-IP":         "",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "api.example.com",
+	}
+	for name, want := range wantHeaders {
+		if got := header.Get(name); got != want {
+			t.Errorf("Expected upstream header %s %q but got %q", name, want, got)
+		}
+	}
+}
+
+// TestValidateHeaderRules tests the header rules validation.
+func TestValidateHeaderRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   *HeaderRules
+		wantErr bool
+	}{
+		{name: "valid", rules: &HeaderRules{PathRegex: `^/(\w+)`, Request: &HeaderOps{Set: []HeaderValue{{Name: "X-A", Value: "{{index .Captures \"1\"}}"}}}}},
+		{name: "invalid regex", rules: &HeaderRules{PathRegex: "("}, wantErr: true},
+		{name: "invalid template", rules: &HeaderRules{Response: &HeaderOps{Set: []HeaderValue{{Name: "X-A", Value: "{{.User"}}}}, wantErr: true},
+		{name: "rename without target", rules: &HeaderRules{Request: &HeaderOps{Rename: []HeaderRename{{From: "X-A"}}}}, wantErr: true},
+		{name: "empty remove", rules: &HeaderRules{Request: &HeaderOps{Remove: []string{""}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateHeaderRules("route1", tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("validateHeaderRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,726 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache configures a shared HTTP cache for the responses of a route, following RFC 9111.
+// GET responses are stored according to Cache-Control, Expires and Vary, served with Age while fresh,
+// revalidated with ETag/Last-Modified when stale, and served stale within stale-while-revalidate
+// and stale-if-error. On routes with authentication only responses marked public, s-maxage or
+// must-revalidate are stored, and responses setting cookies are never stored.
+// With Coalesce, concurrent identical requests wait for one upstream request and are served its
+// response if it is stored; requests waiting longer than CoalesceTimeout go upstream themselves.
+type Cache struct {
+	MaxBytes        int64         `yaml:"maxbytes omitempty=false"`        // LRU limit of the route, defaults to 64 MiB
+	MaxEntryBytes   int64         `yaml:"maxentrybytes omitempty=false"`   // larger responses are not kept in memory, defaults to 1 MiB
+	Disk            *DiskCache    `yaml:"disk omitempty=false"`            // optional tier for responses above MaxEntryBytes
+	Coalesce        bool          `yaml:"coalesce omitempty=false"`        // collapse concurrent identical requests
+	CoalesceTimeout time.Duration `yaml:"coalescetimeout omitempty=false"` // defaults to 5s
+}
+
+// heuristicallyCacheable are the status codes that may be stored without explicit freshness (RFC 9110 15.1).
+var heuristicallyCacheable = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+	http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+	http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented,
+}
+
+// validateCache validates the cache configuration of a route.
+func validateCache(routeName string, cache *Cache) error {
+	if cache.MaxBytes < 0 || cache.MaxEntryBytes < 0 {
+		return fmt.Errorf("invalid cache size for route %s", routeName)
+	}
+	if cache.CoalesceTimeout < 0 {
+		return fmt.Errorf("invalid cache coalescetimeout for route %s", routeName)
+	}
+	if cache.MaxBytes > 0 && cache.MaxEntryBytes > cache.MaxBytes {
+		return fmt.Errorf("cache maxentrybytes exceeds maxbytes for route %s", routeName)
+	}
+	if cache.Disk != nil {
+		return validateDiskCache(routeName, cache.Disk)
+	}
+	return nil
+}
+
+// cacheControl holds the directives of Cache-Control headers by lower case name.
+type cacheControl map[string]string
+
+// parseCacheControl parses the Cache-Control headers. Pragma: no-cache counts as no-cache without them.
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, directive := range splitHeaderList(strings.Join(header.Values("Cache-Control"), ",")) {
+		name, value, _ := strings.Cut(directive, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if len(cc) == 0 && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds of a directive; invalid values count as 0.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
+
+// headerSeconds parses a header holding delta-seconds such as Age.
+func headerSeconds(header http.Header, name string) time.Duration {
+	n, err := strconv.ParseInt(header.Get(name), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second
+}
+
+// date returns the Date of the response, or when it was received.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime returns how long the response is fresh (RFC 9111 4.2.1).
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return expiresAt.Sub(e.date())
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && slices.Contains(heuristicallyCacheable, e.Status) {
+		return min(e.date().Sub(lastModified)/10, constants.CacheHeuristicMaxAge)
+	}
+	return 0
+}
+
+// age returns the current age of the response (RFC 9111 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	correctedAge := headerSeconds(e.Header, "Age") + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+// HTTPCache serves the responses of a route from a cacheStore.
+type HTTPCache struct {
+	RouteName string
+	Config    *Cache
+
+	store           cacheStore
+	disk            *diskCacheStore // nil without a disk tier
+	maxEntryBytes   int64
+	authenticated   bool
+	coalesceTimeout time.Duration
+	now             func() time.Time
+	revalidating    sync.Map // keys with a background revalidation in flight
+	flights         sync.Map // flights by key
+}
+
+// NewHTTPCache creates the cache of the route, loading the entries of the disk tier.
+func NewHTTPCache(route *Route, config *Cache) (*HTTPCache, error) {
+	maxBytes := config.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = constants.CacheMaxBytes
+	}
+	memory := newMemoryCacheStore(route.Name, maxBytes)
+	// upstream credentials, especially impersonation, make responses specific to the proxy or the user
+	authenticated := route.BasicAuth != nil || route.JWTAuth != nil || route.OIDC != nil || route.APIKeyAuth != nil ||
+		route.ForwardAuth != nil || route.Target.Credentials != nil
+	hc := &HTTPCache{
+		RouteName:     route.Name,
+		Config:        config,
+		store:         memory,
+		maxEntryBytes: config.MaxEntryBytes,
+		authenticated: authenticated,
+		now:           time.Now,
+	}
+	if hc.maxEntryBytes == 0 {
+		hc.maxEntryBytes = min(constants.CacheMaxEntryBytes, maxBytes)
+	}
+	if hc.coalesceTimeout = config.CoalesceTimeout; hc.coalesceTimeout == 0 {
+		hc.coalesceTimeout = constants.CacheCoalesceTimeout
+	}
+	if config.Disk != nil {
+		disk, err := newDiskCacheStore(route.Name, config.Disk)
+		if err != nil {
+			return nil, err
+		}
+		hc.disk = disk
+		hc.store = &tieredCacheStore{memory: memory, disk: disk, memoryEntryBytes: hc.maxEntryBytes}
+	}
+	return hc, nil
+}
+
+// primaryKey is the cache key of the target URI; GET and HEAD share it.
+func primaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantKey is the cache key of the variant selected by the request headers named by Vary.
+func variantKey(primary string, varyHeaders []string, r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(primary)
+	for _, name := range varyHeaders {
+		key.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// varyHeaders returns the request header names of the Vary headers.
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	for _, name := range splitHeaderList(strings.Join(header.Values(constants.VaryHeader), ",")) {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// lookup returns the stored response selected by the request.
+func (hc *HTTPCache) lookup(r *http.Request) *cacheEntry {
+	entry, ok := hc.store.Get(primaryKey(r))
+	if !ok {
+		return nil
+	}
+	if len(entry.VaryHeaders) > 0 {
+		if entry, ok = hc.store.Get(variantKey(entry.Key, entry.VaryHeaders, r)); !ok {
+			return nil
+		}
+	}
+	return entry
+}
+
+// storable reports whether the response to the request may be stored (RFC 9111 3).
+func (hc *HTTPCache) storable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || status < 200 || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	requestCC, responseCC := parseCacheControl(r.Header), parseCacheControl(header)
+	if requestCC.has("no-store") || responseCC.has("no-store") || responseCC.has("private") {
+		return false
+	}
+	if header.Get(constants.SetCookieHeader) != "" || slices.Contains(varyHeaders(header), "*") {
+		return false
+	}
+	_, identified := identityFromContext(r.Context())
+	if hc.authenticated || identified || r.Header.Get(constants.AuthorizationHeader) != "" {
+		if !responseCC.has("public") && !responseCC.has("s-maxage") && !responseCC.has("must-revalidate") {
+			return false
+		}
+	}
+	explicit := responseCC.has("public") || responseCC.has("max-age") || responseCC.has("s-maxage") || header.Get("Expires") != ""
+	return explicit || slices.Contains(heuristicallyCacheable, status)
+}
+
+// count increments the request metric of the result.
+func (hc *HTTPCache) count(result string) {
+	constants.CacheRequestsTotal.WithLabelValues(hc.RouteName, result).Inc()
+}
+
+// Middleware answers GET and HEAD requests from the cache and invalidates stored responses
+// on successful unsafe requests.
+func (hc *HTTPCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			hc.serve(w, r, next)
+		case http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+		default:
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, r)
+			if recorder.status < 400 {
+				hc.store.Delete(primaryKey(r))
+			}
+		}
+	})
+}
+
+// serve answers a GET or HEAD request from a fresh or allowed stale response,
+// revalidating or fetching it otherwise.
+func (hc *HTTPCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	requestCC := parseCacheControl(r.Header)
+	if requestCC.has("no-store") || r.Header.Get("Range") != "" {
+		hc.count(constants.CacheBypass)
+		w.Header().Set(constants.CacheStatusHeader, constants.CacheID+"; fwd=request")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	serveEntry := func(entry *cacheEntry, cacheStatus string) {
+		if err := hc.serveEntry(w, r, entry, cacheStatus); err != nil {
+			log.Warn("Cached response unavailable, fetching it again", hc.RouteName, entry.Key, err)
+			hc.store.Delete(entry.Key)
+			hc.fetch(w, r, next, nil, constants.CacheID+"; fwd=miss")
+		}
+	}
+
+	entry := hc.lookup(r)
+	var responseCC cacheControl
+	var staleness time.Duration
+	canServeStale := false
+	if entry != nil {
+		age, lifetime := entry.age(hc.now()), entry.freshnessLifetime()
+		responseCC = parseCacheControl(entry.Header)
+		noCache := requestCC.has("no-cache") || responseCC.has("no-cache")
+		fresh := age < lifetime
+		if maxAge, ok := requestCC.seconds("max-age"); ok && age > maxAge {
+			fresh = false
+		}
+		if minFresh, ok := requestCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+			fresh = false
+		}
+		if fresh && !noCache {
+			hc.count(constants.CacheHit)
+			serveEntry(entry, "hit")
+			return
+		}
+
+		// s-maxage implies proxy-revalidate for shared caches
+		staleness = age - lifetime
+		canServeStale = !noCache && !responseCC.has("must-revalidate") && !responseCC.has("proxy-revalidate") && !responseCC.has("s-maxage")
+		if canServeStale {
+			if maxStale, ok := requestCC["max-stale"]; ok {
+				if limit, _ := requestCC.seconds("max-stale"); maxStale == "" || staleness <= limit {
+					hc.count(constants.CacheStale)
+					serveEntry(entry, "hit")
+					return
+				}
+			}
+			if window, ok := responseCC.seconds("stale-while-revalidate"); ok && staleness <= window {
+				hc.count(constants.CacheStale)
+				hc.revalidateAsync(r, next, entry)
+				serveEntry(entry, "hit")
+				return
+			}
+		}
+	}
+	if requestCC.has("only-if-cached") {
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
+
+	fwd := "fwd=uri-miss"
+	if entry != nil {
+		fwd = "fwd=stale"
+	}
+	var stored *cacheEntry // the response stored by this request, shared with the requests that wait for it
+	flight, leads := hc.join(r)
+	switch {
+	case leads:
+		defer func() { hc.land(flight, stored) }()
+	case flight != nil:
+		if hc.wait(w, r, flight, fwd) {
+			return
+		}
+		// the response varies on headers that differ, so the request can wait for its own variant
+		if hc.flightKey(r) != flight.key {
+			hc.serve(w, r, next)
+			return
+		}
+		fwd += "; collapsed=?0"
+	}
+
+	if entry == nil {
+		hc.count(constants.CacheMiss)
+		stored = hc.fetch(w, r, next, nil, constants.CacheID+"; "+fwd).saved
+		return
+	}
+
+	staleIfError := func(status int) bool {
+		if !canServeStale || status < 500 {
+			return false
+		}
+		for _, cc := range []cacheControl{requestCC, responseCC} {
+			if window, ok := cc.seconds("stale-if-error"); ok && staleness <= window {
+				return true
+			}
+		}
+		return false
+	}
+	recorder := hc.fetch(w, revalidationRequest(r, r.Context(), entry), next, func(status int) bool {
+		return status == http.StatusNotModified || staleIfError(status)
+	}, constants.CacheID+"; "+fwd)
+
+	switch {
+	case recorder.intercepted && recorder.status == http.StatusNotModified:
+		hc.count(constants.CacheRevalidated)
+		stored = hc.freshen(entry, recorder)
+		serveEntry(stored, "fwd=stale; fwd-status=304")
+	case recorder.intercepted:
+		hc.count(constants.CacheStale)
+		serveEntry(entry, "hit; fwd-status="+strconv.Itoa(recorder.status))
+	default:
+		hc.count(constants.CacheMiss)
+		stored = recorder.saved
+	}
+}
+
+// flight is an upstream request for a response that identical requests wait for.
+type flight struct {
+	key     string
+	done    chan struct{}
+	waiters atomic.Int32
+	entry   *cacheEntry // the stored response, nil if it was not stored
+}
+
+// flightKey identifies identical requests: the target URI and, if the stored responses vary,
+// the values of the request headers they vary on.
+func (hc *HTTPCache) flightKey(r *http.Request) string {
+	key := primaryKey(r)
+	if index, ok := hc.store.Get(key); ok && len(index.VaryHeaders) > 0 {
+		return variantKey(key, index.VaryHeaders, r)
+	}
+	return key
+}
+
+// join returns the flight of an identical request in flight and false, or a new flight led by
+// the caller and true. Only GET requests lead flights; nil is returned without coalescing.
+func (hc *HTTPCache) join(r *http.Request) (*flight, bool) {
+	if !hc.Config.Coalesce {
+		return nil, false
+	}
+	key := hc.flightKey(r)
+	if r.Method != http.MethodGet {
+		if existing, ok := hc.flights.Load(key); ok {
+			return existing.(*flight), false
+		}
+		return nil, false
+	}
+	f := &flight{key: key, done: make(chan struct{})}
+	if existing, loaded := hc.flights.LoadOrStore(key, f); loaded {
+		return existing.(*flight), false
+	}
+	return f, true
+}
+
+// land hands the stored response to the requests waiting for the flight.
+func (hc *HTTPCache) land(f *flight, entry *cacheEntry) {
+	f.entry = entry
+	hc.flights.Delete(f.key)
+	close(f.done)
+	if waiters := f.waiters.Load(); waiters > 0 {
+		log.Debug("Coalesced requests", hc.RouteName, f.key, waiters, entry != nil)
+	}
+}
+
+// wait waits for the flight up to the coalescing timeout and serves its response if it was
+// stored and the request selects the same variant. It returns false if the request has to go upstream.
+func (hc *HTTPCache) wait(w http.ResponseWriter, r *http.Request, f *flight, fwd string) bool {
+	f.waiters.Add(1)
+	timer := time.NewTimer(hc.coalesceTimeout)
+	defer timer.Stop()
+	select {
+	case <-f.done:
+	case <-timer.C:
+		log.Debug("Coalesced request timed out, going upstream", hc.RouteName, f.key)
+		return false
+	case <-r.Context().Done():
+		return true
+	}
+
+	entry := f.entry
+	if entry == nil {
+		return false
+	}
+	if vary := varyHeaders(entry.Header); len(vary) > 0 && variantKey(primaryKey(r), vary, r) != entry.Key {
+		return false
+	}
+	if err := hc.serveEntry(w, r, entry, fwd+"; collapsed"); err != nil {
+		return false
+	}
+	hc.count(constants.CacheCollapsed)
+	return true
+}
+
+// serveEntry writes the stored response with its current Age, or 304 if it satisfies
+// the conditional headers of the request. Nothing is written if the body cannot be read.
+func (hc *HTTPCache) serveEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, cacheStatus string) error {
+	notModified := entry.Status == http.StatusOK && notModified(r, entry.Header)
+	var body io.ReadCloser
+	if !notModified && r.Method != http.MethodHead {
+		var err error
+		if body, err = entry.openBody(); err != nil {
+			return err
+		}
+		defer body.Close()
+	}
+
+	age, lifetime := entry.age(hc.now()), entry.freshnessLifetime()
+	header := w.Header()
+	for key, values := range entry.Header {
+		header[key] = slices.Clone(values)
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Set(constants.CacheStatusHeader, fmt.Sprintf("%s; %s; ttl=%d", constants.CacheID, cacheStatus, int((lifetime-age).Seconds())))
+
+	if notModified {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	header.Set("Content-Length", strconv.FormatInt(entry.bodySize(), 10))
+	w.WriteHeader(entry.Status)
+	if body != nil {
+		io.Copy(w, body)
+	}
+	return nil
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it, against the stored response.
+func notModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, tag := range splitHeaderList(ifNoneMatch) {
+			if tag == "*" || (etag != "" && strings.TrimPrefix(tag, "W/") == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// revalidationRequest returns a conditional GET for the stored response, carrying its validators
+// instead of those of the client.
+func revalidationRequest(r *http.Request, ctx context.Context, entry *cacheEntry) *http.Request {
+	conditional := r.Clone(ctx)
+	conditional.Method = http.MethodGet
+	conditional.Body = http.NoBody
+	conditional.ContentLength = 0
+	conditional.Header.Del("If-None-Match")
+	conditional.Header.Del("If-Modified-Since")
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+// revalidateAsync revalidates the stored response in the background, once per key at a time.
+func (hc *HTTPCache) revalidateAsync(r *http.Request, next http.Handler, entry *cacheEntry) {
+	if _, busy := hc.revalidating.LoadOrStore(entry.Key, struct{}{}); busy {
+		return
+	}
+	conditional := revalidationRequest(r, context.WithoutCancel(r.Context()), entry)
+	go func() {
+		defer hc.revalidating.Delete(entry.Key)
+		recorder := hc.fetch(&discardResponseWriter{header: http.Header{}}, conditional, next, func(status int) bool {
+			return status == http.StatusNotModified || status >= 500
+		}, "")
+		if recorder.intercepted && recorder.status == http.StatusNotModified {
+			hc.freshen(entry, recorder)
+		}
+	}()
+}
+
+// freshen stores the response updated with the headers of a 304 response.
+func (hc *HTTPCache) freshen(entry *cacheEntry, recorder *cacheRecorder) *cacheEntry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for key, values := range recorder.header {
+		if key != "Content-Length" {
+			updated.Header[key] = values
+		}
+	}
+	updated.RequestTime = recorder.requestTime
+	updated.ResponseTime = recorder.responseTime
+	hc.store.Set(&updated)
+	return &updated
+}
+
+// fetch passes the request on and stores the response if allowed.
+// Responses with a status for which intercept returns true are not written to w.
+func (hc *HTTPCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, intercept func(status int) bool, cacheStatus string) *cacheRecorder {
+	recorder := &cacheRecorder{
+		ResponseWriter: w,
+		header:         http.Header{},
+		intercept:      intercept,
+		storable:       func(status int, header http.Header) bool { return hc.storable(r, status, header) },
+		cacheStatus:    cacheStatus,
+		body:           &cacheBody{memoryBytes: hc.maxEntryBytes, maxBytes: hc.maxEntryBytes},
+		now:            hc.now,
+		requestTime:    hc.now(),
+	}
+	if hc.disk != nil {
+		recorder.body.maxBytes, recorder.body.disk = hc.disk.maxEntryBytes, hc.disk
+	}
+	// an aborted upstream response panics past save, so a partial body is never stored
+	defer recorder.body.discard()
+	next.ServeHTTP(recorder, r)
+	if recorder.store {
+		recorder.saved = hc.save(r, recorder)
+	}
+	return recorder
+}
+
+// save stores the recorded response, and the Vary index when the response varies.
+func (hc *HTTPCache) save(r *http.Request, recorder *cacheRecorder) *cacheEntry {
+	entry := &cacheEntry{
+		Key:          primaryKey(r),
+		Status:       recorder.status,
+		Header:       recorder.stored,
+		RequestTime:  recorder.requestTime,
+		ResponseTime: recorder.responseTime,
+	}
+	if err := recorder.body.finish(entry); err != nil {
+		log.Error("Failed to store cached response", hc.RouteName, err)
+		return nil
+	}
+	if vary := varyHeaders(entry.Header); len(vary) > 0 {
+		hc.store.Set(&cacheEntry{Key: entry.Key, VaryHeaders: vary, ResponseTime: entry.ResponseTime})
+		entry.Key = variantKey(entry.Key, vary, r)
+	}
+	hc.store.Set(entry)
+	return entry
+}
+
+// cacheRecorder passes a response on to the client while keeping a copy for the cache.
+type cacheRecorder struct {
+	http.ResponseWriter
+	header      http.Header
+	intercept   func(status int) bool
+	storable    func(status int, header http.Header) bool
+	cacheStatus string
+	body        *cacheBody
+	now         func() time.Time
+
+	requestTime  time.Time
+	responseTime time.Time
+	wroteHeader  bool
+	intercepted  bool
+	store        bool
+	status       int
+	stored       http.Header // the headers as received, without those of outer middlewares
+	saved        *cacheEntry
+}
+
+func (cr *cacheRecorder) Header() http.Header {
+	return cr.header
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if cr.wroteHeader {
+		return
+	}
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		cr.copyHeader()
+		cr.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cr.wroteHeader = true
+	cr.status = status
+	cr.responseTime = cr.now()
+	if cr.intercept != nil && cr.intercept(status) {
+		cr.intercepted = true
+		return
+	}
+
+	cr.store = cr.storable(status, cr.header)
+	cr.stored = cr.header.Clone()
+	cr.copyHeader()
+	if cr.cacheStatus != "" {
+		cr.ResponseWriter.Header().Set(constants.CacheStatusHeader, cr.cacheStatus)
+	}
+	// trailers are set after the body, so later changes go to the client directly
+	cr.header = cr.ResponseWriter.Header()
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+// copyHeader copies the recorded headers to the client response.
+func (cr *cacheRecorder) copyHeader() {
+	dst := cr.ResponseWriter.Header()
+	for key, values := range cr.header {
+		dst[key] = values
+	}
+}
+
+func (cr *cacheRecorder) Write(data []byte) (int, error) {
+	if !cr.wroteHeader {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if cr.intercepted {
+		return len(data), nil
+	}
+	if cr.store {
+		if err := cr.body.Write(data); err != nil {
+			cr.store = false
+			cr.body.discard()
+		}
+	}
+	n, err := cr.ResponseWriter.Write(data)
+	if err != nil && cr.store {
+		cr.store = false
+		cr.body.discard()
+	}
+	return n, err
+}
+
+// Flush lets streaming responses pass through the recorder.
+func (cr *cacheRecorder) Flush() {
+	if cr.intercepted {
+		return
+	}
+	if flusher, ok := cr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// discardResponseWriter is the ResponseWriter of background requests.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (dw *discardResponseWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *discardResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (dw *discardResponseWriter) WriteHeader(status int) {}
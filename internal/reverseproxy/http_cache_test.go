@@ -0,0 +1,487 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheUpstream is a test upstream that counts its requests.
+type cacheUpstream struct {
+	calls   atomic.Int32
+	handler func(w http.ResponseWriter, r *http.Request)
+}
+
+func (u *cacheUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.calls.Add(1)
+	u.handler(w, r)
+}
+
+// newTestCache creates a cache with a clock the test can advance.
+func newTestCache(t *testing.T, route *Route, config *Cache) (*HTTPCache, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	hc, err := NewHTTPCache(route, config)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	hc.now = func() time.Time { return now }
+	return hc, &now
+}
+
+// cacheGet sends a GET request with the headers through the handler.
+func cacheGet(handler http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestHTTPCacheStorable tests which responses are stored.
+func TestHTTPCacheStorable(t *testing.T) {
+	tests := []struct {
+		name          string
+		route         *Route
+		requestHeader map[string]string
+		header        map[string]string
+		status        int
+		wantStored    bool
+	}{
+		{name: "max-age", header: map[string]string{"Cache-Control": "max-age=60"}, wantStored: true},
+		{name: "expires", header: map[string]string{"Expires": "Wed, 01 May 2024 13:00:00 GMT"}, wantStored: true},
+		{name: "heuristic status", header: map[string]string{"Last-Modified": "Mon, 01 Apr 2024 12:00:00 GMT"}, wantStored: true},
+		{name: "heuristic status without validators", wantStored: true},
+		{name: "not heuristically cacheable", status: http.StatusInternalServerError},
+		{name: "explicit freshness of other status", status: http.StatusInternalServerError, header: map[string]string{"Cache-Control": "max-age=60"}, wantStored: true},
+		{name: "no-store", header: map[string]string{"Cache-Control": "no-store"}},
+		{name: "private", header: map[string]string{"Cache-Control": "private, max-age=60"}},
+		{name: "set-cookie", header: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "session=abc"}},
+		{name: "vary star", header: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}},
+		{name: "request no-store", requestHeader: map[string]string{"Cache-Control": "no-store"}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "authorization", requestHeader: map[string]string{"Authorization": "Bearer token"}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "authorization with public", requestHeader: map[string]string{"Authorization": "Bearer token"}, header: map[string]string{"Cache-Control": "public, max-age=60"}, wantStored: true},
+		{name: "authenticated route", route: &Route{Name: "grafana", BasicAuth: &BasicAuth{}}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "authenticated route with s-maxage", route: &Route{Name: "grafana", BasicAuth: &BasicAuth{}}, header: map[string]string{"Cache-Control": "s-maxage=60"}, wantStored: true},
+		{name: "upstream credentials", route: &Route{Name: "grafana", Target: Target{Credentials: &UpstreamCredentials{BearerTokenFile: "token"}}}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "impersonation", route: &Route{Name: "grafana", JWTAuth: &JWTAuth{}, Target: Target{Credentials: &UpstreamCredentials{Impersonate: true}}}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "upstream credentials with public", route: &Route{Name: "grafana", Target: Target{Credentials: &UpstreamCredentials{BearerTokenFile: "token"}}}, header: map[string]string{"Cache-Control": "public, max-age=60"}, wantStored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			if route == nil {
+				route = &Route{Name: "grafana"}
+			}
+			hc, _ := newTestCache(t, route, &Cache{})
+			upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", "Wed, 01 May 2024 12:00:00 GMT")
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				status := tt.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				w.WriteHeader(status)
+				w.Write([]byte("dashboard"))
+			}}
+			handler := hc.Middleware(upstream)
+
+			first := cacheGet(handler, "/api/dashboards", tt.requestHeader)
+			if first.Body.String() != "dashboard" || first.Header().Get("Cache-Status") != "reverseproxy; fwd=uri-miss" && tt.requestHeader["Cache-Control"] != "no-store" {
+				t.Fatalf("Unexpected first response %q with Cache-Status %q", first.Body.String(), first.Header().Get("Cache-Status"))
+			}
+			_, stored := hc.store.Get("example.com/api/dashboards")
+			if stored != tt.wantStored {
+				t.Errorf("Expected stored %v but got %v", tt.wantStored, stored)
+			}
+		})
+	}
+}
+
+// TestHTTPCacheHit tests that fresh responses are served from the cache with their age.
+func TestHTTPCacheHit(t *testing.T) {
+	hc, now := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("dashboard"))
+	}}
+	handler := hc.Middleware(upstream)
+
+	cacheGet(handler, "/api/dashboards", nil)
+	*now = now.Add(10 * time.Second)
+	w := cacheGet(handler, "/api/dashboards", nil)
+	if upstream.calls.Load() != 1 || w.Body.String() != "dashboard" {
+		t.Fatalf("Expected a cache hit but the upstream was called %d times", upstream.calls.Load())
+	}
+	if w.Header().Get("Age") != "10" || w.Header().Get("Cache-Status") != "reverseproxy; hit; ttl=50" {
+		t.Errorf("Unexpected Age %q and Cache-Status %q", w.Header().Get("Age"), w.Header().Get("Cache-Status"))
+	}
+
+	w = cacheGet(handler, "/api/dashboards", map[string]string{"If-None-Match": `"v1"`})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching If-None-Match but got %d", w.Code)
+	}
+
+	head := httptest.NewRecorder()
+	handler.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/api/dashboards", nil))
+	if head.Body.Len() != 0 || head.Header().Get("Content-Length") != "9" || upstream.calls.Load() != 1 {
+		t.Errorf("Expected HEAD to be answered from the cache without a body")
+	}
+
+	cacheGet(handler, "/api/dashboards", map[string]string{"Cache-Control": "no-cache"})
+	*now = now.Add(10 * time.Second)
+	cacheGet(handler, "/api/dashboards", map[string]string{"Cache-Control": "max-age=5"})
+	if upstream.calls.Load() != 3 {
+		t.Errorf("Expected no-cache and max-age requests to go upstream but got %d calls", upstream.calls.Load())
+	}
+}
+
+// TestHTTPCacheVary tests that variants are stored per Vary request header.
+func TestHTTPCacheVary(t *testing.T) {
+	hc, _ := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("dashboard " + r.Header.Get("Accept-Language")))
+	}}
+	handler := hc.Middleware(upstream)
+
+	for _, language := range []string{"en", "de", "en", "de"} {
+		w := cacheGet(handler, "/api/dashboards", map[string]string{"Accept-Language": language})
+		if w.Body.String() != "dashboard "+language {
+			t.Errorf("Expected the %s variant but got %q", language, w.Body.String())
+		}
+	}
+	if upstream.calls.Load() != 2 {
+		t.Errorf("Expected one upstream request per variant but got %d", upstream.calls.Load())
+	}
+}
+
+// TestHTTPCacheHeaderRules tests that response header rules are rendered for each client of a cached response.
+func TestHTTPCacheHeaderRules(t *testing.T) {
+	route := &Route{
+		Name:  "grafana",
+		Cache: &Cache{},
+		Headers: &HeaderRules{Response: &HeaderOps{Set: []HeaderValue{
+			{Name: "X-Client", Value: "{{.ClientIP}}"},
+			{Name: "X-Request-ID", Value: "{{.RequestID}}"},
+		}}},
+	}
+	middlewares, err := routeMiddlewares(route)
+	if err != nil {
+		t.Fatalf("Failed to create middlewares: %v", err)
+	}
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("dashboard"))
+	}}
+	handler := chainMiddlewares(upstream, middlewares...)
+
+	for _, client := range []struct{ ip, requestID string }{{"192.0.2.10", "first"}, {"192.0.2.20", "second"}} {
+		req := httptest.NewRequest(http.MethodGet, "/api/dashboards", nil)
+		req.RemoteAddr = client.ip + ":51000"
+		req.Header.Set("X-Request-ID", client.requestID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Body.String() != "dashboard" {
+			t.Fatalf("Expected the dashboard but got %q", w.Body.String())
+		}
+		if got := w.Header().Get("X-Client"); got != client.ip {
+			t.Errorf("Expected X-Client %s but got %s", client.ip, got)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != client.requestID {
+			t.Errorf("Expected X-Request-ID %s but got %s", client.requestID, got)
+		}
+	}
+	if upstream.calls.Load() != 1 {
+		t.Errorf("Expected the second client to be served from the cache but got %d upstream calls", upstream.calls.Load())
+	}
+}
+
+// TestHTTPCacheRevalidation tests conditional revalidation of stale responses.
+func TestHTTPCacheRevalidation(t *testing.T) {
+	hc, now := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+	var ifNoneMatch atomic.Value
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") != "" {
+			ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+			w.Header().Set("X-Revalidated", "true")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("dashboard"))
+	}}
+	handler := hc.Middleware(upstream)
+
+	cacheGet(handler, "/api/dashboards", nil)
+	*now = now.Add(2 * time.Minute)
+	w := cacheGet(handler, "/api/dashboards", nil)
+	if ifNoneMatch.Load() != `"v1"` {
+		t.Fatalf("Expected a conditional request with the stored ETag but got %v", ifNoneMatch.Load())
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "dashboard" || w.Header().Get("X-Revalidated") != "true" {
+		t.Errorf("Expected the freshened response but got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if !strings.Contains(w.Header().Get("Cache-Status"), "fwd-status=304") || w.Header().Get("Age") != "0" {
+		t.Errorf("Unexpected Cache-Status %q and Age %q", w.Header().Get("Cache-Status"), w.Header().Get("Age"))
+	}
+
+	cacheGet(handler, "/api/dashboards", nil)
+	if upstream.calls.Load() != 2 {
+		t.Errorf("Expected the revalidated response to be fresh again but got %d calls", upstream.calls.Load())
+	}
+}
+
+// TestHTTPCacheStale tests stale-if-error, stale-while-revalidate and must-revalidate.
+func TestHTTPCacheStale(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantStale    bool
+	}{
+		{name: "stale-if-error", cacheControl: "max-age=60, stale-if-error=300", wantStale: true},
+		{name: "stale-if-error expired", cacheControl: "max-age=60, stale-if-error=30"},
+		{name: "must-revalidate", cacheControl: "max-age=60, stale-if-error=300, must-revalidate"},
+		{name: "no stale directive", cacheControl: "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc, now := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+			var failing atomic.Bool
+			upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					w.WriteHeader(http.StatusBadGateway)
+					w.Write([]byte("upstream down"))
+					return
+				}
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Write([]byte("dashboard"))
+			}}
+			handler := hc.Middleware(upstream)
+
+			cacheGet(handler, "/api/dashboards", nil)
+			failing.Store(true)
+			*now = now.Add(2 * time.Minute)
+			w := cacheGet(handler, "/api/dashboards", nil)
+			if got := w.Code == http.StatusOK && w.Body.String() == "dashboard"; got != tt.wantStale {
+				t.Errorf("Expected stale %v but got %d %q", tt.wantStale, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("stale-while-revalidate", func(t *testing.T) {
+		hc, now := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+		revalidated := make(chan struct{})
+		upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=300")
+			if r.Header.Get("If-None-Match") != "" {
+				defer close(revalidated)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("dashboard"))
+		}}
+		handler := hc.Middleware(upstream)
+
+		cacheGet(handler, "/api/dashboards", nil)
+		*now = now.Add(2 * time.Minute)
+		w := cacheGet(handler, "/api/dashboards", nil)
+		if w.Body.String() != "dashboard" || w.Header().Get("Age") != "120" {
+			t.Fatalf("Expected the stale response to be served but got %q with Age %q", w.Body.String(), w.Header().Get("Age"))
+		}
+		select {
+		case <-revalidated:
+		case <-time.After(time.Second):
+			t.Fatal("Expected a background revalidation")
+		}
+	})
+}
+
+// TestHTTPCacheInvalidation tests that successful unsafe requests invalidate the stored response.
+func TestHTTPCacheInvalidation(t *testing.T) {
+	hc, _ := newTestCache(t, &Route{Name: "grafana"}, &Cache{})
+	upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("dashboard"))
+	}}
+	handler := hc.Middleware(upstream)
+
+	cacheGet(handler, "/api/dashboards", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/dashboards", strings.NewReader("{}")))
+	cacheGet(handler, "/api/dashboards", nil)
+	if upstream.calls.Load() != 3 {
+		t.Errorf("Expected the POST to invalidate the stored response but got %d calls", upstream.calls.Load())
+	}
+}
+
+// TestCacheFreshnessLifetime tests the freshness lifetime of stored responses.
+func TestCacheFreshnessLifetime(t *testing.T) {
+	date := "Wed, 01 May 2024 12:00:00 GMT"
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		want   time.Duration
+	}{
+		{name: "s-maxage over max-age", header: map[string]string{"Cache-Control": "max-age=60, s-maxage=30"}, want: 30 * time.Second},
+		{name: "max-age over expires", header: map[string]string{"Cache-Control": "max-age=60", "Expires": "Wed, 01 May 2024 13:00:00 GMT"}, want: time.Minute},
+		{name: "expires", header: map[string]string{"Expires": "Wed, 01 May 2024 13:00:00 GMT"}, want: time.Hour},
+		{name: "invalid expires", header: map[string]string{"Expires": "0"}, want: 0},
+		{name: "heuristic", header: map[string]string{"Last-Modified": "Wed, 01 May 2024 02:00:00 GMT"}, want: time.Hour},
+		{name: "heuristic cap", header: map[string]string{"Last-Modified": "Mon, 01 Jan 2024 12:00:00 GMT"}, want: 24 * time.Hour},
+		{name: "heuristic of other status", status: http.StatusInternalServerError, header: map[string]string{"Last-Modified": "Wed, 01 May 2024 02:00:00 GMT"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &cacheEntry{Status: tt.status, Header: http.Header{"Date": {date}}}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			for key, value := range tt.header {
+				entry.Header.Set(key, value)
+			}
+			if got := entry.freshnessLifetime(); got != tt.want {
+				t.Errorf("Expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestValidateCache tests the cache configuration validation.
+func TestValidateCache(t *testing.T) {
+	if err := validateCache("route1", &Cache{MaxBytes: 1 << 20, MaxEntryBytes: 1 << 10}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+	if err := validateCache("route1", &Cache{MaxBytes: -1}); err == nil {
+		t.Errorf("Expected error for a negative maxbytes")
+	}
+	if err := validateCache("route1", &Cache{MaxBytes: 1 << 10, MaxEntryBytes: 1 << 20}); err == nil {
+		t.Errorf("Expected error for a maxentrybytes above maxbytes")
+	}
+	if err := validateCache("route1", &Cache{Coalesce: true, CoalesceTimeout: -time.Second}); err == nil {
+		t.Errorf("Expected error for a negative coalescetimeout")
+	}
+}
+
+// TestHTTPCacheCoalescing tests that concurrent identical requests share one upstream request.
+func TestHTTPCacheCoalescing(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		language     func(i int) string
+		wantCalls    int32
+		wantStatus   string // Cache-Status of the waiting requests, if they are alike
+	}{
+		{name: "stored response is shared", cacheControl: "max-age=60", wantCalls: 1, wantStatus: "reverseproxy; fwd=uri-miss; collapsed; ttl=60"},
+		{name: "private response is not shared", cacheControl: "private", wantCalls: 5, wantStatus: "reverseproxy; fwd=uri-miss; collapsed=?0"},
+		{name: "other variant", cacheControl: "max-age=60", language: func(i int) string { return []string{"en", "de"}[min(i, 1)] }, wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc, _ := newTestCache(t, &Route{Name: "grafana"}, &Cache{Coalesce: true})
+			started, release := make(chan struct{}), make(chan struct{})
+			upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Leader") != "" {
+					close(started)
+					<-release
+				}
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Header().Set("Vary", "Accept-Language")
+				w.Write([]byte("dashboard"))
+			}}
+			handler := hc.Middleware(upstream)
+			language := func(i int) string { return "en" }
+			if tt.language != nil {
+				language = tt.language
+			}
+
+			leader := make(chan *httptest.ResponseRecorder)
+			go func() {
+				leader <- cacheGet(handler, "/api/dashboards", map[string]string{"X-Leader": "true", "Accept-Language": language(0)})
+			}()
+			<-started
+
+			var wg sync.WaitGroup
+			waiters := make([]*httptest.ResponseRecorder, 4)
+			for i := range waiters {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					waiters[i] = cacheGet(handler, "/api/dashboards", map[string]string{"Accept-Language": language(i + 1)})
+				}()
+			}
+			// the waiters are blocked on the leader until it is released
+			for hc.waiting() < len(waiters) {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			<-leader
+			wg.Wait()
+
+			if upstream.calls.Load() != tt.wantCalls {
+				t.Errorf("Expected %d upstream requests but got %d", tt.wantCalls, upstream.calls.Load())
+			}
+			for _, w := range waiters {
+				if w.Body.String() != "dashboard" || tt.wantStatus != "" && w.Header().Get("Cache-Status") != tt.wantStatus {
+					t.Errorf("Unexpected response %q with Cache-Status %q", w.Body.String(), w.Header().Get("Cache-Status"))
+				}
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		hc, _ := newTestCache(t, &Route{Name: "grafana"}, &Cache{Coalesce: true, CoalesceTimeout: 10 * time.Millisecond})
+		started, release := make(chan struct{}), make(chan struct{})
+		upstream := &cacheUpstream{handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Leader") != "" {
+				close(started)
+				<-release
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("dashboard"))
+		}}
+		handler := hc.Middleware(upstream)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cacheGet(handler, "/api/dashboards", map[string]string{"X-Leader": "true"})
+		}()
+		<-started
+		w := cacheGet(handler, "/api/dashboards", nil)
+		close(release)
+		<-done
+		if w.Body.String() != "dashboard" || w.Header().Get("Cache-Status") != "reverseproxy; fwd=uri-miss; collapsed=?0" || upstream.calls.Load() != 2 {
+			t.Errorf("Expected the waiting request to go upstream after the timeout but got Cache-Status %q", w.Header().Get("Cache-Status"))
+		}
+	})
+}
+
+// waiting returns the number of requests that joined the flights in progress.
+func (hc *HTTPCache) waiting() int {
+	waiting := 0
+	hc.flights.Range(func(_, value any) bool {
+		waiting += int(value.(*flight).waiters.Load())
+		return true
+	})
+	return waiting
+}
@@ -0,0 +1,127 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+)
+
+// HTTPRedirect configures a plain HTTP companion listener of an HTTPS route that redirects to the HTTPS URL.
+// ACME HTTP-01 challenges are served from ACMEChallengeDir and HealthPaths are answered with 200,
+// every other request is redirected with Status, preserving the path and query.
+type HTTPRedirect struct {
+	ListenPort       int      `yaml:"listenport omitempty=false"`
+	Status           int      `yaml:"status omitempty=false"`           // 301, 302, 307 or 308 (default)
+	HTTPSPort        int      `yaml:"httpsport omitempty=false"`        // port in the redirect URL, defaults to the route listen port
+	ACMEChallengeDir string   `yaml:"acmechallengedir omitempty=false"` // webroot holding .well-known/acme-challenge tokens
+	HealthPaths      []string `yaml:"healthpaths omitempty=false"`      // defaults to /healthz
+}
+
+// acmeTokenPattern matches valid ACME challenge tokens, which are base64url encoded.
+var acmeTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateHTTPRedirect validates the HTTP redirect listener of a route.
+func validateHTTPRedirect(route Route, redirect *HTTPRedirect) error {
+	if route.Protocol != "https" {
+		return fmt.Errorf("httpredirect requires an https route for route %s", route.Name)
+	}
+	if redirect.ListenPort <= 0 || redirect.ListenPort > 65535 || redirect.ListenPort == route.ListenPort {
+		return fmt.Errorf("invalid httpredirect listenport for route %s", route.Name)
+	}
+	switch redirect.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid httpredirect status %d for route %s", redirect.Status, route.Name)
+	}
+	if redirect.HTTPSPort < 0 || redirect.HTTPSPort > 65535 {
+		return fmt.Errorf("invalid httpredirect httpsport for route %s", route.Name)
+	}
+	return nil
+}
+
+// HTTPSRedirector is the handler of the HTTP redirect listener.
+type HTTPSRedirector struct {
+	RouteName string
+	Config    *HTTPRedirect
+
+	httpsPort   int
+	healthPaths []string
+}
+
+// NewHTTPSRedirector creates the redirect handler of the route.
+func NewHTTPSRedirector(route *Route) *HTTPSRedirector {
+	hr := &HTTPSRedirector{
+		RouteName:   route.Name,
+		Config:      route.HTTPRedirect,
+		httpsPort:   route.HTTPRedirect.HTTPSPort,
+		healthPaths: route.HTTPRedirect.HealthPaths,
+	}
+	if hr.httpsPort == 0 {
+		hr.httpsPort = route.ListenPort
+	}
+	if len(hr.healthPaths) == 0 {
+		hr.healthPaths = []string{constants.HealthPath}
+	}
+	return hr
+}
+
+// NewRedirectServer creates the http.Server of the redirect listener with the listener limits of the route.
+func NewRedirectServer(route *Route) *http.Server {
+	listener := *route
+	listener.ListenPort = route.HTTPRedirect.ListenPort
+	return NewHTTPServer(&listener, NewHTTPSRedirector(route))
+}
+
+// ServeHTTP answers ACME challenges and health checks and redirects everything else to HTTPS.
+func (hr *HTTPSRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token, ok := strings.CutPrefix(r.URL.Path, constants.ACMEChallengePath); ok && hr.Config.ACMEChallengeDir != "" {
+		hr.serveChallenge(w, r, token)
+		return
+	}
+
+	for _, path := range hr.healthPaths {
+		if r.URL.Path == path {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("OK"))
+			return
+		}
+	}
+
+	status := hr.Config.Status
+	if status == 0 {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, hr.location(r), status)
+}
+
+// serveChallenge serves the key authorization of an ACME HTTP-01 challenge token.
+func (hr *HTTPSRedirector) serveChallenge(w http.ResponseWriter, r *http.Request, token string) {
+	if !acmeTokenPattern.MatchString(token) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeFile(w, r, filepath.Join(hr.Config.ACMEChallengeDir, constants.ACMEChallengePath, token))
+}
+
+// location returns the HTTPS URL of the request.
+func (hr *HTTPSRedirector) location(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		// an IPv6 host without a port is still bracketed
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if hr.httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(hr.httpsPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
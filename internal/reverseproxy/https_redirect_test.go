@@ -0,0 +1,88 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHTTPSRedirector tests redirects, ACME challenges and health checks on the redirect listener.
+func TestHTTPSRedirector(t *testing.T) {
+	webroot := t.TempDir()
+	challengeDir := filepath.Join(webroot, ".well-known", "acme-challenge")
+	if err := os.MkdirAll(challengeDir, 0o755); err != nil {
+		t.Fatalf("Failed to create challenge dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(challengeDir, "tok3n_A-b"), []byte("tok3n_A-b.thumbprint"), 0o644); err != nil {
+		t.Fatalf("Failed to write challenge: %v", err)
+	}
+
+	route := &Route{Name: "proxy-k8s", Protocol: "https", ListenPort: 6443, HTTPRedirect: &HTTPRedirect{ListenPort: 6080, ACMEChallengeDir: webroot}}
+
+	tests := []struct {
+		name         string
+		target       string
+		host         string
+		status       int
+		httpsPort    int
+		wantCode     int
+		wantLocation string
+		wantBody     string
+	}{
+		{name: "default status keeps path and query", target: "/api/v1/pods?watch=1", host: "k8s.example.com:6080", wantCode: http.StatusPermanentRedirect, wantLocation: "https://k8s.example.com:6443/api/v1/pods?watch=1"},
+		{name: "configured status", target: "/", host: "k8s.example.com", status: http.StatusMovedPermanently, wantCode: http.StatusMovedPermanently, wantLocation: "https://k8s.example.com:6443/"},
+		{name: "default https port", target: "/a", host: "k8s.example.com", httpsPort: 443, wantCode: http.StatusPermanentRedirect, wantLocation: "https://k8s.example.com/a"},
+		{name: "IPv6 host", target: "/", host: "[::1]:6080", wantCode: http.StatusPermanentRedirect, wantLocation: "https://[::1]:6443/"},
+		{name: "IPv6 host without port", target: "/", host: "[::1]", wantCode: http.StatusPermanentRedirect, wantLocation: "https://[::1]:6443/"},
+		{name: "IPv6 host default https port", target: "/", host: "[::1]", httpsPort: 443, wantCode: http.StatusPermanentRedirect, wantLocation: "https://[::1]/"},
+		{name: "ACME challenge", target: "/.well-known/acme-challenge/tok3n_A-b", host: "k8s.example.com", wantCode: http.StatusOK, wantBody: "tok3n_A-b.thumbprint"},
+		{name: "unknown ACME token", target: "/.well-known/acme-challenge/missing", host: "k8s.example.com", wantCode: http.StatusNotFound},
+		{name: "ACME path traversal", target: "/.well-known/acme-challenge/..%2f..%2fsecret", host: "k8s.example.com", wantCode: http.StatusNotFound},
+		{name: "health", target: "/healthz", host: "k8s.example.com", wantCode: http.StatusOK, wantBody: "OK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirect := *route.HTTPRedirect
+			redirect.Status = tt.status
+			redirect.HTTPSPort = tt.httpsPort
+			r := *route
+			r.HTTPRedirect = &redirect
+			handler := NewHTTPSRedirector(&r)
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Expected Location %q but got %q", tt.wantLocation, got)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %q but got %q", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestValidateHTTPRedirect tests the redirect listener configuration validation.
+func TestValidateHTTPRedirect(t *testing.T) {
+	route := Route{Name: "route1", Protocol: "https", ListenPort: 6443}
+	if err := validateHTTPRedirect(Route{Name: "route1", Protocol: "http", ListenPort: 6442}, &HTTPRedirect{ListenPort: 6080}); err == nil {
+		t.Errorf("Expected error for an http route")
+	}
+	if err := validateHTTPRedirect(route, &HTTPRedirect{ListenPort: 6443}); err == nil {
+		t.Errorf("Expected error for the route listen port")
+	}
+	if err := validateHTTPRedirect(route, &HTTPRedirect{ListenPort: 6080, Status: http.StatusOK}); err == nil {
+		t.Errorf("Expected error for a non redirect status")
+	}
+	if err := validateHTTPRedirect(route, &HTTPRedirect{ListenPort: 6080, Status: http.StatusTemporaryRedirect}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+}
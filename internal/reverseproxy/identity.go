@@ -0,0 +1,29 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Identity is the client identity established by an authentication middleware.
+type Identity struct {
+	User   string         // authenticated user name
+	Groups []string       // groups of the user, if known
+	Method string         // authentication method, e.g. "basic"
+	Claims map[string]any // token claims, if authenticated by a token
+}
+
+// identityContextKey is the context key of the Identity of a request.
+type identityContextKey struct{}
+
+// withIdentity returns a shallow copy of the request carrying the identity.
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	ctx := context.WithValue(r.Context(), identityContextKey{}, identity)
+	return r.WithContext(ctx)
+}
+
+// identityFromContext returns the identity of the request, if it was authenticated.
+func identityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return identity, ok
+}
@@ -0,0 +1,129 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilter configures allow and deny CIDR lists for a route.
+// Deny rules are evaluated first; when Allow is not empty only matching clients are let through.
+// Entries may be CIDRs ("10.0.0.0/8", "fd00::/8") or single addresses.
+type IPFilter struct {
+	Allow      []string `yaml:"allow omitempty=false"`
+	Deny       []string `yaml:"deny omitempty=false"`
+	DenyStatus int      `yaml:"denystatus omitempty=false"` // defaults to 403
+}
+
+// IPMatcher matches client addresses against the parsed rules of an IPFilter.
+type IPMatcher struct {
+	RouteName  string
+	allow      []netip.Prefix
+	deny       []netip.Prefix
+	denyStatus int
+}
+
+// validateIPFilter validates the IP filter configuration of a route.
+func validateIPFilter(routeName string, filter *IPFilter) error {
+	if _, err := NewIPMatcher(routeName, filter); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewIPMatcher parses the rules of the IPFilter.
+func NewIPMatcher(routeName string, filter *IPFilter) (*IPMatcher, error) {
+	allow, err := parsePrefixes(filter.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipfilter allow rule for route %s: %w", routeName, err)
+	}
+	deny, err := parsePrefixes(filter.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipfilter deny rule for route %s: %w", routeName, err)
+	}
+
+	denyStatus := filter.DenyStatus
+	if denyStatus == 0 {
+		denyStatus = http.StatusForbidden
+	}
+	if denyStatus < 400 || denyStatus > 599 {
+		return nil, fmt.Errorf("invalid ipfilter denystatus for route %s", routeName)
+	}
+
+	return &IPMatcher{
+		RouteName:  routeName,
+		allow:      allow,
+		deny:       deny,
+		denyStatus: denyStatus,
+	}, nil
+}
+
+// parsePrefixes parses CIDRs and single addresses into prefixes.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// matchPrefix returns the first prefix containing the address.
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Allowed reports whether the client IP passes the filter and returns the rule that decided it.
+// An unparsable IP is only allowed when there are no allow rules.
+func (m *IPMatcher) Allowed(ip string) (bool, string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		if len(m.allow) > 0 {
+			return false, "invalid client ip"
+		}
+		return true, ""
+	}
+	addr = addr.Unmap()
+
+	if prefix, ok := matchPrefix(m.deny, addr); ok {
+		return false, "deny " + prefix.String()
+	}
+	if len(m.allow) == 0 {
+		return true, ""
+	}
+	if prefix, ok := matchPrefix(m.allow, addr); ok {
+		return true, "allow " + prefix.String()
+	}
+	return false, "not in allow list"
+}
+
+// Middleware rejects clients that do not pass the filter with the configured status.
+func (m *IPMatcher) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if allowed, rule := m.Allowed(ip); !allowed {
+			log.Warn("Client IP denied", m.RouteName, ip, rule)
+			http.Error(w, http.StatusText(m.denyStatus), m.denyStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIPMatcherAllowed tests allow and deny rule evaluation for IPv4 and IPv6 clients.
+func TestIPMatcherAllowed(t *testing.T) {
+	matcher, err := NewIPMatcher("route1", &IPFilter{
+		Allow: []string{"192.168.2.0/24", "fd00::/8", "10.8.0.1"},
+		Deny:  []string{"192.168.2.13"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+		rule    string
+	}{
+		{ip: "192.168.2.10", allowed: true, rule: "allow 192.168.2.0/24"},
+		{ip: "192.168.2.13", allowed: false, rule: "deny 192.168.2.13/32"},
+		{ip: "::ffff:192.168.2.10", allowed: true, rule: "allow 192.168.2.0/24"},
+		{ip: "fd12::1", allowed: true, rule: "allow fd00::/8"},
+		{ip: "10.8.0.1", allowed: true, rule: "allow 10.8.0.1/32"},
+		{ip: "8.8.8.8", allowed: false, rule: "not in allow list"},
+		{ip: "2001:db8::1", allowed: false, rule: "not in allow list"},
+		{ip: "bogus", allowed: false, rule: "invalid client ip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			allowed, rule := matcher.Allowed(tt.ip)
+			if allowed != tt.allowed || rule != tt.rule {
+				t.Errorf("Allowed(%s) = %v, %q, want %v, %q", tt.ip, allowed, rule, tt.allowed, tt.rule)
+			}
+		})
+	}
+}
+
+// TestIPMatcherMiddleware tests that denied clients get the configured status.
+func TestIPMatcherMiddleware(t *testing.T) {
+	matcher, err := NewIPMatcher("route1", &IPFilter{Deny: []string{"192.0.2.0/24"}, DenyStatus: http.StatusNotFound})
+	if err != nil {
+		t.Fatalf("Failed to create matcher: %v", err)
+	}
+	handler := matcher.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 but got %v", w.Code)
+	}
+
+	req.RemoteAddr = "198.51.100.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status OK but got %v", w.Code)
+	}
+}
+
+// TestValidateIPFilter tests that invalid rules are rejected.
+func TestValidateIPFilter(t *testing.T) {
+	if err := validateIPFilter("route1", &IPFilter{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("Expected error for invalid CIDR")
+	}
+	if err := validateIPFilter("route1", &IPFilter{DenyStatus: 200}); err == nil {
+		t.Errorf("Expected error for invalid deny status")
+	}
+}
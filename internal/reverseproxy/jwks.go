@@ -0,0 +1,242 @@
+package reverseproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// jsonWebKey is a key of a JSON Web Key Set as defined by RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// verificationKey is a parsed key usable to verify token signatures.
+type verificationKey struct {
+	Kid string
+	Alg string // algorithm the key is restricted to, if any
+	Key crypto.PublicKey
+}
+
+// parseJWKS parses a JSON Web Key Set. Keys for other uses than signatures and unsupported key types are skipped.
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := []verificationKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			log.Warn("Skipping invalid JWKS key", jwk.Kid, err)
+			continue
+		}
+		keys = append(keys, verificationKey{Kid: jwk.Kid, Alg: jwk.Alg, Key: key})
+	}
+	return keys, nil
+}
+
+// parseJSONWebKey returns the public key of an RSA, EC, OKP (Ed25519) or oct (HMAC) JSON Web Key.
+// HMAC keys are returned as []byte.
+func parseJSONWebKey(jwk jsonWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(k) == 0 {
+			return nil, fmt.Errorf("invalid HMAC key")
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// JWKSCache provides the verification keys of a local JWKS file or a JWKS URL.
+// Keys from a URL are refreshed every Refresh interval and when a token uses an unknown key ID,
+// at most once per constants.JWKSMinRefreshInterval. Only one fetch runs at a time and it runs
+// without holding the lock, so other requests keep using the cached keys.
+type JWKSCache struct {
+	URL     string
+	Refresh time.Duration
+
+	file   *reloadableFile[[]verificationKey]
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	keys        []verificationKey
+	fetched     time.Time
+	lastAttempt time.Time
+	inflight    chan struct{} // closed when the running fetch completes
+}
+
+// NewJWKSCache loads the keys from the file, or fetches them from the URL.
+// A failed initial fetch is logged and retried on the next request so that the route can still start.
+func NewJWKSCache(file, url string, refresh time.Duration) (*JWKSCache, error) {
+	cache := &JWKSCache{
+		URL:     url,
+		Refresh: refresh,
+		client:  &http.Client{Timeout: constants.Timeout},
+		now:     time.Now,
+	}
+	if cache.Refresh <= 0 {
+		cache.Refresh = constants.JWKSRefreshInterval
+	}
+
+	if file != "" {
+		keys, err := newReloadableFile(file, parseJWKS)
+		if err != nil {
+			return nil, err
+		}
+		cache.file = keys
+		return cache, nil
+	}
+
+	done := make(chan struct{})
+	cache.inflight = done
+	cache.fetch(done)
+	return cache, nil
+}
+
+// Keys returns the current keys. Stale keys from a URL are refreshed in the background.
+// When refresh is true, e.g. for an unknown key ID, or no keys were fetched yet, the caller
+// waits for the fetch instead.
+func (c *JWKSCache) Keys(refresh bool) []verificationKey {
+	if c.file != nil {
+		return c.file.Load()
+	}
+
+	c.mu.Lock()
+	keys := c.keys
+	wait := refresh || c.fetched.IsZero()
+	done := c.inflight
+	now := c.now()
+	if done == nil && (wait || now.Sub(c.fetched) >= c.Refresh) && now.Sub(c.lastAttempt) >= constants.JWKSMinRefreshInterval {
+		done = make(chan struct{})
+		c.inflight = done
+		go c.fetch(done)
+	}
+	c.mu.Unlock()
+
+	if !wait || done == nil {
+		return keys
+	}
+	<-done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys
+}
+
+// fetch downloads the JWKS, keeping the cached keys if that fails, and closes done once it completes.
+func (c *JWKSCache) fetch(done chan struct{}) {
+	c.mu.Lock()
+	c.lastAttempt = c.now()
+	c.mu.Unlock()
+
+	keys, err := c.download()
+
+	c.mu.Lock()
+	if err != nil {
+		log.Error("Error fetching JWKS, keeping cached keys", c.URL, err)
+	} else {
+		c.keys = keys
+		c.fetched = c.now()
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// download fetches and parses the JWKS.
+func (c *JWKSCache) download() ([]verificationKey, error) {
+	resp, err := c.client.Get(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, constants.JWKSMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
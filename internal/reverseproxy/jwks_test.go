@@ -0,0 +1,109 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reverseproxy/internal/constants"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer is a test JWKS endpoint serving oct keys with the current key ID.
+type jwksServer struct {
+	*httptest.Server
+	kid     atomic.Value
+	calls   atomic.Int32
+	status  atomic.Int32
+	release atomic.Value // chan struct{} requests wait for until it is closed
+}
+
+func newJWKSServer(t *testing.T, kid string) *jwksServer {
+	server := &jwksServer{}
+	closed := make(chan struct{})
+	close(closed)
+	server.release.Store(closed)
+	server.kid.Store(kid)
+	server.status.Store(http.StatusOK)
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.calls.Add(1)
+		<-server.release.Load().(chan struct{})
+		w.WriteHeader(int(server.status.Load()))
+		w.Write([]byte(`{"keys":[{"kty":"oct","kid":"` + server.kid.Load().(string) + `","k":"c2VjcmV0"}]}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// keyIDs returns the key IDs of the keys.
+func keyIDs(keys []verificationKey) string {
+	ids := ""
+	for _, key := range keys {
+		ids += key.Kid
+	}
+	return ids
+}
+
+// TestJWKSCacheRotation tests the periodic refresh, the refresh for unknown key IDs and its rate limit.
+func TestJWKSCacheRotation(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	cache, err := NewJWKSCache("", server.URL, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create JWKS cache: %v", err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if got := keyIDs(cache.Keys(false)); got != "k1" || server.calls.Load() != 1 {
+		t.Fatalf("Expected the fetched key k1 but got %q after %d fetches", got, server.calls.Load())
+	}
+
+	// unknown key IDs refetch at most once per minimum interval
+	server.kid.Store("k2")
+	if got := keyIDs(cache.Keys(true)); got != "k1" || server.calls.Load() != 1 {
+		t.Errorf("Expected the refetch to be rate limited but got %q after %d fetches", got, server.calls.Load())
+	}
+	now = now.Add(constants.JWKSMinRefreshInterval)
+	if got := keyIDs(cache.Keys(true)); got != "k2" {
+		t.Errorf("Expected the rotated key k2 but got %q", got)
+	}
+
+	// a failed fetch keeps the cached keys
+	server.status.Store(http.StatusInternalServerError)
+	now = now.Add(time.Minute)
+	if got := keyIDs(cache.Keys(true)); got != "k2" || server.calls.Load() != 3 {
+		t.Errorf("Expected the cached key k2 after a failed fetch but got %q after %d fetches", got, server.calls.Load())
+	}
+}
+
+// TestJWKSCacheBackgroundRefresh tests that requests keep using the cached keys while a slow refresh runs.
+func TestJWKSCacheBackgroundRefresh(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	cache, err := NewJWKSCache("", server.URL, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create JWKS cache: %v", err)
+	}
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	release := make(chan struct{})
+	server.release.Store(release)
+	server.kid.Store("k2")
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if got := keyIDs(cache.Keys(false)); got != "k1" {
+			t.Errorf("Expected the cached key k1 during the refresh but got %q", got)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("Expected the stale keys to be returned without waiting for the refresh")
+		}
+	}
+
+	close(release)
+	if got := keyIDs(cache.Keys(true)); got != "k2" {
+		t.Errorf("Expected the refreshed key k2 but got %q", got)
+	}
+	if server.calls.Load() != 2 {
+		t.Errorf("Expected a single refresh but got %d fetches", server.calls.Load()-1)
+	}
+}
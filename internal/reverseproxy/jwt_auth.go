@@ -0,0 +1,402 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWTAuth configures bearer token validation for a route.
+// Keys are read from a local JWKS file or fetched from a JWKS URL.
+type JWTAuth struct {
+	JWKSFile       string        `yaml:"jwksfile omitempty=false"`
+	JWKSURL        string        `yaml:"jwksurl omitempty=false"`
+	JWKSRefresh    time.Duration `yaml:"jwksrefresh omitempty=false"`
+	Issuer         string        `yaml:"issuer omitempty=false"`
+	Audience       []string      `yaml:"audience omitempty=false"`   // the token must carry one of these audiences
+	Algorithms     []string      `yaml:"algorithms omitempty=false"` // allowed algorithms, defaults to all supported
+	ClockSkew      time.Duration `yaml:"clockskew omitempty=false"`
+	RequiredClaims []string      `yaml:"requiredclaims omitempty=false"`
+	ClaimHeaders   []ClaimHeader `yaml:"claimheaders omitempty=false"`
+}
+
+// ClaimHeader maps a token claim to a header of the upstream request.
+type ClaimHeader struct {
+	Claim  string `yaml:"claim omitempty=false"`
+	Header string `yaml:"header omitempty=false"`
+}
+
+// supportedJWTAlgorithms are the signature algorithms accepted by the JWTVerifier.
+var supportedJWTAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA", "HS256", "HS384", "HS512"}
+
+// tokenError is a token validation failure reported to the client in the WWW-Authenticate header.
+type tokenError struct {
+	description string
+}
+
+func (e *tokenError) Error() string {
+	return e.description
+}
+
+// validateJWTAuth validates the JWT configuration of a route.
+func validateJWTAuth(routeName string, auth *JWTAuth) error {
+	if (auth.JWKSFile == "") == (auth.JWKSURL == "") {
+		return fmt.Errorf("exactly one of jwt jwksfile or jwksurl is required for route %s", routeName)
+	}
+	for _, alg := range auth.Algorithms {
+		if !slices.Contains(supportedJWTAlgorithms, alg) {
+			return fmt.Errorf("unsupported jwt algorithm %s for route %s", alg, routeName)
+		}
+	}
+	if auth.ClockSkew < 0 {
+		return fmt.Errorf("invalid jwt clockskew for route %s", routeName)
+	}
+	for _, mapping := range auth.ClaimHeaders {
+		if mapping.Claim == "" || mapping.Header == "" {
+			return fmt.Errorf("jwt claimheaders need a claim and a header for route %s", routeName)
+		}
+	}
+	return nil
+}
+
+// JWTVerifier verifies the signature and registered claims of JSON Web Tokens.
+type JWTVerifier struct {
+	Issuer         string
+	Audience       []string
+	Algorithms     []string
+	ClockSkew      time.Duration
+	RequiredClaims []string
+
+	keys *JWKSCache
+	now  func() time.Time
+}
+
+// NewJWTVerifier creates a JWTVerifier using the keys of the cache.
+func NewJWTVerifier(keys *JWKSCache, issuer string, audience []string) *JWTVerifier {
+	return &JWTVerifier{
+		Issuer:     issuer,
+		Audience:   audience,
+		Algorithms: supportedJWTAlgorithms,
+		keys:       keys,
+		now:        time.Now,
+	}
+}
+
+// Verify checks the token and returns its claims.
+func (v *JWTVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &tokenError{"malformed token"}
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, &tokenError{"malformed token header"}
+	}
+	if !slices.Contains(v.Algorithms, header.Alg) {
+		return nil, &tokenError{"unsupported token algorithm"}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &tokenError{"malformed token signature"}
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	verified, known := v.verifySignature(header.Alg, header.Kid, signingInput, signature, false)
+	if !known {
+		verified, _ = v.verifySignature(header.Alg, header.Kid, signingInput, signature, true)
+	}
+	if !verified {
+		return nil, &tokenError{"invalid token signature"}
+	}
+
+	claims := map[string]any{}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, &tokenError{"malformed token claims"}
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature tries the keys matching the key ID and algorithm and reports whether a matching key was known.
+// With refresh the key set is re-fetched first, which lets the verifier pick up rotated keys.
+func (v *JWTVerifier) verifySignature(alg, kid string, signingInput, signature []byte, refresh bool) (bool, bool) {
+	known := false
+	for _, key := range v.keys.Keys(refresh) {
+		if kid != "" && key.Kid != kid {
+			continue
+		}
+		if key.Alg != "" && key.Alg != alg {
+			continue
+		}
+		known = true
+		if verifyJWTSignature(alg, key.Key, signingInput, signature) == nil {
+			return true, true
+		}
+	}
+	return false, known
+}
+
+// validateClaims checks the registered claims and the required claims.
+func (v *JWTVerifier) validateClaims(claims map[string]any) error {
+	now := v.now()
+
+	if exp, ok := numericClaim(claims, "exp"); ok {
+		if now.After(time.Unix(exp, 0).Add(v.ClockSkew)) {
+			return &tokenError{"token is expired"}
+		}
+	} else if _, present := claims["exp"]; present {
+		return &tokenError{"invalid exp claim"}
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok {
+		if now.Add(v.ClockSkew).Before(time.Unix(nbf, 0)) {
+			return &tokenError{"token is not valid yet"}
+		}
+	} else if _, present := claims["nbf"]; present {
+		return &tokenError{"invalid nbf claim"}
+	}
+
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return &tokenError{"invalid token issuer"}
+	}
+
+	if len(v.Audience) > 0 && !slices.ContainsFunc(claimStrings(claims, "aud"), func(aud string) bool {
+		return slices.Contains(v.Audience, aud)
+	}) {
+		return &tokenError{"invalid token audience"}
+	}
+
+	for _, claim := range v.RequiredClaims {
+		if _, ok := claims[claim]; !ok {
+			return &tokenError{fmt.Sprintf("missing required claim %s", claim)}
+		}
+	}
+	return nil
+}
+
+// decodeTokenPart decodes a base64url encoded JSON token part, keeping numbers exact.
+func decodeTokenPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// numericClaim returns a NumericDate claim in seconds.
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+// claimStrings returns a claim that is either a string or an array of strings.
+func claimStrings(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimString formats a claim for an upstream header; arrays are joined with commas.
+func claimString(claims map[string]any, name string) string {
+	switch value := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case []any:
+		return strings.Join(claimStrings(claims, name), ",")
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// verifyJWTSignature verifies a JWS signature with the key for the algorithm.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	var hashFunc crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hashFunc = crypto.SHA256
+	case "384":
+		hashFunc = crypto.SHA384
+	case "512":
+		hashFunc = crypto.SHA512
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, hashFunc, digest(hashFunc, signingInput), signature)
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an ECDSA key")
+		}
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384()}[alg]
+		if curve == nil {
+			return fmt.Errorf("unsupported algorithm %s", alg)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if pub.Curve != curve || len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest(hashFunc, signingInput), r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signingInput, signature) {
+			return errors.New("invalid EdDSA signature")
+		}
+		return nil
+	case strings.HasPrefix(alg, "HS"):
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not an HMAC key")
+		}
+		newHash := map[crypto.Hash]func() hash.Hash{crypto.SHA256: sha256.New, crypto.SHA384: sha512.New384, crypto.SHA512: sha512.New}[hashFunc]
+		mac := hmac.New(newHash, secret)
+		mac.Write(signingInput)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid HMAC signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// digest hashes the data with the hash function.
+func digest(hashFunc crypto.Hash, data []byte) []byte {
+	h := hashFunc.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// JWTAuthenticator is a middleware requiring a valid bearer token on a route.
+type JWTAuthenticator struct {
+	RouteName string
+	Config    *JWTAuth
+	Verifier  *JWTVerifier
+}
+
+// NewJWTAuthenticator creates a JWTAuthenticator, loading the keys of the configuration.
+func NewJWTAuthenticator(routeName string, config *JWTAuth) (*JWTAuthenticator, error) {
+	keys, err := NewJWKSCache(config.JWKSFile, config.JWKSURL, config.JWKSRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("error loading JWKS for route %s: %w", routeName, err)
+	}
+
+	verifier := NewJWTVerifier(keys, config.Issuer, config.Audience)
+	verifier.ClockSkew = config.ClockSkew
+	verifier.RequiredClaims = config.RequiredClaims
+	if len(config.Algorithms) > 0 {
+		verifier.Algorithms = config.Algorithms
+	}
+
+	return &JWTAuthenticator{
+		RouteName: routeName,
+		Config:    config,
+		Verifier:  verifier,
+	}, nil
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get(constants.AuthorizationHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Middleware rejects requests without a valid token with 401 and maps claims into upstream headers.
+func (ja *JWTAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		challenge := fmt.Sprintf(`Bearer realm="%s"`, ja.RouteName)
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set(constants.WWWAuthenticateHeader, challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := ja.Verifier.Verify(token)
+		if err != nil {
+			log.Warn("JWT validation failed", ja.RouteName, clientIP(r), err)
+			description := "invalid token"
+			if tokenErr, ok := err.(*tokenError); ok {
+				description = tokenErr.description
+			}
+			w.Header().Set(constants.WWWAuthenticateHeader, fmt.Sprintf(`%s, error="invalid_token", error_description="%s"`, challenge, description))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		for _, mapping := range ja.Config.ClaimHeaders {
+			r.Header.Del(mapping.Header)
+			if value := claimString(claims, mapping.Claim); value != "" {
+				r.Header.Set(mapping.Header, value)
+			}
+		}
+
+		identity := &Identity{
+			User:   claimString(claims, "sub"),
+			Groups: claimStrings(claims, "groups"),
+			Method: "jwt",
+			Claims: claims,
+		}
+		next.ServeHTTP(w, withIdentity(r, identity))
+	})
+}
@@ -0,0 +1,234 @@
+package reverseproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKeys holds the private keys of the local JWKS stand-in.
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	hmacKey []byte
+}
+
+// newTestKeys generates a key of every supported type.
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, hmacKey: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+// jwks returns the public JSON Web Key Set of the keys.
+func (k *testKeys) jwks() []byte {
+	b64 := func(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(k.ec.X.FillBytes(make([]byte, 32))), "y": b64(k.ec.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "oct", "kid": "hmac", "k": b64(k.hmacKey)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(k.rsa.N.Bytes()), "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign creates a token with the algorithm and key ID.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, hashed[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, hashed[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(k.ed, []byte(input))
+	case "HS256":
+		mac := hmac.New(sha256.New, k.hmacKey)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// noneToken creates an unsigned token.
+func noneToken(claims map[string]any) string {
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+// TestJWTAuthenticatorMiddleware tests token validation against a local JWKS stand-in served over HTTP.
+func TestJWTAuthenticatorMiddleware(t *testing.T) {
+	keys := newTestKeys(t)
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(keys.jwks())
+	}))
+	defer jwksServer.Close()
+
+	authenticator, err := NewJWTAuthenticator("route1", &JWTAuth{
+		JWKSURL:        jwksServer.URL,
+		Issuer:         "https://issuer.example.com",
+		Audience:       []string{"proxy"},
+		ClockSkew:      30 * time.Second,
+		RequiredClaims: []string{"email"},
+		ClaimHeaders:   []ClaimHeader{{Claim: "email", Header: "X-Auth-Email"}, {Claim: "groups", Header: "X-Auth-Groups"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	var upstream *http.Request
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	now := time.Now().Unix()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": "https://issuer.example.com", "aud": []string{"other", "proxy"}, "sub": "alice",
+			"email": "alice@example.com", "groups": []string{"admins", "dev"}, "exp": now + 60, "nbf": now,
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantCode  int
+		wantError string
+	}{
+		{name: "RS256", token: keys.sign(t, "RS256", "rsa", claims(nil)), wantCode: http.StatusOK},
+		{name: "ES256", token: keys.sign(t, "ES256", "ec", claims(nil)), wantCode: http.StatusOK},
+		{name: "EdDSA", token: keys.sign(t, "EdDSA", "ed", claims(nil)), wantCode: http.StatusOK},
+		{name: "HS256", token: keys.sign(t, "HS256", "hmac", claims(nil)), wantCode: http.StatusOK},
+		{name: "expired within skew", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now - 10})), wantCode: http.StatusOK},
+		{name: "missing token", wantCode: http.StatusUnauthorized},
+		{name: "expired", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now - 60})), wantCode: http.StatusUnauthorized, wantError: "token is expired"},
+		{name: "not yet valid", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"nbf": now + 60})), wantCode: http.StatusUnauthorized, wantError: "token is not valid yet"},
+		{name: "wrong issuer", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"iss": "evil"})), wantCode: http.StatusUnauthorized, wantError: "invalid token issuer"},
+		{name: "wrong audience", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"aud": "other"})), wantCode: http.StatusUnauthorized, wantError: "invalid token audience"},
+		{name: "missing claim", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"email": nil})), wantCode: http.StatusUnauthorized, wantError: "missing required claim email"},
+		{name: "wrong key", token: keys.sign(t, "ES256", "rsa", claims(nil)), wantCode: http.StatusUnauthorized, wantError: "invalid token signature"},
+		{name: "encryption key", token: keys.sign(t, "RS256", "enc", claims(nil)), wantCode: http.StatusUnauthorized, wantError: "invalid token signature"},
+		{name: "none algorithm", token: noneToken(claims(nil)), wantCode: http.StatusUnauthorized, wantError: "unsupported token algorithm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Auth-Email", "spoofed@example.com")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d (%s)", tt.wantCode, w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantCode == http.StatusUnauthorized {
+				want := `Bearer realm="route1"`
+				if tt.wantError != "" {
+					want += `, error="invalid_token", error_description="` + tt.wantError + `"`
+				}
+				if got := w.Header().Get("WWW-Authenticate"); got != want {
+					t.Errorf("Expected WWW-Authenticate %q but got %q", want, got)
+				}
+				return
+			}
+			if got := upstream.Header.Get("X-Auth-Email"); got != "alice@example.com" {
+				t.Errorf("Expected X-Auth-Email alice@example.com but got %q", got)
+			}
+			if got := upstream.Header.Get("X-Auth-Groups"); got != "admins,dev" {
+				t.Errorf("Expected X-Auth-Groups admins,dev but got %q", got)
+			}
+			if identity, ok := identityFromContext(upstream.Context()); !ok || identity.User != "alice" {
+				t.Errorf("Expected identity alice in context")
+			}
+		})
+	}
+}
+
+// TestJWKSCacheFile tests loading keys from a local JWKS file.
+func TestJWKSCacheFile(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks(), 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS file: %v", err)
+	}
+
+	cache, err := NewJWKSCache(path, "", 0)
+	if err != nil {
+		t.Fatalf("Failed to create JWKS cache: %v", err)
+	}
+	// the encryption key is skipped
+	if got := len(cache.Keys(false)); got != 4 {
+		t.Errorf("Expected 4 signature keys but got %d", got)
+	}
+
+	verifier := NewJWTVerifier(cache, "", nil)
+	if _, err := verifier.Verify(keys.sign(t, "EdDSA", "ed", map[string]any{"sub": "alice"})); err != nil {
+		t.Errorf("Expected token to verify but got %v", err)
+	}
+}
+
+// TestValidateJWTAuth tests the JWT configuration validation.
+func TestValidateJWTAuth(t *testing.T) {
+	if err := validateJWTAuth("route1", &JWTAuth{}); err == nil {
+		t.Errorf("Expected error without key source")
+	}
+	if err := validateJWTAuth("route1", &JWTAuth{JWKSFile: "a", JWKSURL: "b"}); err == nil {
+		t.Errorf("Expected error with two key sources")
+	}
+	if err := validateJWTAuth("route1", &JWTAuth{JWKSFile: "a", Algorithms: []string{"none"}}); err == nil {
+		t.Errorf("Expected error for unsupported algorithm")
+	}
+}
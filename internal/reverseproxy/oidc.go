@@ -0,0 +1,646 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC configures an OpenID Connect relying party for browser routes.
+// Unauthenticated browsers are redirected to the provider; the callback is served on the path of RedirectURL.
+type OIDC struct {
+	Issuer           string        `yaml:"issuer omitempty=false"`
+	ClientID         string        `yaml:"clientid omitempty=false"`
+	ClientSecret     string        `yaml:"clientsecret omitempty=false"`
+	ClientSecretFile string        `yaml:"clientsecretfile omitempty=false"`
+	RedirectURL      string        `yaml:"redirecturl omitempty=false"` // e.g. https://grafana.example.com/oauth2/callback
+	Scopes           []string      `yaml:"scopes omitempty=false"`      // defaults to openid, email and profile
+	CookieName       string        `yaml:"cookiename omitempty=false"`
+	CookieSecret     string        `yaml:"cookiesecret omitempty=false"`
+	CookieSecretFile string        `yaml:"cookiesecretfile omitempty=false"`
+	SessionLifetime  time.Duration `yaml:"sessionlifetime omitempty=false"`
+	GroupsClaim      string        `yaml:"groupsclaim omitempty=false"`   // defaults to "groups"
+	AllowedGroups    []string      `yaml:"allowedgroups omitempty=false"` // the user must be in one of these groups
+	AllowedEmails    []string      `yaml:"allowedemails omitempty=false"` // exact addresses or domains such as "@example.com"
+	PassAccessToken  bool          `yaml:"passaccesstoken omitempty=false"`
+}
+
+// oidcSession is the content of the encrypted session cookie.
+type oidcSession struct {
+	Subject      string    `json:"sub"`
+	User         string    `json:"user"`
+	Email        string    `json:"email,omitempty"`
+	Groups       []string  `json:"groups,omitempty"`
+	AccessToken  string    `json:"at,omitempty"`
+	RefreshToken string    `json:"rt,omitempty"`
+	TokenExpiry  time.Time `json:"texp"`
+	Expiry       time.Time `json:"exp"`
+}
+
+// oidcLoginState is the content of the short-lived cookie tying the callback to the login redirect.
+type oidcLoginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Return   string    `json:"return"`
+	Expiry   time.Time `json:"exp"`
+}
+
+// oidcProviderMetadata is the subset of the provider discovery document used by the relying party.
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenResponse is the token endpoint response.
+type oidcTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// validateOIDC validates the OIDC configuration of a route.
+func validateOIDC(routeName string, config *OIDC) error {
+	if config.Issuer == "" || config.ClientID == "" {
+		return fmt.Errorf("oidc issuer and clientid are required for route %s", routeName)
+	}
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirect.IsAbs() || redirect.Path == "" {
+		return fmt.Errorf("oidc redirecturl must be an absolute URL for route %s", routeName)
+	}
+	if config.CookieSecret == "" && config.CookieSecretFile == "" {
+		return fmt.Errorf("oidc cookiesecret or cookiesecretfile is required for route %s", routeName)
+	}
+	if config.CookieSecret != "" && len(config.CookieSecret) < constants.OIDCMinCookieSecretBytes {
+		return fmt.Errorf("oidc cookiesecret must be at least %d bytes for route %s", constants.OIDCMinCookieSecretBytes, routeName)
+	}
+	return nil
+}
+
+// OIDCAuthenticator is a middleware implementing the authorization code flow with PKCE.
+type OIDCAuthenticator struct {
+	RouteName string
+	Config    *OIDC
+
+	clientSecret string
+	callbackPath string
+	cookies      *cookieCipher
+	client       *http.Client
+	now          func() time.Time
+
+	mu            sync.Mutex
+	metadata      *oidcProviderMetadata
+	verifier      *JWTVerifier
+	discovery     chan struct{} // closed when the running discovery completes
+	discoveryErr  error
+	lastDiscovery time.Time
+
+	refreshMu sync.Mutex
+	refreshes map[string]*oidcRefresh // by hash of the refresh token
+}
+
+// oidcRefresh is a token refresh shared by the requests carrying the same refresh token.
+type oidcRefresh struct {
+	done    chan struct{} // closed when the refresh completes
+	session *oidcSession
+	err     error
+	expiry  time.Time // the session is reused until then for requests still sending the old cookie
+}
+
+// NewOIDCAuthenticator creates an OIDCAuthenticator. Provider discovery happens on the first request
+// so that the route can start while the provider is unreachable.
+func NewOIDCAuthenticator(routeName string, config *OIDC) (*OIDCAuthenticator, error) {
+	clientSecret, err := secretValue(config.ClientSecret, config.ClientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading oidc client secret for route %s: %w", routeName, err)
+	}
+	cookieSecret, err := secretValue(config.CookieSecret, config.CookieSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading oidc cookie secret for route %s: %w", routeName, err)
+	}
+	if len(cookieSecret) < constants.OIDCMinCookieSecretBytes {
+		return nil, fmt.Errorf("oidc cookie secret must be at least %d bytes for route %s", constants.OIDCMinCookieSecretBytes, routeName)
+	}
+	cookies, err := newCookieCipher([]byte(cookieSecret))
+	if err != nil {
+		return nil, err
+	}
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCAuthenticator{
+		RouteName:    routeName,
+		Config:       config,
+		clientSecret: clientSecret,
+		callbackPath: redirect.Path,
+		cookies:      cookies,
+		client:       &http.Client{Timeout: constants.Timeout},
+		now:          time.Now,
+		refreshes:    map[string]*oidcRefresh{},
+	}, nil
+}
+
+// secretValue returns the inline secret or the trimmed content of the secret file.
+func secretValue(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// provider returns the discovered provider metadata and the ID token verifier, discovering them if needed.
+// Only one discovery runs at a time, without holding the lock; a failed discovery is retried
+// at most once per constants.OIDCDiscoveryRetryInterval.
+func (oa *OIDCAuthenticator) provider() (*oidcProviderMetadata, *JWTVerifier, error) {
+	oa.mu.Lock()
+	if oa.metadata != nil {
+		defer oa.mu.Unlock()
+		return oa.metadata, oa.verifier, nil
+	}
+	done := oa.discovery
+	if done == nil {
+		if oa.discoveryErr != nil && oa.now().Sub(oa.lastDiscovery) < constants.OIDCDiscoveryRetryInterval {
+			defer oa.mu.Unlock()
+			return nil, nil, oa.discoveryErr
+		}
+		done = make(chan struct{})
+		oa.discovery = done
+		oa.lastDiscovery = oa.now()
+		go oa.discover(done)
+	}
+	oa.mu.Unlock()
+
+	<-done
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+	if oa.metadata == nil {
+		return nil, nil, oa.discoveryErr
+	}
+	return oa.metadata, oa.verifier, nil
+}
+
+// discover fetches the provider metadata and its keys and closes done once it completes.
+func (oa *OIDCAuthenticator) discover(done chan struct{}) {
+	metadata, keys, err := oa.fetchProvider()
+
+	oa.mu.Lock()
+	if err != nil {
+		oa.discoveryErr = err
+	} else {
+		oa.metadata = metadata
+		oa.verifier = NewJWTVerifier(keys, metadata.Issuer, []string{oa.Config.ClientID})
+		oa.verifier.ClockSkew = constants.OIDCClockSkew
+		oa.verifier.now = oa.now
+		oa.discoveryErr = nil
+	}
+	oa.discovery = nil
+	oa.mu.Unlock()
+	close(done)
+}
+
+// fetchProvider fetches the discovery document and the keys of the provider.
+func (oa *OIDCAuthenticator) fetchProvider() (*oidcProviderMetadata, *JWKSCache, error) {
+	discoveryURL := strings.TrimSuffix(oa.Config.Issuer, "/") + constants.OIDCDiscoveryPath
+	resp, err := oa.client.Get(discoveryURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	metadata := &oidcProviderMetadata{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, constants.JWKSMaxSize)).Decode(metadata); err != nil {
+		return nil, nil, err
+	}
+	if metadata.Issuer != oa.Config.Issuer {
+		return nil, nil, fmt.Errorf("discovered issuer %s does not match %s", metadata.Issuer, oa.Config.Issuer)
+	}
+
+	keys, err := NewJWKSCache("", metadata.JWKSURI, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, keys, nil
+}
+
+// cookieName returns the name of the session cookie.
+func (oa *OIDCAuthenticator) cookieName() string {
+	if oa.Config.CookieName != "" {
+		return oa.Config.CookieName
+	}
+	return constants.OIDCCookieName
+}
+
+// Middleware serves the callback, redirects unauthenticated browsers to the provider and
+// forwards identity headers of authenticated sessions.
+func (oa *OIDCAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oa.callbackPath {
+			oa.handleCallback(w, r)
+			return
+		}
+
+		session, ok := oa.loadSession(w, r)
+		if !ok {
+			oa.startLogin(w, r)
+			return
+		}
+
+		for _, header := range []string{constants.ForwardedUserHeader, constants.ForwardedEmailHeader, constants.ForwardedGroupsHeader, constants.ForwardedAccessTokenHeader} {
+			r.Header.Del(header)
+		}
+		r.Header.Set(constants.ForwardedUserHeader, session.User)
+		if session.Email != "" {
+			r.Header.Set(constants.ForwardedEmailHeader, session.Email)
+		}
+		if len(session.Groups) > 0 {
+			r.Header.Set(constants.ForwardedGroupsHeader, strings.Join(session.Groups, ","))
+		}
+		if oa.Config.PassAccessToken && session.AccessToken != "" {
+			r.Header.Set(constants.ForwardedAccessTokenHeader, session.AccessToken)
+		}
+
+		// the session cookie is meant for the proxy only
+		removeCookie(r, oa.cookieName())
+
+		identity := &Identity{User: session.User, Groups: session.Groups, Method: "oidc"}
+		next.ServeHTTP(w, withIdentity(r, identity))
+	})
+}
+
+// loadSession returns the session of the request, refreshing the tokens when they expired.
+func (oa *OIDCAuthenticator) loadSession(w http.ResponseWriter, r *http.Request) (*oidcSession, bool) {
+	cookie, err := r.Cookie(oa.cookieName())
+	if err != nil {
+		return nil, false
+	}
+	session := &oidcSession{}
+	if err := oa.cookies.Open(oa.cookieName(), cookie.Value, session); err != nil {
+		log.Debug("Invalid OIDC session cookie", oa.RouteName, clientIP(r))
+		return nil, false
+	}
+
+	now := oa.now()
+	if now.After(session.Expiry) {
+		return nil, false
+	}
+	if session.RefreshToken == "" || now.Before(session.TokenExpiry) {
+		return session, true
+	}
+
+	refreshed, err := oa.refresh(session)
+	if err != nil {
+		log.Warn("OIDC token refresh failed", oa.RouteName, session.User, err)
+		return nil, false
+	}
+	if err := oa.setSessionCookie(w, r, refreshed); err != nil {
+		log.Error("Error setting OIDC session cookie", err)
+		return nil, false
+	}
+	return refreshed, true
+}
+
+// refresh exchanges the refresh token of the session for new tokens. Requests carrying the same
+// refresh token share one exchange and a successful result is reused for constants.OIDCRefreshReuse,
+// so providers rotating refresh tokens do not see the old one again.
+func (oa *OIDCAuthenticator) refresh(session *oidcSession) (*oidcSession, error) {
+	sum := sha256.Sum256([]byte(session.RefreshToken))
+	key := string(sum[:])
+
+	oa.refreshMu.Lock()
+	now := oa.now()
+	for hash, flight := range oa.refreshes {
+		if !flight.expiry.IsZero() && now.After(flight.expiry) {
+			delete(oa.refreshes, hash)
+		}
+	}
+	flight, shared := oa.refreshes[key]
+	if !shared {
+		flight = &oidcRefresh{done: make(chan struct{})}
+		oa.refreshes[key] = flight
+	}
+	oa.refreshMu.Unlock()
+
+	if shared {
+		<-flight.done
+		return flight.session, flight.err
+	}
+
+	tokens, err := oa.tokenRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err == nil {
+		flight.session, err = oa.newSession(tokens, "", session)
+	}
+	flight.err = err
+
+	oa.refreshMu.Lock()
+	if err != nil {
+		delete(oa.refreshes, key)
+	} else {
+		flight.expiry = oa.now().Add(constants.OIDCRefreshReuse)
+	}
+	oa.refreshMu.Unlock()
+	close(flight.done)
+	return flight.session, flight.err
+}
+
+// startLogin redirects browsers to the authorization endpoint and rejects other clients with 401.
+func (oa *OIDCAuthenticator) startLogin(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	metadata, _, err := oa.provider()
+	if err != nil {
+		log.Error("Error discovering OIDC provider", oa.RouteName, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	login := oidcLoginState{Return: r.URL.RequestURI(), Expiry: oa.now().Add(constants.OIDCLoginTimeout)}
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *value, err = randomString(32); err != nil {
+			log.Error("Error generating OIDC login state", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stateCookie := oa.cookieName() + constants.OIDCStateCookieSuffix
+	sealed, err := oa.cookies.Seal(stateCookie, login)
+	if err != nil {
+		log.Error("Error sealing OIDC login state", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, oa.cookie(r, stateCookie, sealed, login.Expiry))
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	scopes := oa.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = constants.OIDCDefaultScopes
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oa.Config.ClientID},
+		"redirect_uri":          {oa.Config.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	authorizationURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		log.Error("Invalid OIDC authorization endpoint", oa.RouteName, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	for key, values := range authorizationURL.Query() {
+		query[key] = values
+	}
+	authorizationURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authorizationURL.String(), http.StatusFound)
+}
+
+// handleCallback exchanges the authorization code for tokens and establishes the session.
+func (oa *OIDCAuthenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	stateCookie := oa.cookieName() + constants.OIDCStateCookieSuffix
+	cookie, err := r.Cookie(stateCookie)
+	login := oidcLoginState{}
+	if err != nil || oa.cookies.Open(stateCookie, cookie.Value, &login) != nil || oa.now().After(login.Expiry) {
+		http.Error(w, "Login session expired", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, oa.cookie(r, stateCookie, "", time.Unix(0, 0)))
+
+	query := r.URL.Query()
+	if query.Get("state") != login.State {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		log.Warn("OIDC provider returned an error", oa.RouteName, providerErr, query.Get("error_description"))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	tokens, err := oa.tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {oa.Config.RedirectURL},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		log.Warn("OIDC code exchange failed", oa.RouteName, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	session, err := oa.newSession(tokens, login.Nonce, nil)
+	if err != nil {
+		log.Warn("OIDC login rejected", oa.RouteName, clientIP(r), err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err := oa.setSessionCookie(w, r, session); err != nil {
+		log.Error("Error setting OIDC session cookie", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("OIDC login", oa.RouteName, session.User, clientIP(r))
+	returnTo := login.Return
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// tokenRequest calls the token endpoint with the client credentials.
+func (oa *OIDCAuthenticator) tokenRequest(form url.Values) (*oidcTokenResponse, error) {
+	metadata, _, err := oa.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	form.Set("client_id", oa.Config.ClientID)
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if oa.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oa.Config.ClientID), url.QueryEscape(oa.clientSecret))
+	}
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status code: %d", resp.StatusCode)
+	}
+
+	tokens := &oidcTokenResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, constants.JWKSMaxSize)).Decode(tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// newSession verifies the ID token, enforces the allow-lists and builds the session.
+// On refresh the previous session is passed and providers may omit the ID token and refresh token.
+func (oa *OIDCAuthenticator) newSession(tokens *oidcTokenResponse, nonce string, previous *oidcSession) (*oidcSession, error) {
+	_, verifier, err := oa.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	now := oa.now()
+	session := &oidcSession{}
+	if previous != nil {
+		*session = *previous
+	} else {
+		lifetime := oa.Config.SessionLifetime
+		if lifetime <= 0 {
+			lifetime = constants.OIDCSessionLifetime
+		}
+		session.Expiry = now.Add(lifetime)
+	}
+
+	if tokens.IDToken == "" && previous == nil {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	if tokens.IDToken != "" {
+		claims, err := verifier.Verify(tokens.IDToken)
+		if err != nil {
+			return nil, err
+		}
+		if nonce != "" && claims["nonce"] != nonce {
+			return nil, fmt.Errorf("invalid id_token nonce")
+		}
+		if previous != nil && claims["sub"] != previous.Subject {
+			return nil, fmt.Errorf("id_token subject changed on refresh")
+		}
+
+		groupsClaim := oa.Config.GroupsClaim
+		if groupsClaim == "" {
+			groupsClaim = "groups"
+		}
+		session.Subject = claimString(claims, "sub")
+		session.Email = claimString(claims, "email")
+		session.Groups = claimStrings(claims, groupsClaim)
+		session.User = claimString(claims, "preferred_username")
+		if session.User == "" {
+			session.User = session.Subject
+		}
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			session.Email = ""
+		}
+	}
+
+	if err := oa.authorize(session); err != nil {
+		return nil, err
+	}
+
+	if oa.Config.PassAccessToken {
+		session.AccessToken = tokens.AccessToken
+	}
+	if tokens.RefreshToken != "" {
+		session.RefreshToken = tokens.RefreshToken
+	}
+	expiresIn := time.Duration(tokens.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = constants.OIDCDefaultTokenLifetime
+	}
+	session.TokenExpiry = now.Add(expiresIn)
+	return session, nil
+}
+
+// authorize enforces the group and email allow-lists.
+func (oa *OIDCAuthenticator) authorize(session *oidcSession) error {
+	if len(oa.Config.AllowedGroups) > 0 && !slices.ContainsFunc(session.Groups, func(group string) bool {
+		return slices.Contains(oa.Config.AllowedGroups, group)
+	}) {
+		return fmt.Errorf("user %s is not in an allowed group", session.User)
+	}
+
+	if len(oa.Config.AllowedEmails) > 0 {
+		email := strings.ToLower(session.Email)
+		allowed := email != "" && slices.ContainsFunc(oa.Config.AllowedEmails, func(entry string) bool {
+			entry = strings.ToLower(entry)
+			if strings.HasPrefix(entry, "@") {
+				return strings.HasSuffix(email, entry)
+			}
+			return email == entry
+		})
+		if !allowed {
+			return fmt.Errorf("email of user %s is not allowed", session.User)
+		}
+	}
+	return nil
+}
+
+// setSessionCookie seals the session into the session cookie.
+func (oa *OIDCAuthenticator) setSessionCookie(w http.ResponseWriter, r *http.Request, session *oidcSession) error {
+	sealed, err := oa.cookies.Seal(oa.cookieName(), session)
+	if err != nil {
+		return err
+	}
+	if len(sealed) > constants.MaxCookieSize {
+		return fmt.Errorf("session cookie exceeds %d bytes", constants.MaxCookieSize)
+	}
+	http.SetCookie(w, oa.cookie(r, oa.cookieName(), sealed, session.Expiry))
+	return nil
+}
+
+// cookie returns an HttpOnly cookie, secure when the route is served over HTTPS.
+func (oa *OIDCAuthenticator) cookie(r *http.Request, name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(oa.Config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// removeCookie removes a cookie from the Cookie header of the request.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
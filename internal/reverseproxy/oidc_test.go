@@ -0,0 +1,325 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a local OpenID provider stand-in serving discovery, JWKS and the token endpoint.
+type mockIssuer struct {
+	*httptest.Server
+	t         *testing.T
+	keys      *testKeys
+	now       func() time.Time
+	groups    []string
+	nonce     string
+	challenge string
+
+	mu           sync.Mutex
+	refreshes    int
+	refreshToken string // the valid refresh token, rotated on every refresh if rotate is set
+	rotate       bool
+	delay        time.Duration
+}
+
+// newMockIssuer starts the mock provider.
+func newMockIssuer(t *testing.T, now func() time.Time) *mockIssuer {
+	m := &mockIssuer{t: t, keys: newTestKeys(t), now: now, groups: []string{"grafana-users"}, refreshToken: "refresh-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize?prompt=login",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(m.keys.jwks())
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// token implements the authorization code and refresh token grants.
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if user, secret, ok := r.BasicAuth(); !ok || user != "proxy" || secret != "client-secret" {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	claims := map[string]any{
+		"iss": m.URL, "aud": "proxy", "sub": "user-1", "preferred_username": "alice",
+		"email": "alice@example.com", "email_verified": true, "groups": m.groups,
+		"exp": m.now().Add(time.Hour).Unix(), "iat": m.now().Unix(),
+	}
+
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code-1" || base64.RawURLEncoding.EncodeToString(challenge[:]) != m.challenge {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		claims["nonce"] = m.nonce
+	case "refresh_token":
+		time.Sleep(m.delay)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if r.FormValue("refresh_token") != m.refreshToken {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		m.refreshes++
+		if m.rotate {
+			m.refreshToken = fmt.Sprintf("refresh-%d", m.refreshes+1)
+		}
+	default:
+		http.Error(w, "unsupported grant", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  "access-1",
+		"refresh_token": m.refreshToken,
+		"id_token":      m.keys.sign(m.t, "RS256", "rsa", claims),
+		"expires_in":    60,
+	})
+}
+
+// TestOIDCAuthenticatorLoginFlow tests the redirect, callback, session and refresh against the mock issuer.
+func TestOIDCAuthenticatorLoginFlow(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	issuer := newMockIssuer(t, clock)
+	defer issuer.Close()
+
+	authenticator, err := NewOIDCAuthenticator("grafana", &OIDC{
+		Issuer:          issuer.URL,
+		ClientID:        "proxy",
+		ClientSecret:    "client-secret",
+		RedirectURL:     "https://grafana.example.com/oauth2/callback",
+		CookieSecret:    "cookie-secret-of-at-least-32-bytes",
+		AllowedGroups:   []string{"grafana-users"},
+		AllowedEmails:   []string{"@example.com"},
+		PassAccessToken: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	authenticator.now = clock
+
+	var upstream *http.Request
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(target string, accept string, cookies []*http.Cookie) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Forwarded-User", "spoofed")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// API clients without a session are rejected
+	if resp := serve("/api/health", "application/json", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 but got %v", resp.Status)
+	}
+
+	// browsers are redirected to the provider
+	resp := serve("/d/home?orgId=1", "text/html", nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status 302 but got %v", resp.Status)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("prompt") != "login" || query.Get("code_challenge_method") != "S256" ||
+		query.Get("redirect_uri") != "https://grafana.example.com/oauth2/callback" || query.Get("scope") != "openid email profile" {
+		t.Fatalf("Unexpected authorization URL %s", location)
+	}
+	issuer.nonce = query.Get("nonce")
+	issuer.challenge = query.Get("code_challenge")
+	stateCookies := resp.Cookies()
+
+	// a forged state is rejected
+	if resp := serve("/oauth2/callback?code=code-1&state=forged", "text/html", stateCookies); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for forged state but got %v", resp.Status)
+	}
+
+	// the callback establishes the session and returns to the original URL
+	resp = serve("/oauth2/callback?code=code-1&state="+query.Get("state"), "text/html", stateCookies)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/d/home?orgId=1" {
+		t.Fatalf("Expected redirect to the original URL but got %v %s", resp.Status, resp.Header.Get("Location"))
+	}
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "_proxy_session" {
+			session = cookie
+		}
+	}
+	if session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("Expected a secure HttpOnly session cookie but got %v", resp.Cookies())
+	}
+
+	resp = serve("/d/home", "text/html", []*http.Cookie{session, {Name: "grafana_session", Value: "abc"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK with a session but got %v", resp.Status)
+	}
+	if upstream.Header.Get("X-Forwarded-User") != "alice" || upstream.Header.Get("X-Forwarded-Email") != "alice@example.com" ||
+		upstream.Header.Get("X-Forwarded-Groups") != "grafana-users" || upstream.Header.Get("X-Forwarded-Access-Token") != "access-1" {
+		t.Errorf("Unexpected identity headers %v", upstream.Header)
+	}
+	if _, err := upstream.Cookie("_proxy_session"); err == nil {
+		t.Errorf("Expected the session cookie to be removed from the upstream request")
+	}
+	if _, err := upstream.Cookie("grafana_session"); err != nil {
+		t.Errorf("Expected other cookies to be kept")
+	}
+
+	// expired tokens are refreshed with the refresh token
+	now = now.Add(2 * time.Minute)
+	resp = serve("/d/home", "text/html", []*http.Cookie{session})
+	if resp.StatusCode != http.StatusOK || issuer.refreshes != 1 || len(resp.Cookies()) != 1 {
+		t.Fatalf("Expected a refreshed session but got %v, %d refreshes", resp.Status, issuer.refreshes)
+	}
+
+	// removal from the allowed group is enforced on refresh
+	issuer.groups = []string{"other"}
+	now = now.Add(2 * time.Minute)
+	if resp := serve("/d/home", "text/html", []*http.Cookie{session}); resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected a new login after losing the group but got %v", resp.Status)
+	}
+}
+
+// TestOIDCAuthenticatorConcurrentRefresh tests that parallel requests with the same expired session
+// spend the refresh token once with a provider that rotates refresh tokens.
+func TestOIDCAuthenticatorConcurrentRefresh(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	issuer := newMockIssuer(t, clock)
+	defer issuer.Close()
+	issuer.rotate = true
+	issuer.delay = 50 * time.Millisecond
+
+	authenticator, err := NewOIDCAuthenticator("grafana", &OIDC{
+		Issuer:       issuer.URL,
+		ClientID:     "proxy",
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://grafana.example.com/oauth2/callback",
+		CookieSecret: "cookie-secret-of-at-least-32-bytes",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	authenticator.now = clock
+	sealed, err := authenticator.cookies.Seal("_proxy_session", &oidcSession{
+		Subject: "user-1", User: "alice", RefreshToken: "refresh-1",
+		TokenExpiry: now.Add(-time.Minute), Expiry: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Failed to seal session: %v", err)
+	}
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/d/home", nil)
+			req.AddCookie(&http.Cookie{Name: "_proxy_session", Value: sealed})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("Expected every request to be refreshed but got %d", status)
+		}
+	}
+	if issuer.refreshes != 1 {
+		t.Errorf("Expected a single refresh but got %d", issuer.refreshes)
+	}
+}
+
+// TestValidateOIDC tests the OIDC configuration validation.
+func TestValidateOIDC(t *testing.T) {
+	config := OIDC{Issuer: "https://idp.example.com", ClientID: "proxy", RedirectURL: "https://grafana.example.com/oauth2/callback"}
+	config.CookieSecret = strings.Repeat("s", 32)
+	if err := validateOIDC("grafana", &config); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+	config.CookieSecret = "short"
+	if err := validateOIDC("grafana", &config); err == nil {
+		t.Errorf("Expected error for a short cookie secret")
+	}
+}
+
+// TestOIDCAuthorize tests the group and email allow-lists.
+func TestOIDCAuthorize(t *testing.T) {
+	authenticator := &OIDCAuthenticator{Config: &OIDC{AllowedGroups: []string{"admins"}, AllowedEmails: []string{"bob@corp.com", "@example.com"}}}
+
+	tests := []struct {
+		name    string
+		session oidcSession
+		wantErr bool
+	}{
+		{name: "allowed domain", session: oidcSession{Groups: []string{"admins"}, Email: "Alice@Example.com"}},
+		{name: "allowed address", session: oidcSession{Groups: []string{"admins"}, Email: "bob@corp.com"}},
+		{name: "other address", session: oidcSession{Groups: []string{"admins"}, Email: "eve@corp.com"}, wantErr: true},
+		{name: "no email", session: oidcSession{Groups: []string{"admins"}}, wantErr: true},
+		{name: "not in group", session: oidcSession{Groups: []string{"dev"}, Email: "alice@example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := authenticator.authorize(&tt.session); (err != nil) != tt.wantErr {
+				t.Errorf("authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCookieCipher tests that sealed cookies are bound to their name and secret.
+func TestCookieCipher(t *testing.T) {
+	cookies, _ := newCookieCipher([]byte("secret"))
+	sealed, err := cookies.Seal("session", oidcSession{User: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to seal cookie: %v", err)
+	}
+
+	session := oidcSession{}
+	if err := cookies.Open("session", sealed, &session); err != nil || session.User != "alice" {
+		t.Errorf("Expected to open the cookie but got %v", err)
+	}
+	if err := cookies.Open("other", sealed, &session); err == nil {
+		t.Errorf("Expected error for a different cookie name")
+	}
+	other, _ := newCookieCipher([]byte("other"))
+	if err := other.Open("session", sealed, &session); err == nil {
+		t.Errorf("Expected error for a different secret")
+	}
+}
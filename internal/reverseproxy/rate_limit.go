@@ -0,0 +1,229 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit configures token-bucket rate limiting for a route.
+// Rate is the number of requests per second a key may make on average and Burst is the bucket size.
+// Key selects how requests are grouped: "ip" (default), "header", "claim" or "route".
+// The limit applies before authentication, except for "claim", which needs the claims verified by jwtauth;
+// requests of such routes rejected by authentication are limited by client IP before it instead.
+type RateLimit struct {
+	Rate        float64       `yaml:"rate omitempty=false"`
+	Burst       int           `yaml:"burst omitempty=false"`
+	Key         string        `yaml:"key omitempty=false"`
+	Header      string        `yaml:"header omitempty=false"`      // request header used when Key is "header"
+	Claim       string        `yaml:"claim omitempty=false"`       // JWT claim used when Key is "claim"
+	IdleTimeout time.Duration `yaml:"idletimeout omitempty=false"` // idle keys are dropped after this duration
+}
+
+// validateRateLimit validates the rate limit configuration of a route.
+func validateRateLimit(route Route, rl *RateLimit) error {
+	routeName := route.Name
+	if rl.Rate <= 0 {
+		return fmt.Errorf("invalid ratelimit rate for route %s", routeName)
+	}
+	if rl.Burst < 1 {
+		return fmt.Errorf("invalid ratelimit burst for route %s", routeName)
+	}
+
+	switch rl.Key {
+	case "", constants.RateLimitKeyIP, constants.RateLimitKeyRoute:
+	case constants.RateLimitKeyHeader:
+		if rl.Header == "" {
+			return fmt.Errorf("ratelimit header is required for route %s", routeName)
+		}
+	case constants.RateLimitKeyClaim:
+		if rl.Claim == "" {
+			return fmt.Errorf("ratelimit claim is required for route %s", routeName)
+		}
+		if route.JWTAuth == nil {
+			return fmt.Errorf("ratelimit key claim requires jwtauth for route %s", routeName)
+		}
+	default:
+		return fmt.Errorf("invalid ratelimit key %s for route %s", rl.Key, routeName)
+	}
+
+	return nil
+}
+
+// tokenBucket holds the state of a single rate limit key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter enforces a RateLimit using one token bucket per key.
+type RateLimiter struct {
+	RouteName string
+	Config    *RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter for the named route.
+func NewRateLimiter(routeName string, config *RateLimit) *RateLimiter {
+	return &RateLimiter{
+		RouteName: routeName,
+		Config:    config,
+		buckets:   make(map[string]*tokenBucket),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key.
+// It returns whether the request is allowed, the tokens left and how long until the next token is available.
+func (rl *RateLimiter) Allow(key string) (bool, int, time.Duration) {
+	return rl.take(key, true)
+}
+
+// Peek reports whether the bucket of the key has a token left without taking it.
+func (rl *RateLimiter) Peek(key string) (bool, time.Duration) {
+	allowed, _, wait := rl.take(key, false)
+	return allowed, wait
+}
+
+// take refills the bucket of the key and takes a token from it if consume is set.
+func (rl *RateLimiter) take(key string, consume bool) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	burst := float64(rl.Config.Burst)
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	// refill the bucket for the time elapsed since the last request
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(burst, bucket.tokens+elapsed*rl.Config.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rl.Config.Rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	if consume {
+		bucket.tokens--
+	}
+	return true, int(bucket.tokens), 0
+}
+
+// sweep drops buckets that have been idle for longer than the idle timeout so memory stays bounded.
+// An idle bucket would have refilled to its burst anyway, so dropping it does not change the outcome.
+func (rl *RateLimiter) sweep(now time.Time) {
+	idle := rl.idleTimeout()
+	if now.Sub(rl.lastSweep) < idle {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= idle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// idleTimeout returns the configured idle timeout, never shorter than the time to refill a bucket.
+func (rl *RateLimiter) idleTimeout() time.Duration {
+	idle := rl.Config.IdleTimeout
+	if idle <= 0 {
+		idle = constants.RateLimitIdleTimeout
+	}
+	refill := time.Duration(float64(rl.Config.Burst) / rl.Config.Rate * float64(time.Second))
+	if idle < refill {
+		idle = refill
+	}
+	return idle
+}
+
+// Len returns the number of keys currently tracked.
+func (rl *RateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.buckets)
+}
+
+// Middleware rejects requests over the limit with 429 and sets the "X-RateLimit-*" headers.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := rl.requestKey(r)
+		allowed, remaining, wait := rl.Allow(key)
+
+		w.Header().Set(constants.RateLimitLimitHeader, strconv.Itoa(rl.Config.Burst))
+		w.Header().Set(constants.RateLimitRemainHeader, strconv.Itoa(remaining))
+
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set(constants.RateLimitResetHeader, strconv.Itoa(retryAfter))
+			w.Header().Set(constants.RetryAfterHeader, strconv.Itoa(retryAfter))
+			constants.RateLimitRejectedTotal.WithLabelValues(rl.RouteName).Inc()
+			log.Warn("Rate limit exceeded", rl.RouteName, key)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		reset := (float64(rl.Config.Burst) - float64(remaining)) / rl.Config.Rate
+		w.Header().Set(constants.RateLimitResetHeader, strconv.Itoa(int(math.Ceil(reset))))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthFailureMiddleware limits by client IP the requests rejected with 401 or 403 by the authentication
+// that follows, so that credentials cannot be guessed faster than the limit allows.
+func (rl *RateLimiter) AuthFailureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := constants.RateLimitKeyIP + ":" + clientIP(r)
+		if allowed, wait := rl.Peek(key); !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set(constants.RetryAfterHeader, strconv.Itoa(retryAfter))
+			constants.RateLimitRejectedTotal.WithLabelValues(rl.RouteName).Inc()
+			log.Warn("Rate limit of failed authentications exceeded", rl.RouteName, key)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+		if recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden {
+			rl.Allow(key)
+		}
+	})
+}
+
+// requestKey returns the bucket key for the request according to the configured key type.
+// Claims are only taken from the identity verified by the JWT middleware.
+// Requests missing the header or claim fall back to the client IP.
+func (rl *RateLimiter) requestKey(r *http.Request) string {
+	switch rl.Config.Key {
+	case constants.RateLimitKeyRoute:
+		return constants.RateLimitKeyRoute
+	case constants.RateLimitKeyHeader:
+		if value := r.Header.Get(rl.Config.Header); value != "" {
+			return constants.RateLimitKeyHeader + ":" + value
+		}
+	case constants.RateLimitKeyClaim:
+		if identity, ok := identityFromContext(r.Context()); ok && identity.Claims != nil {
+			if value := claimString(identity.Claims, rl.Config.Claim); value != "" {
+				return constants.RateLimitKeyClaim + ":" + value
+			}
+		}
+	}
+	return constants.RateLimitKeyIP + ":" + clientIP(r)
+}
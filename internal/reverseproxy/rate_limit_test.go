@@ -0,0 +1,172 @@
+package reverseproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRateLimiterAllow tests that the token bucket honours burst and refills at the configured rate.
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter("route1", &RateLimit{Rate: 1, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := limiter.Allow("a"); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+	}
+
+	allowed, remaining, wait := limiter.Allow("a")
+	if allowed || remaining != 0 || wait != time.Second {
+		t.Errorf("Expected rejection with 1s wait but got allowed=%v remaining=%d wait=%v", allowed, remaining, wait)
+	}
+
+	if allowed, _, _ := limiter.Allow("b"); !allowed {
+		t.Errorf("Expected a different key to have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if allowed, _, _ := limiter.Allow("a"); !allowed {
+		t.Errorf("Expected request to be allowed after refill")
+	}
+}
+
+// TestRateLimiterSweep tests that idle keys are dropped.
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter("route1", &RateLimit{Rate: 10, Burst: 1, IdleTimeout: time.Minute})
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("a")
+	limiter.Allow("b")
+	if limiter.Len() != 2 {
+		t.Fatalf("Expected 2 keys but got %d", limiter.Len())
+	}
+
+	now = now.Add(2 * time.Minute)
+	limiter.Allow("c")
+	if limiter.Len() != 1 {
+		t.Errorf("Expected idle keys to be dropped but got %d keys", limiter.Len())
+	}
+}
+
+// TestRateLimiterMiddleware tests the 429 response and rate limit headers.
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := NewRateLimiter("route1", &RateLimit{Rate: 0.1, Burst: 1, Key: "header", Header: "X-API-Key"})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(apiKey string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := send("key1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK but got %v", resp.Status)
+	}
+	if resp.Header.Get("X-RateLimit-Limit") != "1" || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers %v", resp.Header)
+	}
+
+	resp = send("key1")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429 but got %v", resp.Status)
+	}
+	if resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("Expected Retry-After 10 but got %v", resp.Header.Get("Retry-After"))
+	}
+
+	if resp := send("key2"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a different API key to be allowed but got %v", resp.Status)
+	}
+}
+
+// TestRateLimiterRequestKey tests that claims are only taken from a verified identity.
+func TestRateLimiterRequestKey(t *testing.T) {
+	limiter := NewRateLimiter("route1", &RateLimit{Rate: 1, Burst: 1, Key: "claim", Claim: "sub"})
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.10:51000"
+	req.Header.Set("Authorization", "Bearer e30."+payload+".sig")
+
+	if got := limiter.requestKey(req); got != "ip:192.0.2.10" {
+		t.Errorf("Expected the unverified token to fall back to the client IP but got %q", got)
+	}
+	req = withIdentity(req, &Identity{User: "alice", Method: "jwt", Claims: map[string]any{"sub": "alice"}})
+	if got := limiter.requestKey(req); got != "claim:alice" {
+		t.Errorf("Expected the verified claim but got %q", got)
+	}
+}
+
+// TestRateLimiterAuthFailureMiddleware tests that only requests rejected by authentication use up the limit.
+func TestRateLimiterAuthFailureMiddleware(t *testing.T) {
+	limiter := NewRateLimiter("route1", &RateLimit{Rate: 0.1, Burst: 2, Key: "claim", Claim: "sub"})
+	handler := limiter.AuthFailureMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send("Bearer valid"); code != http.StatusOK {
+			t.Fatalf("Expected authenticated requests not to use up the limit but got %d", code)
+		}
+	}
+	for _, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if code := send("Bearer guess"); code != want {
+			t.Errorf("Expected status %d but got %d", want, code)
+		}
+	}
+	if code := send("Bearer valid"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the client IP to be limited after failed attempts but got %d", code)
+	}
+}
+
+// TestValidateRateLimit tests the rate limit configuration validation.
+func TestValidateRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RateLimit
+		jwtAuth bool
+		wantErr bool
+	}{
+		{name: "valid ip", config: RateLimit{Rate: 1, Burst: 1}},
+		{name: "zero rate", config: RateLimit{Rate: 0, Burst: 1}, wantErr: true},
+		{name: "zero burst", config: RateLimit{Rate: 1, Burst: 0}, wantErr: true},
+		{name: "header without name", config: RateLimit{Rate: 1, Burst: 1, Key: "header"}, wantErr: true},
+		{name: "claim", config: RateLimit{Rate: 1, Burst: 1, Key: "claim", Claim: "sub"}, jwtAuth: true},
+		{name: "claim without jwtauth", config: RateLimit{Rate: 1, Burst: 1, Key: "claim", Claim: "sub"}, wantErr: true},
+		{name: "unknown key", config: RateLimit{Rate: 1, Burst: 1, Key: "cookie"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := Route{Name: "route1"}
+			if tt.jwtAuth {
+				route.JWTAuth = &JWTAuth{}
+			}
+			err := validateRateLimit(route, &tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
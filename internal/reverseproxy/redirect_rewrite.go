@@ -0,0 +1,209 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+)
+
+// RedirectRewrite configures rewriting of the Location, Content-Location and Refresh response headers
+// and the Domain and Path attributes of Set-Cookie, for backends mounted below a prefix or on another host.
+// URLs pointing at the target (or UpstreamHosts) are rewritten to the public scheme and host, and paths
+// under UpstreamPrefix are moved below PublicPrefix unless they already carry it.
+type RedirectRewrite struct {
+	PublicPrefix   string   `yaml:"publicprefix omitempty=false"`   // defaults to the path of the route pattern
+	UpstreamPrefix string   `yaml:"upstreamprefix omitempty=false"` // path the backend is served at, defaults to /
+	PublicHost     string   `yaml:"publichost omitempty=false"`     // defaults to the request host, or the listener address
+	PublicScheme   string   `yaml:"publicscheme omitempty=false"`   // defaults to the route protocol
+	UpstreamHosts  []string `yaml:"upstreamhosts omitempty=false"`  // further hosts the backend calls itself, besides the target
+	CookieDomain   string   `yaml:"cookiedomain omitempty=false"`   // replaces upstream cookie domains, which are removed by default
+}
+
+// validateRedirectRewrite validates the redirect rewrite configuration of a route.
+func validateRedirectRewrite(routeName string, rewrite *RedirectRewrite) error {
+	for _, prefix := range []string{rewrite.PublicPrefix, rewrite.UpstreamPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid redirectrewrite prefix %s for route %s", prefix, routeName)
+		}
+	}
+	switch rewrite.PublicScheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid redirectrewrite publicscheme %s for route %s", rewrite.PublicScheme, routeName)
+	}
+	return nil
+}
+
+// patternPath returns the path of a ServeMux pattern such as "GET example.com/app/".
+func patternPath(pattern string) string {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = strings.TrimSpace(path)
+	}
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		return pattern[i:]
+	}
+	return "/"
+}
+
+// RedirectRewriter rewrites upstream URLs in response headers to the public ones.
+type RedirectRewriter struct {
+	RouteName string
+	Config    *RedirectRewrite
+
+	publicPrefix   string
+	upstreamPrefix string
+	publicScheme   string
+	listenAddress  string
+	upstreamHosts  map[string]bool
+}
+
+// NewRedirectRewriter creates the rewriter of the route, defaulting to the route pattern and listener.
+func NewRedirectRewriter(route *Route, config *RedirectRewrite) *RedirectRewriter {
+	rr := &RedirectRewriter{
+		RouteName:      route.Name,
+		Config:         config,
+		publicPrefix:   config.PublicPrefix,
+		upstreamPrefix: strings.TrimSuffix(config.UpstreamPrefix, "/"),
+		publicScheme:   config.PublicScheme,
+		listenAddress:  net.JoinHostPort(route.ListenHost, strconv.Itoa(route.ListenPort)),
+		upstreamHosts:  map[string]bool{},
+	}
+	if rr.publicPrefix == "" {
+		rr.publicPrefix = patternPath(route.Pattern)
+	}
+	rr.publicPrefix = strings.TrimSuffix(rr.publicPrefix, "/")
+	if rr.publicScheme == "" {
+		rr.publicScheme = route.Protocol
+	}
+
+	target := route.Target
+	hosts := append([]string{target.Host, net.JoinHostPort(target.Host, strconv.Itoa(target.Port))}, config.UpstreamHosts...)
+	for _, host := range hosts {
+		rr.upstreamHosts[strings.ToLower(host)] = true
+	}
+	return rr
+}
+
+// publicHost returns the host clients use to reach the route.
+func (rr *RedirectRewriter) publicHost(r *http.Request) string {
+	if rr.Config.PublicHost != "" {
+		return rr.Config.PublicHost
+	}
+	if r.Host != "" {
+		return r.Host
+	}
+	return rr.listenAddress
+}
+
+// rewritePath moves a path under the upstream prefix below the public prefix.
+func (rr *RedirectRewriter) rewritePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	if rr.publicPrefix != "" && (path == rr.publicPrefix || strings.HasPrefix(path, rr.publicPrefix+"/")) {
+		return path
+	}
+	rest, ok := strings.CutPrefix(path, rr.upstreamPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return path
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rr.publicPrefix + rest
+}
+
+// rewriteURL rewrites an absolute URL of the upstream or an absolute path.
+// Relative references and URLs of other hosts are returned unchanged.
+func (rr *RedirectRewriter) rewriteURL(value string, r *http.Request) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if u.Host != "" {
+		if !rr.upstreamHosts[strings.ToLower(u.Host)] {
+			return value
+		}
+		u.Scheme = rr.publicScheme
+		u.Host = rr.publicHost(r)
+	} else if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+		return value
+	}
+	// the escaped path is rewritten so escapes such as %2F stay as they are
+	escaped := rr.rewritePath(u.EscapedPath())
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return value
+	}
+	u.Path, u.RawPath = path, escaped
+	return u.String()
+}
+
+// rewriteRefresh rewrites the URL of a Refresh header such as "5; url=/login".
+func (rr *RedirectRewriter) rewriteRefresh(value string, r *http.Request) string {
+	delay, target, ok := strings.Cut(value, ";")
+	if !ok {
+		return value
+	}
+	target = strings.TrimSpace(target)
+	if len(target) < 4 || !strings.EqualFold(target[:4], "url=") {
+		return value
+	}
+	return delay + "; " + target[:4] + rr.rewriteURL(strings.Trim(target[4:], `'"`), r)
+}
+
+// rewriteCookie rewrites the Domain and Path attributes of a Set-Cookie header, keeping all others.
+func (rr *RedirectRewriter) rewriteCookie(value string) string {
+	parts := strings.Split(value, ";")
+	rewritten := []string{parts[0]}
+	for _, part := range parts[1:] {
+		name, attr, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if !rr.upstreamHosts[strings.ToLower(strings.TrimPrefix(attr, "."))] {
+				break
+			}
+			if rr.Config.CookieDomain == "" {
+				continue
+			}
+			part = " " + name + "=" + rr.Config.CookieDomain
+		case "path":
+			part = " " + name + "=" + rr.rewritePath(attr)
+		}
+		rewritten = append(rewritten, part)
+	}
+	return strings.Join(rewritten, ";")
+}
+
+// apply rewrites the response headers.
+func (rr *RedirectRewriter) apply(header http.Header, r *http.Request) {
+	for _, name := range []string{constants.LocationHeader, constants.ContentLocationHeader} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, rr.rewriteURL(value, r))
+		}
+	}
+	if value := header.Get(constants.RefreshHeader); value != "" {
+		header.Set(constants.RefreshHeader, rr.rewriteRefresh(value, r))
+	}
+	if cookies := header.Values(constants.SetCookieHeader); len(cookies) > 0 {
+		rewritten := make([]string, 0, len(cookies))
+		for _, cookie := range cookies {
+			rewritten = append(rewritten, rr.rewriteCookie(cookie))
+		}
+		header[constants.SetCookieHeader] = rewritten
+	}
+}
+
+// Middleware rewrites the response headers of the upstream.
+func (rr *RedirectRewriter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = newHeaderWriter(w, func(header http.Header, status int) {
+			rr.apply(header, r)
+		})
+		next.ServeHTTP(w, r)
+	})
+}
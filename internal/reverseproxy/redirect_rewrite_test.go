@@ -0,0 +1,76 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRedirectRewriterMiddleware tests the rewriting of redirect and cookie headers to the public URL.
+func TestRedirectRewriterMiddleware(t *testing.T) {
+	route := &Route{
+		Name:       "grafana",
+		ListenHost: "0.0.0.0",
+		ListenPort: 6443,
+		Protocol:   "https",
+		Pattern:    "/grafana/",
+		Target:     Target{Name: "grafana-service", Protocol: "http", Host: "192.168.1.100", Port: 3000},
+	}
+
+	tests := []struct {
+		name      string
+		config    *RedirectRewrite
+		header    string
+		value     string
+		wantValue string
+	}{
+		{name: "absolute upstream location", config: &RedirectRewrite{}, header: "Location", value: "http://192.168.1.100:3000/login?next=%2F", wantValue: "https://proxy.example.com/grafana/login?next=%2F"},
+		{name: "absolute path location", config: &RedirectRewrite{}, header: "Location", value: "/login", wantValue: "/grafana/login"},
+		{name: "escaped path location", config: &RedirectRewrite{}, header: "Location", value: "/api/datasources/name/a%2Fb%20c", wantValue: "/grafana/api/datasources/name/a%2Fb%20c"},
+		{name: "escaped absolute location", config: &RedirectRewrite{}, header: "Location", value: "http://192.168.1.100:3000/d/a%2Fb", wantValue: "https://proxy.example.com/grafana/d/a%2Fb"},
+		{name: "already prefixed location", config: &RedirectRewrite{}, header: "Location", value: "/grafana/login", wantValue: "/grafana/login"},
+		{name: "relative location", config: &RedirectRewrite{}, header: "Location", value: "login", wantValue: "login"},
+		{name: "foreign host location", config: &RedirectRewrite{}, header: "Location", value: "https://sso.example.com/auth", wantValue: "https://sso.example.com/auth"},
+		{name: "configured upstream host and prefix", config: &RedirectRewrite{UpstreamHosts: []string{"grafana.internal"}, UpstreamPrefix: "/app/", PublicHost: "lab.example.com"}, header: "Content-Location", value: "http://grafana.internal/app/d/1", wantValue: "https://lab.example.com/grafana/d/1"},
+		{name: "upstream prefix only", config: &RedirectRewrite{UpstreamPrefix: "/app"}, header: "Location", value: "/application", wantValue: "/application"},
+		{name: "refresh", config: &RedirectRewrite{}, header: "Refresh", value: "5; URL=/login", wantValue: "5; URL=/grafana/login"},
+		{name: "cookie domain removed", config: &RedirectRewrite{}, header: "Set-Cookie", value: "session=abc; Domain=192.168.1.100; Path=/; HttpOnly; SameSite=Lax", wantValue: "session=abc; Path=/grafana/; HttpOnly; SameSite=Lax"},
+		{name: "cookie domain replaced", config: &RedirectRewrite{UpstreamHosts: []string{"grafana.internal"}, CookieDomain: "example.com"}, header: "Set-Cookie", value: "session=abc; domain=.grafana.internal; path=/api", wantValue: "session=abc; domain=example.com; path=/grafana/api"},
+		{name: "foreign cookie domain kept", config: &RedirectRewrite{}, header: "Set-Cookie", value: "id=1; Domain=example.com", wantValue: "id=1; Domain=example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter := NewRedirectRewriter(route, tt.config)
+			handler := rewriter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.header, tt.value)
+				w.WriteHeader(http.StatusFound)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/grafana/", nil)
+			req.Host = "proxy.example.com"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Header().Get(tt.header); got != tt.wantValue {
+				t.Errorf("Expected %s %q but got %q", tt.header, tt.wantValue, got)
+			}
+		})
+	}
+}
+
+// TestPatternPath tests the extraction of the path from ServeMux patterns.
+func TestPatternPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                          "/",
+		"/grafana/":                  "/grafana/",
+		"GET /api/":                  "/api/",
+		"example.com/app/":           "/app/",
+		"POST example.com/app/{id}/": "/app/{id}/",
+	}
+	for pattern, want := range tests {
+		if got := patternPath(pattern); got != want {
+			t.Errorf("patternPath(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package reverseproxy
+
+import (
+	"os"
+	"reverseproxy/internal/constants"
+	"sync"
+	"time"
+)
+
+// reloadableFile holds the parsed content of a file and re-reads it when the file changes.
+// The file is checked at most once per constants.FileReloadInterval; if a reload fails the previous content is kept.
+type reloadableFile[T any] struct {
+	Path  string
+	parse func([]byte) (T, error)
+
+	mu        sync.Mutex
+	value     T
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+	version   int
+}
+
+// newReloadableFile reads and parses the file, returning an error if the initial load fails.
+func newReloadableFile[T any](path string, parse func([]byte) (T, error)) (*reloadableFile[T], error) {
+	f := &reloadableFile[T]{Path: path, parse: parse}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.reload(stat); err != nil {
+		return nil, err
+	}
+	f.lastCheck = time.Now()
+	return f, nil
+}
+
+// Load returns the current content of the file, reloading it if it changed on disk.
+func (f *reloadableFile[T]) Load() T {
+	value, _ := f.LoadVersion()
+	return value
+}
+
+// LoadVersion returns the current content and a version that changes on every reload.
+func (f *reloadableFile[T]) LoadVersion() (T, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.lastCheck) >= constants.FileReloadInterval {
+		f.lastCheck = time.Now()
+		stat, err := os.Stat(f.Path)
+		if err != nil {
+			log.Error("Error reading file, keeping previous content", f.Path, err)
+		} else if !stat.ModTime().Equal(f.modTime) || stat.Size() != f.size {
+			if err := f.reload(stat); err != nil {
+				log.Error("Error reloading file, keeping previous content", f.Path, err)
+			} else {
+				log.Info("Reloaded file", f.Path)
+			}
+		}
+	}
+
+	return f.value, f.version
+}
+
+// reload reads and parses the file. The caller must hold the lock or own the file exclusively.
+func (f *reloadableFile[T]) reload(stat os.FileInfo) error {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return err
+	}
+	f.value = value
+	f.modTime = stat.ModTime()
+	f.size = stat.Size()
+	f.version++
+	return nil
+}
@@ -0,0 +1,236 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RequestSigning configures HMAC signing of the requests sent to a target, so the upstream can verify
+// that they came through the proxy.
+// The signature covers the method, the request URI, a timestamp, the SHA-256 of the body and the
+// SignedHeaders, and is computed with the active key of KeysFile, which is reloaded when it changes.
+// It is computed over the request as sent to the upstream, after the forwarding headers are set.
+type RequestSigning struct {
+	KeysFile        string   `yaml:"keysfile omitempty=false"`
+	Algorithm       string   `yaml:"algorithm omitempty=false"`       // hmac-sha256 (default) or hmac-sha512
+	SignedHeaders   []string `yaml:"signedheaders omitempty=false"`   // e.g. Host, Content-Type
+	SignatureHeader string   `yaml:"signatureheader omitempty=false"` // defaults to X-Proxy-Signature
+	KeyIDHeader     string   `yaml:"keyidheader omitempty=false"`     // defaults to X-Proxy-Key-Id
+	TimestampHeader string   `yaml:"timestampheader omitempty=false"` // defaults to X-Proxy-Timestamp
+	BodyHashHeader  string   `yaml:"bodyhashheader omitempty=false"`  // defaults to X-Proxy-Content-SHA256
+	MaxBodyBytes    int64    `yaml:"maxbodybytes omitempty=false"`    // larger bodies are rejected with 413, defaults to 10 MiB
+}
+
+// signingKeysFile is the format of the keys file.
+// Keys other than the active one are kept so the same file can be shared with verifiers during a rotation.
+type signingKeysFile struct {
+	Active string       `yaml:"active"` // defaults to the first key
+	Keys   []signingKey `yaml:"keys"`
+}
+
+// signingKey is an entry of the keys file.
+type signingKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"` // base64 encoded, at least 32 bytes
+}
+
+// activeSigningKey is the key requests are signed with.
+type activeSigningKey struct {
+	id     string
+	secret []byte
+}
+
+// validateRequestSigning validates the request signing configuration of a target.
+func validateRequestSigning(targetName string, signing *RequestSigning) error {
+	if signing.KeysFile == "" {
+		return fmt.Errorf("signing keysfile is required for target %s", targetName)
+	}
+	switch signing.Algorithm {
+	case "", constants.SigningHMACSHA256, constants.SigningHMACSHA512:
+	default:
+		return fmt.Errorf("invalid signing algorithm %s for target %s", signing.Algorithm, targetName)
+	}
+	if signing.MaxBodyBytes < 0 {
+		return fmt.Errorf("invalid signing maxbodybytes for target %s", targetName)
+	}
+	for _, name := range signing.SignedHeaders {
+		// hop-by-hop headers are removed or set by the transport after signing
+		if slices.ContainsFunc(constants.HopByHopHeaders, func(hop string) bool { return strings.EqualFold(hop, name) }) {
+			return fmt.Errorf("hop-by-hop header %s cannot be signed for target %s", name, targetName)
+		}
+	}
+	return nil
+}
+
+// parseSigningKeys parses the keys file and returns the active key.
+func parseSigningKeys(data []byte) (*activeSigningKey, error) {
+	file := signingKeysFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	active := file.Active
+	if active == "" {
+		active = file.Keys[0].ID
+	}
+	for i, key := range file.Keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("id is required for signing key %d", i+1)
+		}
+		if key.ID != active {
+			continue
+		}
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil || len(secret) < constants.SigningMinKeyBytes {
+			return nil, fmt.Errorf("invalid secret for signing key %s", key.ID)
+		}
+		return &activeSigningKey{id: key.ID, secret: secret}, nil
+	}
+	return nil, fmt.Errorf("active signing key %s not found", active)
+}
+
+// RequestSigner signs upstream requests with the active key.
+type RequestSigner struct {
+	RouteName string
+	Config    *RequestSigning
+
+	keys *reloadableFile[*activeSigningKey]
+	hash func() hash.Hash
+	now  func() time.Time
+}
+
+// NewRequestSigner loads the keys file of the configuration.
+func NewRequestSigner(routeName string, config *RequestSigning) (*RequestSigner, error) {
+	keys, err := newReloadableFile(config.KeysFile, parseSigningKeys)
+	if err != nil {
+		return nil, fmt.Errorf("error loading signing keys file for route %s: %w", routeName, err)
+	}
+	rs := &RequestSigner{RouteName: routeName, Config: config, keys: keys, hash: sha256.New, now: time.Now}
+	if config.Algorithm == constants.SigningHMACSHA512 {
+		rs.hash = sha512.New
+	}
+	return rs, nil
+}
+
+// header returns the configured header name or the default.
+func (rs *RequestSigner) header(configured, fallback string) string {
+	if configured != "" {
+		return configured
+	}
+	return fallback
+}
+
+// readBody reads the request body, which is needed in full before the signature can be sent,
+// and restores it for the upstream.
+func (rs *RequestSigner) readBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	limit := rs.Config.MaxBodyBytes
+	if limit == 0 {
+		limit = constants.SigningMaxBodyBytes
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		return nil, false, nil
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, true, nil
+}
+
+// canonicalRequest returns the string the signature is computed over, one element per line:
+// method, request URI, timestamp, hex body hash and a "name:value" line per signed header.
+func (rs *RequestSigner) canonicalRequest(r *http.Request, timestamp, bodyHash string) string {
+	lines := []string{r.Method, r.URL.RequestURI(), timestamp, bodyHash}
+	for _, name := range rs.Config.SignedHeaders {
+		value := r.Host
+		if !strings.EqualFold(name, "Host") {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		lines = append(lines, strings.ToLower(name)+":"+strings.TrimSpace(value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signingContextKey is the context key of the pending signature of a request.
+type signingContextKey struct{}
+
+// pendingSignature is the signer and body hash of a request to be signed by upstreamTransport.
+type pendingSignature struct {
+	signer   *RequestSigner
+	bodyHash string
+}
+
+// Middleware reads the body of the request for the signature, which is added by upstreamTransport
+// once httputil.ReverseProxy has made its last changes to the request.
+func (rs *RequestSigner) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok, err := rs.readBody(r)
+		if err != nil {
+			if reason := bodyLimitReason(r); reason != "" {
+				rejectBody(w, rs.RouteName, reason)
+				return
+			}
+			log.Warn("Error reading request body", rs.RouteName, err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			rejectBody(w, rs.RouteName, constants.RejectBodyTooLarge)
+			return
+		}
+
+		bodySum := sha256.Sum256(body)
+		pending := &pendingSignature{signer: rs, bodyHash: hex.EncodeToString(bodySum[:])}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signingContextKey{}, pending)))
+	})
+}
+
+// sign sets the signature headers on the request.
+func (rs *RequestSigner) sign(r *http.Request, bodyHash string) {
+	timestamp := strconv.FormatInt(rs.now().Unix(), 10)
+	key := rs.keys.Load()
+
+	mac := hmac.New(rs.hash, key.secret)
+	mac.Write([]byte(rs.canonicalRequest(r, timestamp, bodyHash)))
+
+	r.Header.Set(rs.header(rs.Config.KeyIDHeader, constants.SignatureKeyIDHeader), key.id)
+	r.Header.Set(rs.header(rs.Config.TimestampHeader, constants.SignatureTimestampHeader), timestamp)
+	r.Header.Set(rs.header(rs.Config.BodyHashHeader, constants.SignatureBodyHashHeader), bodyHash)
+	r.Header.Set(rs.header(rs.Config.SignatureHeader, constants.SignatureHeader), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// signRequest signs the request if it was prepared by RequestSigner.Middleware.
+func signRequest(r *http.Request) {
+	if pending, ok := r.Context().Value(signingContextKey{}).(*pendingSignature); ok {
+		pending.signer.sign(r, pending.bodyHash)
+	}
+}
@@ -0,0 +1,189 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigningSecret is a 32 byte secret.
+var testSigningSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// writeSigningKeys writes a keys file with the active key and returns its path.
+func writeSigningKeys(t *testing.T, path, active string) string {
+	data := "active: " + active + "\nkeys:\n" +
+		"  - id: k1\n    secret: " + base64.StdEncoding.EncodeToString(testSigningSecret) + "\n" +
+		"  - id: k2\n    secret: " + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+	return path
+}
+
+// TestRequestSignerMiddleware tests that the upstream can verify the signature and receives the body.
+func TestRequestSignerMiddleware(t *testing.T) {
+	keysFile := writeSigningKeys(t, filepath.Join(t.TempDir(), "signing-keys.yaml"), "k1")
+	signer, err := NewRequestSigner("route1", &RequestSigning{KeysFile: keysFile, SignedHeaders: []string{"Host", "Content-Type"}, MaxBodyBytes: 32})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	signer.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	var upstream *http.Request
+	var upstreamBody string
+	transport := upstreamTransport{RoundTripper: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		upstream = r
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})}
+	handler := signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transport.RoundTrip(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/items?b=2&a=1", strings.NewReader(`{"name":"item"}`))
+	req.Host = "api.example.com"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Proxy-Signature", "forged")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK but got %d", w.Code)
+	}
+	if upstreamBody != `{"name":"item"}` {
+		t.Errorf("Expected the upstream to receive the body but got %q", upstreamBody)
+	}
+
+	bodySum := sha256.Sum256([]byte(`{"name":"item"}`))
+	bodyHash := hex.EncodeToString(bodySum[:])
+	canonical := "POST\n/api/items?b=2&a=1\n1700000000\n" + bodyHash + "\nhost:api.example.com\ncontent-type:application/json"
+	mac := hmac.New(sha256.New, testSigningSecret)
+	mac.Write([]byte(canonical))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if got := upstream.Header.Get("X-Proxy-Signature"); got != want {
+		t.Errorf("Expected signature %q but got %q", want, got)
+	}
+	if upstream.Header.Get("X-Proxy-Key-Id") != "k1" || upstream.Header.Get("X-Proxy-Timestamp") != "1700000000" ||
+		upstream.Header.Get("X-Proxy-Content-SHA256") != bodyHash {
+		t.Errorf("Unexpected signing headers %v", upstream.Header)
+	}
+
+	// bodies above the limit cannot be signed
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 33))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 but got %d", w.Code)
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper calling the function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TestRequestSigningUpstream tests that the upstream can verify the signature of the request it receives,
+// including the target path and the forwarding headers set after the middlewares.
+func TestRequestSigningUpstream(t *testing.T) {
+	verified := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodySum := sha256.Sum256(body)
+		canonical := strings.Join([]string{
+			r.Method, r.RequestURI, r.Header.Get("X-Proxy-Timestamp"), hex.EncodeToString(bodySum[:]),
+			"host:" + r.Host,
+			"x-forwarded-for:" + strings.Join(r.Header.Values("X-Forwarded-For"), ","),
+			"x-forwarded-host:" + r.Header.Get("X-Forwarded-Host"),
+			"x-real-ip:" + r.Header.Get("X-Real-IP"),
+		}, "\n")
+		mac := hmac.New(sha256.New, testSigningSecret)
+		mac.Write([]byte(canonical))
+		signature, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Proxy-Signature"))
+		verified <- hmac.Equal(signature, mac.Sum(nil)) && r.Header.Get("X-Forwarded-For") != ""
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(backendURL.Port())
+
+	keysFile := writeSigningKeys(t, filepath.Join(t.TempDir(), "signing-keys.yaml"), "k1")
+	route := &Route{
+		Name:    "route1",
+		Pattern: "/",
+		Target: Target{Protocol: "http", Host: backendURL.Hostname(), Port: port, Signing: &RequestSigning{
+			KeysFile:      keysFile,
+			SignedHeaders: []string{"Host", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-IP"},
+		}},
+	}
+	proxy, err := NewReverseProxy(context.Background(), route)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/items?a=1", strings.NewReader(`{"name":"item"}`))
+	req.Host = "api.example.com"
+	req.RemoteAddr = "192.0.2.10:51000"
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK but got %d", w.Code)
+	}
+	if !<-verified {
+		t.Errorf("Expected the upstream to verify the signature of the request it received")
+	}
+}
+
+// TestValidateRequestSigning tests that hop-by-hop headers cannot be signed.
+func TestValidateRequestSigning(t *testing.T) {
+	if err := validateRequestSigning("target1", &RequestSigning{KeysFile: "keys.yaml", SignedHeaders: []string{"Host", "X-Forwarded-For"}}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+	if err := validateRequestSigning("target1", &RequestSigning{KeysFile: "keys.yaml", SignedHeaders: []string{"connection"}}); err == nil {
+		t.Errorf("Expected error for a hop-by-hop header")
+	}
+}
+
+// TestParseSigningKeys tests the selection of the active key and the keys file validation.
+func TestParseSigningKeys(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(testSigningSecret)
+	tests := []struct {
+		name    string
+		data    string
+		wantID  string
+		wantErr bool
+	}{
+		{name: "first key by default", data: "keys:\n  - id: a\n    secret: " + secret + "\n  - id: b\n    secret: " + secret + "\n", wantID: "a"},
+		{name: "rotated active key", data: "active: b\nkeys:\n  - id: a\n    secret: " + secret + "\n  - id: b\n    secret: " + secret + "\n", wantID: "b"},
+		{name: "unknown active key", data: "active: c\nkeys:\n  - id: a\n    secret: " + secret + "\n", wantErr: true},
+		{name: "short secret", data: "keys:\n  - id: a\n    secret: " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n", wantErr: true},
+		{name: "missing id", data: "keys:\n  - secret: " + secret + "\n", wantErr: true},
+		{name: "no keys", data: "keys: []\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseSigningKeys([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSigningKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && key.id != tt.wantID {
+				t.Errorf("Expected key %s but got %s", tt.wantID, key.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package reverseproxy
+
+import (
+	"net/http"
+)
+
+// statusRecorder is an http.ResponseWriter that records the status code written by the next handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// newStatusRecorder wraps the ResponseWriter, defaulting the status to 200.
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming responses pass through the recorder.
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// headerWriter is an http.ResponseWriter that lets a middleware modify the response headers,
+// including those copied from the upstream, right before they are written.
+type headerWriter struct {
+	http.ResponseWriter
+	modify      func(header http.Header, status int)
+	wroteHeader bool
+}
+
+// newHeaderWriter wraps the ResponseWriter, calling modify once before the final status is written.
+func newHeaderWriter(w http.ResponseWriter, modify func(header http.Header, status int)) *headerWriter {
+	return &headerWriter{ResponseWriter: w, modify: modify}
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	// informational responses are followed by the final one
+	if !hw.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		hw.wroteHeader = true
+		hw.modify(hw.ResponseWriter.Header(), status)
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(data []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(data)
+}
+
+// Flush lets streaming responses pass through the writer.
+func (hw *headerWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -12,6 +12,8 @@ import (
 	"os"
 	"reverseproxy/internal/constants"
 	"reverseproxy/pkg/logger"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,10 +24,14 @@ var log = logger.NewLogger(os.Stdout, "reverseproxy", constants.LoggingLevel)
 
 // ReverseProxy is a struct that holds a Route and a Proxy. It is used to proxy HTTP requests to a target URL.
 type ReverseProxy struct {
-	Route *Route
-	Proxy *httputil.ReverseProxy
+	Route   *Route
+	Proxy   *httputil.ReverseProxy
+	handler http.Handler // route middlewares wrapping proxyRequest
 }
 
+// Middleware wraps an http.Handler with additional request processing.
+type Middleware func(http.Handler) http.Handler
+
 type ReverseProxyFactory interface {
 	CreateReverseProxy(ctx context.Context, route *Route) (*ReverseProxy, error)
 }
@@ -69,11 +75,15 @@ func (f *ReverseProxyFactoryImpl) CreateReverseProxy(ctx context.Context, route
 	// Setup the reverse proxy
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
+			user := ""
+			if identity, ok := identityFromContext(req.Context()); ok {
+				user = identity.User
+			}
 			req = req.WithContext(ctx)
 			req.URL.Scheme = url.Scheme
 			req.URL.Host = url.Host
 			req.URL.Path = url.Path + req.URL.Path // adds proxy path plus request url path
-			log.Debug("Request proxied to %s%s", req.URL.Host, req.URL.Path)
+			log.Debug("Request proxied", req.URL.Host, req.URL.Path, req.Header.Get(constants.RealIPHeader), user)
 		},
 		// Modify the reverse proxy to add the CORS headers:
 		// ModifyResponse: func(resp *http.Response) error {
@@ -82,8 +92,12 @@ func (f *ReverseProxyFactoryImpl) CreateReverseProxy(ctx context.Context, route
 		// 	resp.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		// 	return nil
 		// },
-		Transport: transport,
+		Transport: upstreamTransport{RoundTripper: transport},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if reason := bodyLimitReason(r); reason != "" {
+				rejectBody(w, route.Name, reason)
+				return
+			}
 			if urlErr != nil {
 				log.Error("Error parsing target url", urlErr)
 				http.Error(w, "Error parsing target url", http.StatusBadGateway)
@@ -102,27 +116,247 @@ func (f *ReverseProxyFactoryImpl) CreateReverseProxy(ctx context.Context, route
 		Proxy: proxy,
 	}
 
+	middlewares, err := routeMiddlewares(route)
+	if err != nil {
+		log.Error("Error creating route middlewares", err, route.Name)
+		return nil, err
+	}
+	reverseProxy.handler = chainMiddlewares(http.HandlerFunc(reverseProxy.proxyRequest), middlewares...)
+
 	return reverseProxy, nil
 }
 
+// routeMiddlewares returns the middlewares configured for the route, outermost first.
+func routeMiddlewares(route *Route) ([]Middleware, error) {
+	middlewares := []Middleware{}
+
+	trust, err := NewProxyTrust(route.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	middlewares = append(middlewares, trust.Middleware)
+
+	if route.SecurityHeaders != nil {
+		policy := NewSecurityHeaderPolicy(route, route.SecurityHeaders)
+		middlewares = append(middlewares, policy.Middleware)
+	}
+
+	// compression wraps the body rewriting and the responses generated by the other middlewares
+	if route.Compression != nil {
+		compressor := NewCompressor(route.Name, route.Compression)
+		middlewares = append(middlewares, compressor.Middleware)
+	}
+
+	if route.IPFilter != nil {
+		matcher, err := NewIPMatcher(route.Name, route.IPFilter)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, matcher.Middleware)
+	}
+
+	// preflight requests carry no credentials, so CORS is handled before authentication
+	if route.CORS == nil {
+		middlewares = append(middlewares, HandleCORS)
+	} else if !route.CORS.Disabled {
+		policy, err := NewCORSPolicy(route.CORS)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, policy.Middleware)
+	}
+
+	// the server read timeout also applies to bodies, so it is answered with 408 as well
+	if route.BodyLimit != nil || (route.Server != nil && route.Server.ReadTimeout > 0) {
+		limit := route.BodyLimit
+		if limit == nil {
+			limit = &BodyLimit{}
+		}
+		limiter := NewBodyLimiter(route.Name, limit)
+		middlewares = append(middlewares, limiter.Middleware)
+	}
+
+	if route.WAF != nil {
+		engine, err := NewWAFEngine(route.Name, route.WAF)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, engine.Middleware)
+	}
+
+	// requests are limited before authentication so that failed attempts count as well;
+	// claims are only known after it, so routes keyed by claim limit failed attempts by client IP
+	if route.RateLimit != nil {
+		limiter := NewRateLimiter(route.Name, route.RateLimit)
+		if route.RateLimit.Key == constants.RateLimitKeyClaim {
+			middlewares = append(middlewares, limiter.AuthFailureMiddleware)
+		} else {
+			middlewares = append(middlewares, limiter.Middleware)
+		}
+	}
+
+	if route.BasicAuth != nil {
+		authenticator, err := NewBasicAuthenticator(route.Name, route.BasicAuth)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, authenticator.Middleware)
+	}
+
+	if route.JWTAuth != nil {
+		authenticator, err := NewJWTAuthenticator(route.Name, route.JWTAuth)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, authenticator.Middleware)
+	}
+
+	if route.OIDC != nil {
+		authenticator, err := NewOIDCAuthenticator(route.Name, route.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, authenticator.Middleware)
+	}
+
+	if route.APIKeyAuth != nil {
+		authenticator, err := NewAPIKeyAuthenticator(route.Name, route.APIKeyAuth)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, authenticator.Middleware)
+	}
+
+	if route.ForwardAuth != nil {
+		authenticator := NewForwardAuthenticator(route.Name, route.ForwardAuth)
+		middlewares = append(middlewares, authenticator.Middleware)
+	}
+
+	if route.RateLimit != nil && route.RateLimit.Key == constants.RateLimitKeyClaim {
+		limiter := NewRateLimiter(route.Name, route.RateLimit)
+		middlewares = append(middlewares, limiter.Middleware)
+	}
+
+	var headerRewriter *HeaderRewriter
+	if route.Headers != nil {
+		headerRewriter, err = NewHeaderRewriter(route.Name, route.Headers)
+		if err != nil {
+			return nil, err
+		}
+		// response rules render per-request values and must not be stored in the cache
+		middlewares = append(middlewares, headerRewriter.ResponseMiddleware)
+	}
+
+	if route.Cache != nil {
+		cache, err := NewHTTPCache(route, route.Cache)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, cache.Middleware)
+	}
+
+	if route.ConcurrencyLimit != nil {
+		limiter := NewConcurrencyLimiter("route", route.Name, route.ConcurrencyLimit)
+		middlewares = append(middlewares, limiter.Middleware)
+	}
+
+	if route.Target.ConcurrencyLimit != nil {
+		limiter := targetConcurrencyLimiter(route.Target)
+		middlewares = append(middlewares, limiter.Middleware)
+	}
+
+	if route.Target.AdaptiveConcurrency != nil {
+		limiter := targetAdaptiveLimiter(route.Target)
+		middlewares = append(middlewares, limiter.Middleware)
+	}
+
+	if route.Target.Credentials != nil {
+		injector, err := NewCredentialInjector(route.Name, route.Target.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, injector.Middleware)
+	}
+
+	if headerRewriter != nil {
+		middlewares = append(middlewares, headerRewriter.RequestMiddleware)
+	}
+
+	if route.BodyRewrite != nil {
+		rewriter, err := NewBodyRewriter(route.Name, route.BodyRewrite)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, rewriter.Middleware)
+	}
+
+	if route.RedirectRewrite != nil {
+		rewriter := NewRedirectRewriter(route, route.RedirectRewrite)
+		middlewares = append(middlewares, rewriter.Middleware)
+	}
+
+	// the signer reads the body as modified by the other middlewares; the signature is added by upstreamTransport
+	if route.Target.Signing != nil {
+		signer, err := NewRequestSigner(route.Name, route.Target.Signing)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, signer.Middleware)
+	}
+
+	return middlewares, nil
+}
+
+// chainMiddlewares wraps the handler with the middlewares so that the first middleware runs first.
+func chainMiddlewares(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
 // ServeHTTP is the HTTP handler for the ReverseProxy.
-// It sets the "X-Forwarded-Host" header on the incoming request and then passes the request to the underlying ReverseProxy's ServeHTTP method.
+// It runs the route middlewares before the request is proxied to the target.
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.handler == nil {
+		p.proxyRequest(w, r)
+		return
+	}
+	p.handler.ServeHTTP(w, r)
+}
 
-	// // Set the X-Forwarded-Host header on the incoming request
-	if p.Route.Protocol == "https" {
-		r.Header.Set(constants.ForwardedProtoHeader, "https")
-	} else {
-		r.Header.Set(constants.ForwardedProtoHeader, "http")
+// proxyRequest sets the "X-Forwarded-*" headers on the incoming request and then passes the request to the underlying ReverseProxy's ServeHTTP method.
+func (p *ReverseProxy) proxyRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Headers from a trusted proxy describe the original request and are kept as they are.
+	// X-Forwarded-For is appended with the peer address by httputil.ReverseProxy.
+	trusted := peerTrusted(r)
+	setForwardedHeader(r, trusted, constants.ForwardedProtoHeader, p.Route.Protocol)
+	setForwardedHeader(r, trusted, constants.ForwardedHostHeader, r.Host)
+	setForwardedHeader(r, trusted, constants.ForwardedPortHeader, forwardedPort(r, p.Route))
+	setForwardedHeader(r, trusted, constants.ForwardedMethodHeader, r.Method)
+	setForwardedHeader(r, trusted, constants.ForwardedPathHeader, r.URL.Path)
+	setForwardedHeader(r, trusted, constants.ForwardedQueryHeader, r.URL.RawQuery)
+	setForwardedHeader(r, trusted, constants.ForwardedURIHeader, r.URL.RequestURI())
+	r.Header.Set(constants.RealIPHeader, clientIP(r))
+	if !trusted {
+		r.Header.Del(constants.ForwardedForHeader)
+		r.Header.Del(constants.ForwardedHeader)
 	}
 
-	// Set the X-Forwarded-Host header on the incoming request
-	r.Header.Set(constants.ForwardedHostHeader, r.Host)
-	r.Header.Set(constants.ForwardedForHeader, r.RemoteAddr)
-	r.Header.Set(constants.ForwardedMethodHeader, r.Method)
-	r.Header.Set(constants.ForwardedPathHeader, r.URL.Path)
-	r.Header.Set(constants.ForwardedQueryHeader, r.URL.RawQuery)
-	r.Header.Set(constants.ForwardedPortHeader, r.URL.Port())
+	switch forwardedStyle(p.Route) {
+	case constants.ForwardedStyleStandard:
+		setForwarded(r, p.Route, trusted)
+		for _, header := range forwardedHeaders {
+			if strings.HasPrefix(header, "X-Forwarded-") {
+				r.Header.Del(header)
+			}
+		}
+		// a nil value stops httputil.ReverseProxy from adding X-Forwarded-For
+		r.Header[constants.ForwardedForHeader] = nil
+	case constants.ForwardedStyleBoth:
+		setForwarded(r, p.Route, trusted)
+	}
 
 	// Prometheus metrics
 	constants.ProxiedRequestsTotal.Inc()
@@ -132,6 +366,42 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.Proxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// upstreamTransport finishes requests once httputil.ReverseProxy has set its headers: it applies the
+// request header rules and then signs the request, so the signature covers the request as sent.
+type upstreamTransport struct {
+	http.RoundTripper
+}
+
+func (ut upstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	applyRequestHeaderRules(r)
+	signRequest(r)
+	return ut.RoundTripper.RoundTrip(r)
+}
+
+// setForwardedHeader sets a forwarding header unless a trusted proxy already set it.
+func setForwardedHeader(r *http.Request, trusted bool, header, value string) {
+	if trusted && r.Header.Get(header) != "" {
+		return
+	}
+	if value == "" {
+		r.Header.Del(header)
+		return
+	}
+	r.Header.Set(header, value)
+}
+
+// forwardedPort returns the port the client connected to, taken from the Host header or the route listen port.
+func forwardedPort(r *http.Request, route *Route) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if route.ListenPort > 0 {
+		return strconv.Itoa(route.ListenPort)
+	}
+	return ""
+}
+
 // NewServeMux creates a new HTTP request multiplexer (ServeMux) that will route incoming requests to the provided handler.
 // The mux is configured to handle all requests to the root path ("/") and forward them to the provided handler.
 func (p *ReverseProxy) NewServeMux(ctx context.Context, route *Route, handler http.Handler) (*http.ServeMux, error) {
@@ -142,19 +412,10 @@ func (p *ReverseProxy) NewServeMux(ctx context.Context, route *Route, handler ht
 }
 
 // HandleCORS is a middleware function that adds CORS headers to the response.
+// It applies the default policy allowing any origin, used by routes without a CORS configuration.
 func HandleCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set(constants.CORSAllowHeadersHeader, constants.CORSHeaders)
-		w.Header().Set(constants.CORSAllowMethodsHeader, constants.CORSMethods)
-		w.Header().Set(constants.CORSAllowOriginHeader, constants.CORSAllowOrigin)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
-
-	})
-
+	policy, _ := NewCORSPolicy(defaultCORS)
+	return policy.Middleware(next)
 }
 
 // getTlsTransport returns a TLS configuration for the provided target. // TODO move this to the target struct
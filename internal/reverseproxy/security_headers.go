@@ -0,0 +1,124 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"time"
+)
+
+// SecurityHeaders configures the security headers the proxy enforces on the responses of a route.
+// Mode "add" (default) only sets headers the upstream did not send, "override" always replaces them.
+// RemoveHeaders are deleted from every response and default to "Server" and "X-Powered-By".
+type SecurityHeaders struct {
+	Mode                  string   `yaml:"mode omitempty=false"`
+	HSTS                  *HSTS    `yaml:"hsts omitempty=false"` // only sent on HTTPS routes
+	ContentSecurityPolicy string   `yaml:"contentsecuritypolicy omitempty=false"`
+	FrameOptions          string   `yaml:"frameoptions omitempty=false"`       // e.g. DENY or SAMEORIGIN
+	ContentTypeOptions    string   `yaml:"contenttypeoptions omitempty=false"` // e.g. nosniff
+	ReferrerPolicy        string   `yaml:"referrerpolicy omitempty=false"`
+	PermissionsPolicy     string   `yaml:"permissionspolicy omitempty=false"`
+	RemoveHeaders         []string `yaml:"removeheaders omitempty=false"`
+}
+
+// HSTS configures the Strict-Transport-Security header.
+type HSTS struct {
+	MaxAge            time.Duration `yaml:"maxage omitempty=false"`
+	IncludeSubdomains bool          `yaml:"includesubdomains omitempty=false"`
+	Preload           bool          `yaml:"preload omitempty=false"`
+}
+
+// validateSecurityHeaders validates the security headers configuration of a route.
+// Preloading follows the requirements of the HSTS preload list.
+func validateSecurityHeaders(route Route, headers *SecurityHeaders) error {
+	switch headers.Mode {
+	case "", constants.SecurityModeAdd, constants.SecurityModeOverride:
+	default:
+		return fmt.Errorf("invalid securityheaders mode %s for route %s", headers.Mode, route.Name)
+	}
+
+	if hsts := headers.HSTS; hsts != nil {
+		if route.Protocol != "https" {
+			return fmt.Errorf("securityheaders hsts requires an https route for route %s", route.Name)
+		}
+		if hsts.MaxAge <= 0 {
+			return fmt.Errorf("invalid securityheaders hsts maxage for route %s", route.Name)
+		}
+		if hsts.Preload && (hsts.MaxAge < constants.HSTSPreloadMinMaxAge || !hsts.IncludeSubdomains) {
+			return fmt.Errorf("securityheaders hsts preload requires includesubdomains and a maxage of at least one year for route %s", route.Name)
+		}
+	}
+	return nil
+}
+
+// SecurityHeaderPolicy sets the security headers of a route on responses.
+type SecurityHeaderPolicy struct {
+	RouteName string
+	Config    *SecurityHeaders
+
+	headers  http.Header
+	override bool
+	remove   []string
+}
+
+// NewSecurityHeaderPolicy builds the header values of the configuration.
+func NewSecurityHeaderPolicy(route *Route, config *SecurityHeaders) *SecurityHeaderPolicy {
+	policy := &SecurityHeaderPolicy{
+		RouteName: route.Name,
+		Config:    config,
+		headers:   http.Header{},
+		override:  config.Mode == constants.SecurityModeOverride,
+		remove:    config.RemoveHeaders,
+	}
+	if len(policy.remove) == 0 {
+		policy.remove = constants.LeakyResponseHeaders
+	}
+
+	if hsts := config.HSTS; hsts != nil && route.Protocol == "https" {
+		value := "max-age=" + strconv.Itoa(int(hsts.MaxAge.Seconds()))
+		if hsts.IncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		if hsts.Preload {
+			value += "; preload"
+		}
+		policy.headers.Set(constants.HSTSHeader, value)
+	}
+
+	values := map[string]string{
+		constants.CSPHeader:                config.ContentSecurityPolicy,
+		constants.FrameOptionsHeader:       config.FrameOptions,
+		constants.ContentTypeOptionsHeader: config.ContentTypeOptions,
+		constants.ReferrerPolicyHeader:     config.ReferrerPolicy,
+		constants.PermissionsPolicyHeader:  config.PermissionsPolicy,
+	}
+	for header, value := range values {
+		if value != "" {
+			policy.headers.Set(header, value)
+		}
+	}
+	return policy
+}
+
+// apply removes the leaky headers and sets the security headers according to the mode.
+func (sp *SecurityHeaderPolicy) apply(header http.Header) {
+	for _, name := range sp.remove {
+		header.Del(name)
+	}
+	for name, values := range sp.headers {
+		if !sp.override && header.Get(name) != "" {
+			continue
+		}
+		header[name] = values
+	}
+}
+
+// Middleware applies the policy to every response of the route, including those generated by the proxy.
+func (sp *SecurityHeaderPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(newHeaderWriter(w, func(header http.Header, status int) {
+			sp.apply(header)
+		}), r)
+	})
+}
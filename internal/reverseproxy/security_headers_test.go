@@ -0,0 +1,97 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSecurityHeaderPolicyMiddleware tests the add and override modes and the removal of leaky headers.
+func TestSecurityHeaderPolicyMiddleware(t *testing.T) {
+	config := &SecurityHeaders{
+		HSTS:                  &HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubdomains: true, Preload: true},
+		ContentSecurityPolicy: "default-src 'self'",
+		FrameOptions:          "DENY",
+		ContentTypeOptions:    "nosniff",
+		ReferrerPolicy:        "no-referrer",
+		PermissionsPolicy:     "camera=()",
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.25.3")
+		w.Header().Set("X-Powered-By", "PHP/8.2")
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		name      string
+		mode      string
+		protocol  string
+		wantFrame string
+		wantHSTS  string
+	}{
+		{name: "add keeps upstream values", mode: "add", protocol: "https", wantFrame: "SAMEORIGIN", wantHSTS: "max-age=31536000; includeSubDomains; preload"},
+		{name: "override replaces upstream values", mode: "override", protocol: "https", wantFrame: "DENY", wantHSTS: "max-age=31536000; includeSubDomains; preload"},
+		{name: "no HSTS over http", protocol: "http", wantFrame: "SAMEORIGIN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := *config
+			cfg.Mode = tt.mode
+			policy := NewSecurityHeaderPolicy(&Route{Name: "route1", Protocol: tt.protocol}, &cfg)
+			w := httptest.NewRecorder()
+			policy.Middleware(upstream).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := w.Header().Get("X-Frame-Options"); got != tt.wantFrame {
+				t.Errorf("Expected X-Frame-Options %q but got %q", tt.wantFrame, got)
+			}
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.wantHSTS {
+				t.Errorf("Expected Strict-Transport-Security %q but got %q", tt.wantHSTS, got)
+			}
+			if w.Header().Get("Content-Security-Policy") != "default-src 'self'" || w.Header().Get("X-Content-Type-Options") != "nosniff" ||
+				w.Header().Get("Referrer-Policy") != "no-referrer" || w.Header().Get("Permissions-Policy") != "camera=()" {
+				t.Errorf("Unexpected security headers %v", w.Header())
+			}
+			if w.Header().Get("Server") != "" || w.Header().Get("X-Powered-By") != "" {
+				t.Errorf("Expected leaky headers to be removed but got %v", w.Header())
+			}
+		})
+	}
+
+	// responses generated by the proxy get the headers too
+	policy := NewSecurityHeaderPolicy(&Route{Name: "route1", Protocol: "https"}, config)
+	w := httptest.NewRecorder()
+	policy.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Expected security headers on error responses but got %v", w.Header())
+	}
+}
+
+// TestValidateSecurityHeaders tests the security headers configuration validation.
+func TestValidateSecurityHeaders(t *testing.T) {
+	https := Route{Name: "route1", Protocol: "https"}
+	tests := []struct {
+		name    string
+		route   Route
+		headers *SecurityHeaders
+		wantErr bool
+	}{
+		{name: "valid", route: https, headers: &SecurityHeaders{Mode: "override", HSTS: &HSTS{MaxAge: time.Hour}}},
+		{name: "invalid mode", route: https, headers: &SecurityHeaders{Mode: "replace"}, wantErr: true},
+		{name: "hsts on http", route: Route{Name: "route1", Protocol: "http"}, headers: &SecurityHeaders{HSTS: &HSTS{MaxAge: time.Hour}}, wantErr: true},
+		{name: "preload too short", route: https, headers: &SecurityHeaders{HSTS: &HSTS{MaxAge: time.Hour, IncludeSubdomains: true, Preload: true}}, wantErr: true},
+		{name: "preload without subdomains", route: https, headers: &SecurityHeaders{HSTS: &HSTS{MaxAge: 2 * 365 * 24 * time.Hour, Preload: true}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSecurityHeaders(tt.route, tt.headers); (err != nil) != tt.wantErr {
+				t.Errorf("validateSecurityHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reverseproxy/internal/constants"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server configures the listener of a route to protect it from slow and oversized requests.
+// ReadHeaderTimeout and IdleTimeout default to constants.ServerReadHeaderTimeout and constants.ServerIdleTimeout;
+// the other timeouts are disabled when zero. MaxHeaderBytes defaults to http.DefaultMaxHeaderBytes.
+type Server struct {
+	ReadTimeout       time.Duration `yaml:"readtimeout omitempty=false"`
+	ReadHeaderTimeout time.Duration `yaml:"readheadertimeout omitempty=false"`
+	WriteTimeout      time.Duration `yaml:"writetimeout omitempty=false"`
+	IdleTimeout       time.Duration `yaml:"idletimeout omitempty=false"`
+	MaxHeaderBytes    int           `yaml:"maxheaderbytes omitempty=false"`
+}
+
+// BodyLimit configures the request body limits of a route.
+// Bodies over MaxBytes are rejected with 413 and bodies not received within ReadTimeout with 408.
+type BodyLimit struct {
+	MaxBytes    int64         `yaml:"maxbytes omitempty=false"`
+	ReadTimeout time.Duration `yaml:"readtimeout omitempty=false"`
+}
+
+// validateServer validates the listener configuration of a route.
+func validateServer(routeName string, server *Server) error {
+	if server.ReadTimeout < 0 || server.ReadHeaderTimeout < 0 || server.WriteTimeout < 0 || server.IdleTimeout < 0 {
+		return fmt.Errorf("invalid server timeout for route %s", routeName)
+	}
+	if server.MaxHeaderBytes < 0 {
+		return fmt.Errorf("invalid server maxheaderbytes for route %s", routeName)
+	}
+	return nil
+}
+
+// validateBodyLimit validates the body limit configuration of a route.
+func validateBodyLimit(routeName string, limit *BodyLimit) error {
+	if limit.MaxBytes < 0 {
+		return fmt.Errorf("invalid bodylimit maxbytes for route %s", routeName)
+	}
+	if limit.ReadTimeout < 0 {
+		return fmt.Errorf("invalid bodylimit readtimeout for route %s", routeName)
+	}
+	return nil
+}
+
+// NewHTTPServer creates the http.Server of the route listener with the configured timeouts.
+// Connections closed before a complete request header arrived, e.g. by the header timeout
+// or the header size limit, are counted as rejections.
+func NewHTTPServer(route *Route, handler http.Handler) *http.Server {
+	config := route.Server
+	if config == nil {
+		config = &Server{}
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", route.ListenHost, route.ListenPort),
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	if server.ReadHeaderTimeout == 0 {
+		server.ReadHeaderTimeout = constants.ServerReadHeaderTimeout
+	}
+	if server.IdleTimeout == 0 {
+		server.IdleTimeout = constants.ServerIdleTimeout
+	}
+
+	// conns tracks whether each connection sent any bytes and whether a request reached the handler
+	var conns sync.Map
+	server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		state := &connState{}
+		conns.Store(conn, state)
+		return context.WithValue(ctx, connStateContextKey{}, state)
+	}
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		value, ok := conns.Load(conn)
+		if !ok {
+			return
+		}
+		cs := value.(*connState)
+		switch state {
+		case http.StateActive:
+			cs.active.Store(true)
+		case http.StateClosed, http.StateHijacked:
+			conns.Delete(conn)
+			if state == http.StateClosed && cs.active.Load() && !cs.served.Load() {
+				constants.RequestRejectedTotal.WithLabelValues(route.Name, constants.RejectIncompleteHeader).Inc()
+			}
+		}
+	}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cs, ok := r.Context().Value(connStateContextKey{}).(*connState); ok {
+			cs.served.Store(true)
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	return server
+}
+
+// connStateContextKey is the context key of the connState of a connection.
+type connStateContextKey struct{}
+
+// connState records the progress of a listener connection.
+type connState struct {
+	active atomic.Bool // bytes were read from the connection
+	served atomic.Bool // a complete request header was read
+}
+
+// bodyLimitContextKey is the context key of the bodyLimitState of a request.
+type bodyLimitContextKey struct{}
+
+// bodyLimitState records why reading the request body failed.
+type bodyLimitState struct {
+	mu     sync.Mutex
+	reason string
+}
+
+// bodyLimitReader classifies errors reading the request body.
+type bodyLimitReader struct {
+	io.ReadCloser
+	state *bodyLimitState
+}
+
+func (br *bodyLimitReader) Read(p []byte) (int, error) {
+	n, err := br.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		var maxBytesErr *http.MaxBytesError
+		br.state.mu.Lock()
+		switch {
+		case errors.As(err, &maxBytesErr):
+			br.state.reason = constants.RejectBodyTooLarge
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			br.state.reason = constants.RejectBodyTimeout
+		}
+		br.state.mu.Unlock()
+	}
+	return n, err
+}
+
+// BodyLimiter enforces the body limit of a route.
+type BodyLimiter struct {
+	RouteName string
+	Config    *BodyLimit
+}
+
+// NewBodyLimiter creates a BodyLimiter for the route.
+func NewBodyLimiter(routeName string, config *BodyLimit) *BodyLimiter {
+	return &BodyLimiter{RouteName: routeName, Config: config}
+}
+
+// Middleware rejects requests declaring a body over the limit with 413 and limits how much
+// and how long the body is read. Failures while proxying are answered via bodyLimitReason.
+func (bl *BodyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bl.Config.MaxBytes > 0 && r.ContentLength > bl.Config.MaxBytes {
+			rejectBody(w, bl.RouteName, constants.RejectBodyTooLarge)
+			return
+		}
+
+		if bl.Config.ReadTimeout > 0 {
+			if err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(bl.Config.ReadTimeout)); err != nil {
+				log.Warn("Error setting body read deadline", bl.RouteName, err)
+			}
+		}
+
+		state := &bodyLimitState{}
+		if r.Body != nil && r.Body != http.NoBody {
+			body := r.Body
+			if bl.Config.MaxBytes > 0 {
+				body = http.MaxBytesReader(w, body, bl.Config.MaxBytes)
+			}
+			r.Body = &bodyLimitReader{ReadCloser: body, state: state}
+		}
+
+		ctx := context.WithValue(r.Context(), bodyLimitContextKey{}, state)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bodyLimitReason returns why the request body could not be read because of a limit, if it was.
+func bodyLimitReason(r *http.Request) string {
+	state, ok := r.Context().Value(bodyLimitContextKey{}).(*bodyLimitState)
+	if !ok {
+		return ""
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.reason
+}
+
+// rejectBody counts the rejection and writes 413 or 408 for the reason.
+func rejectBody(w http.ResponseWriter, routeName, reason string) {
+	status := http.StatusRequestEntityTooLarge
+	if reason == constants.RejectBodyTimeout {
+		status = http.StatusRequestTimeout
+	}
+	constants.RequestRejectedTotal.WithLabelValues(routeName, reason).Inc()
+	log.Warn("Request body rejected", routeName, reason)
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(status), status)
+}
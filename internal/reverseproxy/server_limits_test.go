@@ -0,0 +1,153 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reverseproxy/internal/constants"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newBodyLimitProxy starts a proxy for the route in front of an upstream reading the whole body.
+func newBodyLimitProxy(t *testing.T, route *Route) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	route.Protocol = "http"
+	route.Target = Target{Name: "upstream", Protocol: "http", Host: upstreamURL.Hostname()}
+	route.Target.Port, _ = strconv.Atoi(upstreamURL.Port())
+
+	proxy, err := NewReverseProxy(context.Background(), route)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewUnstartedServer(proxy)
+	server.Config = NewHTTPServer(route, proxy)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestBodyLimiterMaxBytes tests that declared and streamed bodies over the limit are rejected with 413.
+func TestBodyLimiterMaxBytes(t *testing.T) {
+	route := &Route{Name: "upload", BodyLimit: &BodyLimit{MaxBytes: 1024}}
+	server := newBodyLimitProxy(t, route)
+
+	tests := []struct {
+		name     string
+		body     io.Reader
+		length   int64
+		wantCode int
+	}{
+		{name: "within limit", body: strings.NewReader(strings.Repeat("a", 1024)), length: 1024, wantCode: http.StatusOK},
+		{name: "declared over limit", body: strings.NewReader(strings.Repeat("a", 2048)), length: 2048, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "streamed over limit", body: io.MultiReader(strings.NewReader(strings.Repeat("a", 64<<10))), length: -1, wantCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(constants.RequestRejectedTotal.WithLabelValues("upload", constants.RejectBodyTooLarge))
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/", tt.body)
+			req.ContentLength = tt.length
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, resp.StatusCode)
+			}
+			after := testutil.ToFloat64(constants.RequestRejectedTotal.WithLabelValues("upload", constants.RejectBodyTooLarge))
+			if wantRejected := tt.wantCode != http.StatusOK; (after > before) != wantRejected {
+				t.Errorf("Expected rejection counted %v but counter went from %v to %v", wantRejected, before, after)
+			}
+		})
+	}
+}
+
+// TestBodyLimiterReadTimeout tests that a client stalling while sending the body gets 408.
+func TestBodyLimiterReadTimeout(t *testing.T) {
+	route := &Route{Name: "slow-upload", BodyLimit: &BodyLimit{ReadTimeout: 200 * time.Millisecond}}
+	server := newBodyLimitProxy(t, route)
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// announce a body and only send part of it
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\npartial")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Expected status 408 but got %d", resp.StatusCode)
+	}
+}
+
+// TestNewHTTPServer tests the listener defaults and the count of connections without a complete header.
+func TestNewHTTPServer(t *testing.T) {
+	route := &Route{Name: "slowloris", ListenHost: "localhost", ListenPort: 8080, Server: &Server{ReadHeaderTimeout: 100 * time.Millisecond, MaxHeaderBytes: 4096}}
+	server := NewHTTPServer(route, http.NotFoundHandler())
+	if server.Addr != "localhost:8080" || server.IdleTimeout != constants.ServerIdleTimeout || server.MaxHeaderBytes != 4096 {
+		t.Errorf("Unexpected server settings addr %s idle %v max header %d", server.Addr, server.IdleTimeout, server.MaxHeaderBytes)
+	}
+	if server := NewHTTPServer(&Route{}, http.NotFoundHandler()); server.ReadHeaderTimeout != constants.ServerReadHeaderTimeout {
+		t.Errorf("Expected default read header timeout but got %v", server.ReadHeaderTimeout)
+	}
+
+	ts := httptest.NewUnstartedServer(server.Handler)
+	ts.Config = server
+	ts.Start()
+	defer ts.Close()
+
+	before := testutil.ToFloat64(constants.RequestRejectedTotal.WithLabelValues("slowloris", constants.RejectIncompleteHeader))
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: exa")
+
+	// the server closes the connection after the header timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(constants.RequestRejectedTotal.WithLabelValues("slowloris", constants.RejectIncompleteHeader)) == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the incomplete header to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestValidateBodyLimit tests the listener and body limit configuration validation.
+func TestValidateBodyLimit(t *testing.T) {
+	if err := validateBodyLimit("route1", &BodyLimit{MaxBytes: -1}); err == nil {
+		t.Errorf("Expected error for negative maxbytes")
+	}
+	if err := validateServer("route1", &Server{ReadTimeout: -time.Second}); err == nil {
+		t.Errorf("Expected error for a negative timeout")
+	}
+	if err := validateBodyLimit("route1", &BodyLimit{MaxBytes: 1 << 20, ReadTimeout: time.Minute}); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+}
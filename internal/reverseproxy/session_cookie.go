@@ -0,0 +1,70 @@
+package reverseproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// cookieCipher encrypts and authenticates cookie values with AES-256-GCM.
+type cookieCipher struct {
+	aead cipher.AEAD
+}
+
+// newCookieCipher derives the encryption key from the secret.
+func newCookieCipher(secret []byte) (*cookieCipher, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCipher{aead: aead}, nil
+}
+
+// Seal encodes the value as JSON and encrypts it bound to the cookie name.
+func (c *cookieCipher) Seal(name string, value any) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed for the cookie name into value.
+func (c *cookieCipher) Open(name, sealed string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return errInvalidCookie
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errInvalidCookie
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+// randomString returns a URL safe random string of n random bytes.
+func randomString(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,152 @@
+package reverseproxy
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SHA-512 crypt parameters as defined by https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSaltLength = 16
+	cryptAlphabet            = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errInvalidSHA512Crypt = errors.New("invalid SHA-512 crypt hash")
+
+// compareSHA512Crypt reports whether the password matches a "$6$" crypt(3) hash.
+func compareSHA512Crypt(hash, password string) (bool, error) {
+	computed, err := sha512Crypt(password, hash)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
+
+// sha512Crypt hashes the password with the salt and rounds of the setting, e.g. "$6$rounds=10000$salt".
+func sha512Crypt(password, setting string) (string, error) {
+	rest, ok := strings.CutPrefix(setting, sha512CryptPrefix)
+	if !ok {
+		return "", errInvalidSHA512Crypt
+	}
+
+	rounds, customRounds := sha512CryptDefaultRounds, false
+	if value, after, ok := strings.Cut(rest, "$"); ok && strings.HasPrefix(value, sha512CryptRoundsPrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(value, sha512CryptRoundsPrefix))
+		if err != nil {
+			return "", errInvalidSHA512Crypt
+		}
+		rounds = min(max(n, sha512CryptMinRounds), sha512CryptMaxRounds)
+		customRounds = true
+		rest = after
+	}
+
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > sha512CryptMaxSaltLength {
+		salt = salt[:sha512CryptMaxSaltLength]
+	}
+
+	key, saltBytes := []byte(password), []byte(salt)
+
+	// digest B
+	b := sha512.New()
+	b.Write(key)
+	b.Write(saltBytes)
+	b.Write(key)
+	digestB := b.Sum(nil)
+
+	// digest A
+	a := sha512.New()
+	a.Write(key)
+	a.Write(saltBytes)
+	a.Write(repeatBytes(digestB, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(key)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	// sequence P from digest DP
+	dp := sha512.New()
+	for i := 0; i < len(key); i++ {
+		dp.Write(key)
+	}
+	p := repeatBytes(dp.Sum(nil), len(key))
+
+	// sequence S from digest DS
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(saltBytes)
+	}
+	s := repeatBytes(ds.Sum(nil), len(saltBytes))
+
+	digest := digestA
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i%2 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i%2 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+		digest = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix)
+	if customRounds {
+		out.WriteString(sha512CryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+
+	// the final digest bytes are encoded in this permuted order
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	}
+	for _, group := range order {
+		encodeCrypt64(&out, uint(digest[group[0]])<<16|uint(digest[group[1]])<<8|uint(digest[group[2]]), 4)
+	}
+	encodeCrypt64(&out, uint(digest[63]), 2)
+
+	return out.String(), nil
+}
+
+// repeatBytes returns the sequence repeated to the given length.
+func repeatBytes(sequence []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		out = append(out, sequence[:min(len(sequence), length-len(out))]...)
+	}
+	return out
+}
+
+// encodeCrypt64 writes n characters of the crypt base64 encoding of the value, least significant first.
+func encodeCrypt64(out *strings.Builder, value uint, n int) {
+	for i := 0; i < n; i++ {
+		out.WriteByte(cryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
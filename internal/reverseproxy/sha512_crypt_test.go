@@ -0,0 +1,47 @@
+package reverseproxy
+
+import "testing"
+
+// TestSHA512Crypt tests the SHA-512 crypt implementation against the reference test vectors.
+func TestSHA512Crypt(t *testing.T) {
+	tests := []struct {
+		setting  string
+		password string
+		want     string
+	}{
+		{
+			setting:  "$6$saltstring",
+			password: "Hello world!",
+			want:     "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			setting:  "$6$rounds=10000$saltstringsaltstring",
+			password: "Hello world!",
+			want:     "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			setting:  "$6$rounds=10$roundstoolow",
+			password: "the minimum number is still observed",
+			want:     "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			got, err := sha512Crypt(tt.password, tt.setting)
+			if err != nil {
+				t.Fatalf("sha512Crypt() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sha512Crypt() = %s, want %s", got, tt.want)
+			}
+			if ok, _ := compareSHA512Crypt(tt.want, tt.password); !ok {
+				t.Errorf("compareSHA512Crypt() did not match")
+			}
+		})
+	}
+
+	if _, err := sha512Crypt("password", "$5$salt"); err == nil {
+		t.Errorf("Expected error for non SHA-512 setting")
+	}
+}
@@ -0,0 +1,157 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"reverseproxy/internal/constants"
+	"strings"
+)
+
+// forwardedHeaders are the client supplied forwarding headers that are only honoured from trusted proxies.
+var forwardedHeaders = []string{
+	constants.ForwardedForHeader,
+	constants.ForwardedHostHeader,
+	constants.ForwardedProtoHeader,
+	constants.ForwardedURIHeader,
+	constants.ForwardedMethodHeader,
+	constants.ForwardedPathHeader,
+	constants.ForwardedQueryHeader,
+	constants.ForwardedPortHeader,
+	constants.RealIPHeader,
+	constants.ForwardedHeader,
+}
+
+// clientContextKey is the context key of the clientInfo resolved for a request.
+type clientContextKey struct{}
+
+// clientInfo is the client address resolved once per request.
+type clientInfo struct {
+	IP          string // real client IP after trusted proxy processing
+	PeerTrusted bool   // whether the directly connected peer is a trusted proxy
+}
+
+// ProxyTrust resolves the real client IP of requests using a list of trusted proxy CIDRs.
+type ProxyTrust struct {
+	prefixes []netip.Prefix
+}
+
+// validateTrustedProxies validates the trusted proxy CIDRs of a route.
+func validateTrustedProxies(routeName string, cidrs []string) error {
+	if _, err := parsePrefixes(cidrs); err != nil {
+		return fmt.Errorf("invalid trustedproxies for route %s: %w", routeName, err)
+	}
+	return nil
+}
+
+// NewProxyTrust parses the trusted proxy CIDRs. An empty list trusts no peer.
+func NewProxyTrust(cidrs []string) (*ProxyTrust, error) {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyTrust{prefixes: prefixes}, nil
+}
+
+// Trusted reports whether the IP belongs to a trusted proxy.
+func (pt *ProxyTrust) Trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	_, ok := matchPrefix(pt.prefixes, addr.Unmap())
+	return ok
+}
+
+// Resolve returns the client of the request.
+// When the peer is trusted the X-Forwarded-For chain, or the Forwarded chain when there is none,
+// is walked from the right, skipping trusted proxies, and the first untrusted address is the client.
+func (pt *ProxyTrust) Resolve(r *http.Request) clientInfo {
+	peer := remoteIP(r)
+	if !pt.Trusted(peer) {
+		return clientInfo{IP: peer}
+	}
+
+	client := peer
+	hops := forwardedForChain(r.Header)
+	if len(hops) == 0 {
+		hops = forwardedChain(r.Header)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(hops[i]); err != nil {
+			break
+		}
+		client = hops[i]
+		if !pt.Trusted(hops[i]) {
+			break
+		}
+	}
+
+	return clientInfo{IP: client, PeerTrusted: true}
+}
+
+// Middleware resolves the client once per request and strips forwarding headers sent by untrusted peers.
+func (pt *ProxyTrust) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := pt.Resolve(r)
+		if !client.PeerTrusted {
+			for _, header := range forwardedHeaders {
+				if r.Header.Get(header) != "" {
+					log.Debug("Stripping forwarding header from untrusted peer", header, client.IP)
+				}
+				r.Header.Del(header)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), clientContextKey{}, client)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forwardedForChain returns the addresses of all X-Forwarded-For headers in order, without ports.
+func forwardedForChain(header http.Header) []string {
+	hops := []string{}
+	for _, value := range header.Values(constants.ForwardedForHeader) {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop == "" {
+				continue
+			}
+			if ip, ok := forwardedNodeIP(hop); ok {
+				hop = ip
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// clientFromContext returns the client resolved by ProxyTrust.Middleware.
+func clientFromContext(ctx context.Context) (clientInfo, bool) {
+	client, ok := ctx.Value(clientContextKey{}).(clientInfo)
+	return client, ok
+}
+
+// clientIP returns the real client IP of the request, falling back to the peer address.
+func clientIP(r *http.Request) string {
+	if client, ok := clientFromContext(r.Context()); ok {
+		return client.IP
+	}
+	return remoteIP(r)
+}
+
+// peerTrusted reports whether the directly connected peer of the request is a trusted proxy.
+func peerTrusted(r *http.Request) bool {
+	client, ok := clientFromContext(r.Context())
+	return ok && client.PeerTrusted
+}
+
+// remoteIP returns the IP address of the directly connected peer without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,115 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestProxyTrustResolve tests client IP resolution through trusted and untrusted peers.
+func TestProxyTrustResolve(t *testing.T) {
+	trust, err := NewProxyTrust([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("Failed to create proxy trust: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		wantIP       string
+		wantTrusted  bool
+	}{
+		{name: "untrusted peer ignores header", remoteAddr: "203.0.113.5:1234", forwardedFor: []string{"1.2.3.4"}, wantIP: "203.0.113.5"},
+		{name: "trusted peer without header", remoteAddr: "10.0.0.1:1234", wantIP: "10.0.0.1", wantTrusted: true},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.7"}, wantIP: "198.51.100.7", wantTrusted: true},
+		{name: "skips trusted hops", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.2.3.4, 198.51.100.7", "10.0.0.2"}, wantIP: "198.51.100.7", wantTrusted: true},
+		{name: "ipv6 peer", remoteAddr: "[fd00::1]:1234", forwardedFor: []string{"2001:db8::7"}, wantIP: "2001:db8::7", wantTrusted: true},
+		{name: "garbage hop stops the walk", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.2.3.4, garbage, 10.0.0.3"}, wantIP: "10.0.0.3", wantTrusted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			client := trust.Resolve(req)
+			if client.IP != tt.wantIP || client.PeerTrusted != tt.wantTrusted {
+				t.Errorf("Resolve() = %+v, want IP %s trusted %v", client, tt.wantIP, tt.wantTrusted)
+			}
+		})
+	}
+}
+
+// TestReverseProxyForwardedFor tests the forwarding headers received by the target.
+func TestReverseProxyForwardedFor(t *testing.T) {
+	var received http.Header
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	backendURL, _ := url.Parse(backendServer.URL)
+	route := &Route{
+		Name:           "route1",
+		Pattern:        "/",
+		Protocol:       "http",
+		ListenPort:     6446,
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Target:         Target{Protocol: "http", Host: "localhost", Port: 8080},
+	}
+	proxy, err := NewReverseProxy(context.Background(), route)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	proxy.Proxy.Director = func(req *http.Request) {
+		req.URL.Scheme = backendURL.Scheme
+		req.URL.Host = backendURL.Host
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantFor    string
+		wantProto  string
+		wantRealIP string
+	}{
+		{name: "untrusted peer", remoteAddr: "203.0.113.5:1234", wantFor: "203.0.113.5", wantProto: "http", wantRealIP: "203.0.113.5"},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", wantFor: "198.51.100.7, 10.0.0.1", wantProto: "https", wantRealIP: "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/path?q=1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Real-IP", "1.1.1.1")
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status OK but got %v", w.Code)
+			}
+
+			if got := received.Get("X-Forwarded-For"); got != tt.wantFor {
+				t.Errorf("Expected X-Forwarded-For %q but got %q", tt.wantFor, got)
+			}
+			if got := received.Get("X-Forwarded-Proto"); got != tt.wantProto {
+				t.Errorf("Expected X-Forwarded-Proto %q but got %q", tt.wantProto, got)
+			}
+			if got := received.Get("X-Real-IP"); got != tt.wantRealIP {
+				t.Errorf("Expected X-Real-IP %q but got %q", tt.wantRealIP, got)
+			}
+			if got := received.Get("X-Forwarded-Port"); got != "6446" {
+				t.Errorf("Expected X-Forwarded-Port 6446 but got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"reverseproxy/internal/constants"
+	"strings"
+	"text/template"
+)
+
+// UpstreamCredentials configures credentials the proxy adds to requests sent to a target,
+// so callers do not need to hold them.
+// BearerTokenFile is read into the Authorization header and reloaded when it changes, e.g. a service-account token.
+// Headers are set on every request; their values may use templates such as "{{.User}}".
+// Impersonate sets the Kubernetes "Impersonate-User" and "Impersonate-Group" headers from the authenticated identity.
+type UpstreamCredentials struct {
+	BearerTokenFile string        `yaml:"bearertokenfile omitempty=false"`
+	Headers         []HeaderValue `yaml:"headers omitempty=false"`
+	Impersonate     bool          `yaml:"impersonate omitempty=false"`
+}
+
+// HeaderValue is a header name and value; the value may be a template.
+type HeaderValue struct {
+	Name  string `yaml:"name omitempty=false"`
+	Value string `yaml:"value omitempty=false"`
+}
+
+// headerTemplate is a parsed HeaderValue.
+type headerTemplate struct {
+	name     string
+	template *template.Template
+}
+
+// headerTemplateData is the data available to header templates.
+type headerTemplateData struct {
+	Route     string
+	Host      string
+	Method    string
+	Path      string
+	ClientIP  string
+	RequestID string
+	User      string
+	Groups    []string
+	Claims    map[string]any
+	Captures  map[string]string // set by the header rules
+}
+
+// headerTemplateFuncs are the functions available to header templates.
+var headerTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"env":  os.Getenv,
+}
+
+// validateUpstreamCredentials validates the upstream credentials of a target.
+// Impersonation needs an authentication middleware on the route to provide the identity.
+func validateUpstreamCredentials(targetName string, credentials *UpstreamCredentials, authenticated bool) error {
+	if credentials.Impersonate && !authenticated {
+		return fmt.Errorf("credentials impersonate requires authentication on the route for target %s", targetName)
+	}
+	for _, header := range credentials.Headers {
+		if _, err := parseHeaderTemplate(header); err != nil {
+			return fmt.Errorf("invalid credentials header for target %s: %w", targetName, err)
+		}
+	}
+	return nil
+}
+
+// parseHeaderTemplate parses the value of a header as a template.
+func parseHeaderTemplate(header HeaderValue) (*headerTemplate, error) {
+	if header.Name == "" {
+		return nil, errors.New("header name is required")
+	}
+	tmpl, err := template.New(header.Name).Funcs(headerTemplateFuncs).Option("missingkey=zero").Parse(header.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &headerTemplate{name: textproto.CanonicalMIMEHeaderKey(header.Name), template: tmpl}, nil
+}
+
+// newHeaderTemplateData returns the template data of the request.
+func newHeaderTemplateData(routeName string, r *http.Request) *headerTemplateData {
+	data := &headerTemplateData{
+		Route:     routeName,
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		ClientIP:  clientIP(r),
+		RequestID: r.Header.Get(constants.RequestIDHeader),
+	}
+	if identity, ok := identityFromContext(r.Context()); ok {
+		data.User = identity.User
+		data.Groups = identity.Groups
+		data.Claims = identity.Claims
+	}
+	return data
+}
+
+// render executes the template with the data.
+func (ht *headerTemplate) render(data *headerTemplateData) (string, error) {
+	var value bytes.Buffer
+	if err := ht.template.Execute(&value, data); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+// CredentialInjector adds the configured credentials to upstream requests.
+type CredentialInjector struct {
+	RouteName string
+	Config    *UpstreamCredentials
+
+	token   *reloadableFile[string]
+	headers []*headerTemplate
+}
+
+// NewCredentialInjector loads the token file and parses the header templates of the configuration.
+func NewCredentialInjector(routeName string, config *UpstreamCredentials) (*CredentialInjector, error) {
+	ci := &CredentialInjector{RouteName: routeName, Config: config}
+	if config.BearerTokenFile != "" {
+		token, err := newReloadableFile(config.BearerTokenFile, parseBearerToken)
+		if err != nil {
+			return nil, fmt.Errorf("error loading bearer token file for route %s: %w", routeName, err)
+		}
+		ci.token = token
+	}
+	for _, header := range config.Headers {
+		tmpl, err := parseHeaderTemplate(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials header for route %s: %w", routeName, err)
+		}
+		ci.headers = append(ci.headers, tmpl)
+	}
+	return ci, nil
+}
+
+// parseBearerToken trims the token file content.
+func parseBearerToken(data []byte) (string, error) {
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("bearer token file is empty")
+	}
+	return token, nil
+}
+
+// Middleware replaces client supplied credentials with the configured ones.
+// Impersonation headers from the client are always removed, since the upstream would
+// honour them with the authority of the injected credentials.
+func (ci *CredentialInjector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key := range r.Header {
+			if strings.HasPrefix(key, constants.ImpersonateHeaderPrefix) {
+				r.Header.Del(key)
+			}
+		}
+
+		if ci.token != nil {
+			r.Header.Set(constants.AuthorizationHeader, "Bearer "+ci.token.Load())
+		}
+
+		if ci.Config.Impersonate {
+			identity, ok := identityFromContext(r.Context())
+			if !ok || identity.User == "" {
+				log.Warn("No identity to impersonate", ci.RouteName, clientIP(r))
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			r.Header.Set(constants.ImpersonateUserHeader, identity.User)
+			for _, group := range identity.Groups {
+				r.Header.Add(constants.ImpersonateGroupHeader, group)
+			}
+		}
+
+		if len(ci.headers) > 0 {
+			data := newHeaderTemplateData(ci.RouteName, r)
+			for _, header := range ci.headers {
+				value, err := header.render(data)
+				if err != nil {
+					log.Error("Error rendering credentials header", ci.RouteName, header.name, err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				r.Header.Set(header.name, value)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCredentialInjectorMiddleware tests the bearer token, templated headers and impersonation headers.
+func TestCredentialInjectorMiddleware(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	injector, err := NewCredentialInjector("proxy-k8s", &UpstreamCredentials{
+		BearerTokenFile: tokenFile,
+		Impersonate:     true,
+		Headers: []HeaderValue{
+			{Name: "x-proxy-route", Value: "{{.Route}}"},
+			{Name: "X-Proxy-Groups", Value: `{{join .Groups ","}}`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create injector: %v", err)
+	}
+
+	var upstream *http.Request
+	handler := injector.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods", nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+	req.Header.Set("Impersonate-User", "system:admin")
+	req.Header.Set("Impersonate-Extra-Scopes", "all")
+	req = withIdentity(req, &Identity{User: "alice", Groups: []string{"dev", "ops"}, Method: "oidc"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK but got %d", w.Code)
+	}
+	if got := upstream.Header.Get("Authorization"); got != "Bearer sa-token" {
+		t.Errorf("Expected the injected token but got %q", got)
+	}
+	if got := upstream.Header.Get("Impersonate-User"); got != "alice" {
+		t.Errorf("Expected Impersonate-User alice but got %q", got)
+	}
+	if got := upstream.Header.Values("Impersonate-Group"); len(got) != 2 || got[0] != "dev" || got[1] != "ops" {
+		t.Errorf("Expected Impersonate-Group dev and ops but got %v", got)
+	}
+	if got := upstream.Header.Get("Impersonate-Extra-Scopes"); got != "" {
+		t.Errorf("Expected client impersonation headers to be removed but got %q", got)
+	}
+	if upstream.Header.Get("X-Proxy-Route") != "proxy-k8s" || upstream.Header.Get("X-Proxy-Groups") != "dev,ops" {
+		t.Errorf("Unexpected templated headers %v", upstream.Header)
+	}
+
+	// without an identity there is nobody to impersonate
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without identity but got %d", w.Code)
+	}
+}
+
+// TestValidateUpstreamCredentials tests the credentials configuration validation.
+func TestValidateUpstreamCredentials(t *testing.T) {
+	if err := validateUpstreamCredentials("k8s", &UpstreamCredentials{Impersonate: true}, false); err == nil {
+		t.Errorf("Expected error for impersonation without authentication")
+	}
+	if err := validateUpstreamCredentials("k8s", &UpstreamCredentials{Headers: []HeaderValue{{Name: "X-User", Value: "{{.User"}}}, false); err == nil {
+		t.Errorf("Expected error for an invalid template")
+	}
+	if err := validateUpstreamCredentials("k8s", &UpstreamCredentials{Headers: []HeaderValue{{Value: "a"}}}, false); err == nil {
+		t.Errorf("Expected error for a missing header name")
+	}
+	if err := validateUpstreamCredentials("k8s", &UpstreamCredentials{Impersonate: true}, true); err != nil {
+		t.Errorf("Expected valid config but got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"reverseproxy/internal/constants"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WAF configures request filtering rules for a route.
+// Rules are read from a YAML file that is reloaded when it changes. In "block" mode (default)
+// matching block rules reject the request; in "detect" mode matches are only logged and counted.
+type WAF struct {
+	RulesFile       string `yaml:"rulesfile omitempty=false"`
+	Mode            string `yaml:"mode omitempty=false"`
+	BlockStatus     int    `yaml:"blockstatus omitempty=false"`     // defaults to 403
+	TagHeader       string `yaml:"tagheader omitempty=false"`       // carries the IDs of matched tag rules upstream, defaults to X-WAF-Tags
+	BodyPrefixBytes int    `yaml:"bodyprefixbytes omitempty=false"` // inspected body prefix, defaults to constants.WAFBodyPrefixBytes
+}
+
+// wafRulesFile is the format of the rules file.
+type wafRulesFile struct {
+	Rules []wafRule `yaml:"rules"`
+}
+
+// wafRule blocks or tags requests matching all of its conditions.
+type wafRule struct {
+	ID     string         `yaml:"id"`
+	Action string         `yaml:"action"` // block (default) or tag
+	Match  []wafCondition `yaml:"match"`
+}
+
+// wafCondition matches a request field against a regular expression or a list of literals.
+// Literals match case-insensitively anywhere in the field.
+type wafCondition struct {
+	Field  string   `yaml:"field"`  // method, path, query, header, useragent or body
+	Header string   `yaml:"header"` // header name when Field is "header"
+	Regex  string   `yaml:"regex"`
+	Values []string `yaml:"values"`
+
+	regex *regexp.Regexp
+}
+
+// wafRuleSet is a parsed rules file.
+type wafRuleSet struct {
+	rules       []*wafRule
+	inspectBody bool
+}
+
+// validateWAF validates the WAF configuration of a route.
+func validateWAF(routeName string, waf *WAF) error {
+	if waf.RulesFile == "" {
+		return fmt.Errorf("waf rulesfile is required for route %s", routeName)
+	}
+	switch waf.Mode {
+	case "", constants.WAFModeBlock, constants.WAFModeDetect:
+	default:
+		return fmt.Errorf("invalid waf mode %s for route %s", waf.Mode, routeName)
+	}
+	if waf.BlockStatus != 0 && (waf.BlockStatus < 400 || waf.BlockStatus > 599) {
+		return fmt.Errorf("invalid waf blockstatus for route %s", routeName)
+	}
+	if waf.BodyPrefixBytes < 0 {
+		return fmt.Errorf("invalid waf bodyprefixbytes for route %s", routeName)
+	}
+	return nil
+}
+
+// parseWAFRules parses and compiles the rules file.
+func parseWAFRules(data []byte) (*wafRuleSet, error) {
+	file := wafRulesFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	set := &wafRuleSet{}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.ID == "" {
+			return nil, fmt.Errorf("id is required for waf rule %d", i+1)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = constants.WAFActionBlock
+		case constants.WAFActionBlock, constants.WAFActionTag:
+		default:
+			return nil, fmt.Errorf("invalid action %s for waf rule %s", rule.Action, rule.ID)
+		}
+		if len(rule.Match) == 0 {
+			return nil, fmt.Errorf("match is required for waf rule %s", rule.ID)
+		}
+		for j := range rule.Match {
+			condition := &rule.Match[j]
+			switch condition.Field {
+			case "method", "path", "query", "useragent":
+			case "body":
+				set.inspectBody = true
+			case "header":
+				if condition.Header == "" {
+					return nil, fmt.Errorf("header is required for waf rule %s", rule.ID)
+				}
+			default:
+				return nil, fmt.Errorf("invalid field %s for waf rule %s", condition.Field, rule.ID)
+			}
+			if (condition.Regex == "") == (len(condition.Values) == 0) {
+				return nil, fmt.Errorf("either regex or values is required for waf rule %s", rule.ID)
+			}
+			if condition.Regex != "" {
+				re, err := regexp.Compile(condition.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex for waf rule %s: %w", rule.ID, err)
+				}
+				condition.regex = re
+			}
+			for k, value := range condition.Values {
+				condition.Values[k] = strings.ToLower(value)
+			}
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+// wafRequest holds the fields of a request the rules match against.
+type wafRequest struct {
+	r     *http.Request
+	path  string
+	query string
+	body  []byte
+}
+
+// field returns the value of a condition field.
+func (wr *wafRequest) field(condition *wafCondition) string {
+	switch condition.Field {
+	case "method":
+		return wr.r.Method
+	case "path":
+		return wr.path
+	case "query":
+		return wr.query
+	case "useragent":
+		return wr.r.UserAgent()
+	case "header":
+		return strings.Join(wr.r.Header.Values(condition.Header), ",")
+	case "body":
+		return string(wr.body)
+	}
+	return ""
+}
+
+// matches reports whether the condition matches the request.
+func (c *wafCondition) matches(wr *wafRequest) bool {
+	value := wr.field(c)
+	if c.regex != nil {
+		return c.regex.MatchString(value)
+	}
+	value = strings.ToLower(value)
+	for _, literal := range c.Values {
+		if strings.Contains(value, literal) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether all conditions of the rule match the request.
+func (rule *wafRule) matches(wr *wafRequest) bool {
+	for i := range rule.Match {
+		if !rule.Match[i].matches(wr) {
+			return false
+		}
+	}
+	return true
+}
+
+// WAFEngine applies the rules of a route to requests.
+type WAFEngine struct {
+	RouteName string
+	Config    *WAF
+
+	rules *reloadableFile[*wafRuleSet]
+}
+
+// NewWAFEngine loads the rules file of the configuration.
+func NewWAFEngine(routeName string, config *WAF) (*WAFEngine, error) {
+	rules, err := newReloadableFile(config.RulesFile, parseWAFRules)
+	if err != nil {
+		return nil, fmt.Errorf("error loading waf rules file for route %s: %w", routeName, err)
+	}
+	return &WAFEngine{RouteName: routeName, Config: config, rules: rules}, nil
+}
+
+// newWAFRequest collects the fields of the request, reading the body prefix if a rule needs it.
+// The body is restored so the upstream still receives it in full.
+func (we *WAFEngine) newWAFRequest(r *http.Request, inspectBody bool) (*wafRequest, error) {
+	wr := &wafRequest{r: r, path: r.URL.Path, query: r.URL.RawQuery}
+	if query, err := url.QueryUnescape(r.URL.RawQuery); err == nil {
+		wr.query = query
+	}
+
+	if inspectBody && r.Body != nil && r.Body != http.NoBody {
+		limit := we.Config.BodyPrefixBytes
+		if limit == 0 {
+			limit = constants.WAFBodyPrefixBytes
+		}
+		prefix, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		wr.body = prefix
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+	}
+	return wr, nil
+}
+
+// tagHeader returns the header carrying the matched tag rules upstream.
+func (we *WAFEngine) tagHeader() string {
+	if we.Config.TagHeader != "" {
+		return we.Config.TagHeader
+	}
+	return constants.WAFTagHeader
+}
+
+// Middleware matches the request against the rules, blocking it or tagging it for the upstream.
+func (we *WAFEngine) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(we.tagHeader())
+		rules := we.rules.Load()
+
+		wr, err := we.newWAFRequest(r, rules.inspectBody)
+		if err != nil {
+			if reason := bodyLimitReason(r); reason != "" {
+				rejectBody(w, we.RouteName, reason)
+				return
+			}
+			log.Warn("Error reading request body", we.RouteName, err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		detectOnly := we.Config.Mode == constants.WAFModeDetect
+		tags := []string{}
+		for _, rule := range rules.rules {
+			if !rule.matches(wr) {
+				continue
+			}
+
+			action := rule.Action
+			if detectOnly && action == constants.WAFActionBlock {
+				action = constants.WAFModeDetect
+			}
+			constants.WAFRuleHitsTotal.WithLabelValues(we.RouteName, rule.ID, action).Inc()
+			log.Warn("WAF rule matched", we.RouteName, rule.ID, action, clientIP(r), r.Method, r.URL.Path)
+
+			switch action {
+			case constants.WAFActionBlock:
+				status := we.Config.BlockStatus
+				if status == 0 {
+					status = http.StatusForbidden
+				}
+				http.Error(w, http.StatusText(status), status)
+				return
+			case constants.WAFActionTag:
+				tags = append(tags, rule.ID)
+			}
+		}
+
+		if len(tags) > 0 {
+			r.Header.Set(we.tagHeader(), strings.Join(tags, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package reverseproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reverseproxy/internal/constants"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testWAFRules covers the fields and match types of the rules file.
+const testWAFRules = `rules:
+  - id: path-traversal
+    match:
+      - field: path
+        regex: '\.\./'
+  - id: sqli
+    match:
+      - field: query
+        regex: '(?i)union\s+select'
+  - id: sqli-body
+    match:
+      - field: method
+        values: ["POST"]
+      - field: body
+        regex: '(?i)or\s+1=1'
+  - id: bad-bot
+    match:
+      - field: useragent
+        values: ["sqlmap", "Nikto"]
+  - id: legacy-client
+    action: tag
+    match:
+      - field: header
+        header: X-Client-Version
+        regex: '^1\.'
+`
+
+// newTestWAFEngine writes the rules and creates an engine in the mode.
+func newTestWAFEngine(t *testing.T, routeName, mode string) *WAFEngine {
+	rulesFile := filepath.Join(t.TempDir(), "waf.yaml")
+	if err := os.WriteFile(rulesFile, []byte(testWAFRules), 0o600); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+	engine, err := NewWAFEngine(routeName, &WAF{RulesFile: rulesFile, Mode: mode, BodyPrefixBytes: 64})
+	if err != nil {
+		t.Fatalf("Failed to create WAF engine: %v", err)
+	}
+	return engine
+}
+
+// TestWAFEngineMiddleware tests blocking and tagging by the rules in block mode.
+func TestWAFEngineMiddleware(t *testing.T) {
+	engine := newTestWAFEngine(t, "waf-block", "")
+
+	var upstream *http.Request
+	var upstreamBody string
+	handler := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	longBody := "name=alice&comment=" + strings.Repeat("a", 100) + "' or 1=1 --"
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		body      string
+		headers   map[string]string
+		wantCode  int
+		wantRule  string
+		wantTags  string
+		wantBody  string
+		checkBody bool
+	}{
+		{name: "clean", method: http.MethodGet, target: "/api/items?page=2", wantCode: http.StatusOK},
+		{name: "path traversal", method: http.MethodGet, target: "/static/../../etc/passwd", wantCode: http.StatusForbidden, wantRule: "path-traversal"},
+		{name: "encoded sqli in query", method: http.MethodGet, target: "/search?q=1%20UNION%20SELECT%20password", wantCode: http.StatusForbidden, wantRule: "sqli"},
+		{name: "sqli in body", method: http.MethodPost, target: "/login", body: "user=admin' OR 1=1 --", wantCode: http.StatusForbidden, wantRule: "sqli-body"},
+		{name: "sqli in body of other method", method: http.MethodPut, target: "/login", body: "user=admin' OR 1=1 --", wantCode: http.StatusOK, wantBody: "user=admin' OR 1=1 --", checkBody: true},
+		{name: "signature beyond body prefix", method: http.MethodPost, target: "/comment", body: longBody, wantCode: http.StatusOK, wantBody: longBody, checkBody: true},
+		{name: "bad bot", method: http.MethodGet, target: "/", headers: map[string]string{"User-Agent": "Mozilla/5.0 nikto/2.5"}, wantCode: http.StatusForbidden, wantRule: "bad-bot"},
+		{name: "tagged", method: http.MethodGet, target: "/", headers: map[string]string{"X-Client-Version": "1.4.2", "X-WAF-Tags": "spoofed"}, wantCode: http.StatusOK, wantTags: "legacy-client"},
+		{name: "client tags removed", method: http.MethodGet, target: "/", headers: map[string]string{"X-WAF-Tags": "spoofed"}, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			var before float64
+			if tt.wantRule != "" {
+				before = testutil.ToFloat64(constants.WAFRuleHitsTotal.WithLabelValues("waf-block", tt.wantRule, "block"))
+			}
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d but got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantRule != "" {
+				if after := testutil.ToFloat64(constants.WAFRuleHitsTotal.WithLabelValues("waf-block", tt.wantRule, "block")); after != before+1 {
+					t.Errorf("Expected a hit of rule %s to be counted", tt.wantRule)
+				}
+				return
+			}
+			if got := upstream.Header.Get("X-WAF-Tags"); got != tt.wantTags {
+				t.Errorf("Expected tags %q but got %q", tt.wantTags, got)
+			}
+			if tt.checkBody && upstreamBody != tt.wantBody {
+				t.Errorf("Expected the upstream to receive the full body but got %q", upstreamBody)
+			}
+		})
+	}
+}
+
+// TestWAFEngineDetectMode tests that matches are counted but not blocked in detect mode.
+func TestWAFEngineDetectMode(t *testing.T) {
+	engine := newTestWAFEngine(t, "waf-detect", "detect")
+	handler := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	before := testutil.ToFloat64(constants.WAFRuleHitsTotal.WithLabelValues("waf-detect", "path-traversal", "detect"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/../../etc/passwd", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status OK in detect mode but got %d", w.Code)
+	}
+	if after := testutil.ToFloat64(constants.WAFRuleHitsTotal.WithLabelValues("waf-detect", "path-traversal", "detect")); after != before+1 {
+		t.Errorf("Expected the detected hit to be counted")
+	}
+}
+
+// TestParseWAFRules tests the rules file validation.
+func TestParseWAFRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "valid", data: testWAFRules},
+		{name: "missing id", data: "rules:\n  - match:\n      - field: path\n        regex: a\n", wantErr: true},
+		{name: "invalid action", data: "rules:\n  - id: a\n    action: drop\n    match:\n      - field: path\n        regex: a\n", wantErr: true},
+		{name: "invalid field", data: "rules:\n  - id: a\n    match:\n      - field: cookie\n        regex: a\n", wantErr: true},
+		{name: "header without name", data: "rules:\n  - id: a\n    match:\n      - field: header\n        regex: a\n", wantErr: true},
+		{name: "regex and values", data: "rules:\n  - id: a\n    match:\n      - field: path\n        regex: a\n        values: [b]\n", wantErr: true},
+		{name: "invalid regex", data: "rules:\n  - id: a\n    match:\n      - field: path\n        regex: '('\n", wantErr: true},
+		{name: "no conditions", data: "rules:\n  - id: a\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseWAFRules([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("parseWAFRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}